@@ -1,7 +1,10 @@
 package add
 
 import (
+	"cloudsave/cmd/cli/tools/flags"
 	"cloudsave/pkg/data"
+	"cloudsave/pkg/tools/filter"
+	"cloudsave/pkg/tools/paths"
 	"context"
 	"flag"
 	"fmt"
@@ -16,15 +19,25 @@ type (
 		Service *data.Service
 		name    string
 		remote  string
+		include flags.Strings
+		exclude flags.Strings
+		roots   flags.Roots
 	}
 )
 
 func (*AddCmd) Name() string     { return "add" }
 func (*AddCmd) Synopsis() string { return "add a folder to the sync list" }
 func (*AddCmd) Usage() string {
-	return `Usage: cloudsave add [-name] [-remote] <PATH>
+	return `Usage: cloudsave add [-name] [-remote] [-include GLOB]... [-exclude GLOB]... [-root NAME=PATH]... <PATH>
 
 Add a folder to the track list
+
+The game can have other folders (e.g. the settings), each of them is
+archived with the save under its name.
+
+The files matching an exclude pattern (and, if there are include patterns,
+the files that match none of them) are not archived. More exclude patterns
+can be written in the file .cloudsaveignore of the folder, one per line.
 	
 Options:
 `
@@ -33,6 +46,9 @@ Options:
 func (p *AddCmd) SetFlags(f *flag.FlagSet) {
 	f.StringVar(&p.name, "name", "", "Override the name of the game")
 	f.StringVar(&p.remote, "remote", "", "Defines a remote server to sync with")
+	f.Var(&p.include, "include", "Only archive the files matching this glob, can be repeated")
+	f.Var(&p.exclude, "exclude", "Do not archive the files matching this glob (e.g. '*.log' or 'cache/'), can be repeated")
+	f.Var(&p.roots, "root", "Another folder of the game, as NAME=PATH, can be repeated")
 }
 
 func (p *AddCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -40,7 +56,7 @@ func (p *AddCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) s
 		fmt.Fprintln(os.Stderr, "error: the command is expecting for 1 argument")
 		return subcommands.ExitUsageError
 	}
-	path, err := filepath.Abs(f.Arg(0))
+	path, err := paths.Abs(f.Arg(0))
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error: cannot get the absolute path for this entry:", err)
 		return subcommands.ExitFailure
@@ -50,12 +66,35 @@ func (p *AddCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) s
 		p.name = filepath.Base(path)
 	}
 
+	if _, err := filter.New(p.include, p.exclude); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return subcommands.ExitUsageError
+	}
+	if err := data.CheckRoots(path, p.roots); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return subcommands.ExitUsageError
+	}
+
 	gameID, err := p.Service.Add(p.name, path, p.remote)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error: failed to add this gamesave to the datastore:", err)
 		return subcommands.ExitFailure
 	}
 
+	if len(p.include) > 0 || len(p.exclude) > 0 {
+		if err := p.Service.SetFilters(gameID, p.include, p.exclude); err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to save the patterns:", err)
+			return subcommands.ExitFailure
+		}
+	}
+
+	if len(p.roots) > 0 {
+		if err := p.Service.SetRoots(gameID, p.roots); err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to save the roots:", err)
+			return subcommands.ExitFailure
+		}
+	}
+
 	if _, err := p.Service.Scan(gameID); err != nil {
 		fmt.Fprintln(os.Stderr, "error: failed to scan:", err)
 		return subcommands.ExitFailure
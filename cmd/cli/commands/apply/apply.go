@@ -2,30 +2,40 @@ package apply
 
 import (
 	"cloudsave/pkg/data"
+	"cloudsave/pkg/tools/archive"
 	"context"
 	"flag"
 	"fmt"
 	"os"
+	"time"
 
 	"github.com/google/subcommands"
 )
 
 type (
 	ApplyCmd struct {
-		Service *data.Service
+		Service  *data.Service
+		preview  bool
+		to       string
+		symlinks string
 	}
 )
 
 func (*ApplyCmd) Name() string     { return "apply" }
 func (*ApplyCmd) Synopsis() string { return "apply a backup" }
 func (*ApplyCmd) Usage() string {
-	return `Usage: cloudsave apply <GAME_ID> [BACKUP_ID]
+	return `Usage: cloudsave apply [-preview] [-to PATH] [-symlinks allow|skip|reject] <GAME_ID> [BACKUP_ID]
 
-Apply a backup
+Apply a backup. The save directory is saved in a backup before being replaced.
+
+Options:
 `
 }
 
 func (p *ApplyCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&p.preview, "preview", false, "list the files that would be added, changed or deleted")
+	f.StringVar(&p.to, "to", "", "extract in this directory instead of the save directory, it must be empty")
+	f.StringVar(&p.symlinks, "symlinks", "allow", "what to do with the symbolic links of the archive: allow (only inside the save directory), skip (the other entries are still extracted) or reject")
 }
 
 func (p *ApplyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
@@ -37,6 +47,53 @@ func (p *ApplyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{})
 	gameID := f.Arg(0)
 	uuid := f.Arg(1)
 
+	policy, err := archive.ParsePolicy(p.symlinks)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return subcommands.ExitUsageError
+	}
+	opts := p.Service.ExtractOptions()
+	opts.Symlinks = policy
+	p.Service.SetExtractOptions(opts)
+
+	if p.preview {
+		c, err := p.Service.Preview(gameID, uuid, p.to)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to compare:", err)
+			return subcommands.ExitFailure
+		}
+		for _, name := range c.Added {
+			fmt.Println("+", name)
+		}
+		for _, name := range c.Changed {
+			fmt.Println("~", name)
+		}
+		for _, name := range c.Deleted {
+			fmt.Println("-", name)
+		}
+		if len(c.Added)+len(c.Changed)+len(c.Deleted) == 0 {
+			fmt.Println("no change")
+		}
+		return subcommands.ExitSuccess
+	}
+
+	if len(p.to) > 0 {
+		if err := p.Service.ApplyTo(gameID, uuid, p.to); err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to apply:", err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+
+	backupID, err := p.Service.BackupDirectory(gameID, "before apply at "+time.Now().Format(time.DateTime))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to save the save directory:", err)
+		return subcommands.ExitFailure
+	}
+	if len(backupID) > 0 {
+		fmt.Println("the save directory is kept in the backup", backupID)
+	}
+
 	if len(uuid) == 0 {
 		if err := p.Service.ApplyCurrent(gameID); err != nil {
 			fmt.Fprintf(os.Stderr, "error: failed to apply: %s", err)
@@ -0,0 +1,134 @@
+package edit
+
+import (
+	"cloudsave/cmd/cli/tools/flags"
+	"cloudsave/pkg/data"
+	"cloudsave/pkg/repository"
+	"cloudsave/pkg/tools/filter"
+	"cloudsave/pkg/tools/paths"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+	"slices"
+
+	"github.com/google/subcommands"
+)
+
+type (
+	EditCmd struct {
+		Service *data.Service
+		name    string
+		path    string
+		include flags.Strings
+		exclude flags.Strings
+		remove  flags.Strings
+		clear   bool
+		roots   flags.Roots
+		unroot  flags.Strings
+	}
+)
+
+func (*EditCmd) Name() string     { return "edit" }
+func (*EditCmd) Synopsis() string { return "change the name, the folders or the patterns of a game" }
+func (*EditCmd) Usage() string {
+	return `Usage: cloudsave edit [-name NAME] [-path PATH] [-root NAME=PATH]... [-remove-root NAME]... [-include GLOB]... [-exclude GLOB]... [-remove GLOB]... [-clear] <GAME_ID>
+
+Change the name, the folders or the include/exclude patterns of a game.
+The changes are used from the next scan.
+
+Options:
+`
+}
+
+func (p *EditCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.name, "name", "", "new name of the game")
+	f.StringVar(&p.path, "path", "", "new path of the save directory")
+	f.Var(&p.include, "include", "add an include pattern, can be repeated")
+	f.Var(&p.exclude, "exclude", "add an exclude pattern, can be repeated")
+	f.Var(&p.remove, "remove", "remove an include or exclude pattern, can be repeated")
+	f.BoolVar(&p.clear, "clear", false, "remove every pattern before adding the new ones")
+	f.Var(&p.roots, "root", "add or move another folder of the game, as NAME=PATH, can be repeated")
+	f.Var(&p.unroot, "remove-root", "stop tracking another folder of the game, can be repeated")
+}
+
+func (p *EditCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 {
+		fmt.Fprintln(os.Stderr, "error: the command is expecting for 1 argument")
+		return subcommands.ExitUsageError
+	}
+	gameID := f.Arg(0)
+
+	g, err := p.Service.One(gameID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to get the game:", err)
+		return subcommands.ExitFailure
+	}
+
+	if len(p.name) > 0 {
+		g.Name = p.name
+	}
+	if len(p.path) > 0 {
+		path, err := paths.Abs(p.path)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: cannot get the absolute path for this entry:", err)
+			return subcommands.ExitFailure
+		}
+		p.Service.SetPath(&g, path)
+	}
+
+	// the paths are changed for this device only
+	for _, r := range p.roots {
+		i := slices.IndexFunc(g.Roots, func(v repository.Root) bool { return v.Name == r.Name })
+		if i < 0 {
+			g.Roots = append(g.Roots, repository.Root{Name: r.Name})
+			i = len(g.Roots) - 1
+		}
+		p.Service.SetRootPath(&g.Roots[i], r.Path)
+	}
+	g.Roots = slices.DeleteFunc(g.Roots, func(v repository.Root) bool {
+		return slices.Contains(p.unroot, v.Name)
+	})
+
+	path, err := p.Service.Location(g)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return subcommands.ExitFailure
+	}
+	if err := data.CheckRoots(path, p.Service.LocalRoots(g)); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return subcommands.ExitUsageError
+	}
+
+	include, exclude := g.Include, g.Exclude
+	if p.clear {
+		include, exclude = nil, nil
+	}
+	include = edit(include, p.include, p.remove)
+	exclude = edit(exclude, p.exclude, p.remove)
+
+	if _, err := filter.New(include, exclude); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return subcommands.ExitUsageError
+	}
+	g.Include, g.Exclude = include, exclude
+
+	if err := p.Service.UpdateMetadata(gameID, g); err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to save the game:", err)
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
+
+// edit appends the new patterns to the list, then removes the given ones
+func edit(list, add, remove []string) []string {
+	for _, v := range add {
+		if !slices.Contains(list, v) {
+			list = append(list, v)
+		}
+	}
+	return slices.DeleteFunc(list, func(v string) bool {
+		return slices.Contains(remove, v)
+	})
+}
@@ -0,0 +1,130 @@
+package launch
+
+import (
+	"cloudsave/cmd/cli/commands/sync"
+	"cloudsave/pkg/data"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+)
+
+type (
+	LaunchCmd struct {
+		Service    *data.Service
+		force      bool
+		noSync     bool
+		steal      bool
+		onConflict sync.ConflictPolicy
+	}
+)
+
+func (*LaunchCmd) Name() string     { return "run" }
+func (*LaunchCmd) Synopsis() string { return "sync a game, launch it, then save and push it" }
+func (*LaunchCmd) Usage() string {
+	return `Usage: cloudsave run [-force] [-steal] [-no-sync] [-on-conflict=ask|local|remote|newest|keep-both|skip] <GAME_ID> [--] <COMMAND> [ARGS]...
+
+Synchronize the game and apply the newest save, launch the command and
+wait for it to exit, then scan the save and push it. The exit code is the
+one of the command.
+
+The command is not launched if a conflict with the remote is not resolved,
+unless -force is set. The game is launched with the local save if the
+remote cannot be reached.
+
+The save is checked out on the server while the command runs, the
+other devices are warned when they sync it. The command is not launched
+if another device checked it out, unless -steal is set.
+
+e.g. as a Steam launch option: cloudsave run GAME_ID -- %command%
+The credentials are read from CLOUDSAVE_USERNAME and CLOUDSAVE_PASSWORD
+when there is no terminal.
+
+Options:
+`
+}
+
+func (p *LaunchCmd) SetFlags(f *flag.FlagSet) {
+	p.onConflict = sync.PolicySkip
+	f.BoolVar(&p.force, "force", false, "launch the command even if a conflict is not resolved")
+	f.BoolVar(&p.steal, "steal", false, "check out the save even if another device plays the game")
+	f.BoolVar(&p.noSync, "no-sync", false, "only scan the save, before and after the command")
+	f.Var(&p.onConflict, "on-conflict", "how to resolve a conflict: ask, local, remote, newest (most recent date), keep-both (save both versions in backups) or skip")
+}
+
+func (p *LaunchCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	args := f.Args()
+	if len(args) > 1 && args[1] == "--" {
+		args = append(args[:1], args[2:]...)
+	}
+	if len(args) < 2 {
+		fmt.Fprintln(os.Stderr, "error: missing game ID and/or command")
+		return subcommands.ExitUsageError
+	}
+	gameID := args[0]
+
+	g, err := p.Service.One(gameID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to get the game:", err)
+		return subcommands.ExitFailure
+	}
+
+	syncer := sync.New(p.Service, p.onConflict)
+
+	// the changes made without the wrapper are kept before the sync
+	if _, err := p.Service.Scan(gameID); err != nil {
+		fmt.Fprintln(os.Stderr, "warning: failed to scan the save:", err)
+	}
+
+	// the scan may have made a new version, the sync needs its metadata
+	if g, err = p.Service.One(gameID); err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to get the game:", err)
+		return subcommands.ExitFailure
+	}
+
+	release := func() {}
+	if !p.noSync {
+		release, err = p.checkout(syncer, g)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return subcommands.ExitFailure
+		}
+	}
+	defer release()
+
+	if !p.noSync {
+		err := syncer.Sync(g)
+		switch {
+		case errors.Is(err, sync.ErrUnresolved) && !p.force:
+			fmt.Fprintf(os.Stderr, "error: the save of %s is in conflict with the remote, resolve it with `cloudsave sync` or use -force\n", g.Name)
+			return subcommands.ExitFailure
+		case errors.Is(err, sync.ErrUnresolved):
+			fmt.Fprintln(os.Stderr, "warning: the conflict is not resolved, the game is launched with the local save")
+		case err != nil:
+			fmt.Fprintln(os.Stderr, "warning: failed to sync, the game is launched with the local save:", err)
+		}
+	}
+
+	code, err := execute(args[1], args[2:]...)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to launch the command:", err)
+		return subcommands.ExitFailure
+	}
+
+	changed, err := p.Service.Scan(gameID)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "warning: failed to scan the save:", err)
+	} else if changed && !p.noSync {
+		if g, err = p.Service.One(gameID); err == nil {
+			err = syncer.Sync(g)
+		}
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "warning: failed to push the save, run `cloudsave sync` later:", err)
+		}
+	}
+
+	return subcommands.ExitStatus(code)
+}
@@ -0,0 +1,81 @@
+package launch
+
+import (
+	"cloudsave/cmd/cli/commands/sync"
+	"cloudsave/pkg/remote"
+	"cloudsave/pkg/remote/client"
+	"cloudsave/pkg/repository"
+	"errors"
+	"fmt"
+	"log/slog"
+	"os"
+	"time"
+)
+
+// leaseTTL is how long the game stays checked out if the device stops
+// renewing its lease, e.g. after a crash
+const leaseTTL = 10 * time.Minute
+
+// checkout takes the lease of the game on its remote and renews it until
+// the returned function is called, which releases it. The game is not
+// checked out when it has no remote or the remote cannot be reached.
+func (p *LaunchCmd) checkout(syncer *sync.SyncCmd, g repository.Metadata) (func(), error) {
+	cli, r, err := syncer.Client(g.ID)
+	if err != nil {
+		if !errors.Is(err, remote.ErrNoRemote) {
+			fmt.Fprintln(os.Stderr, "warning: failed to check out the save:", err)
+		}
+		return func() {}, nil
+	}
+
+	deviceID, device := p.Service.Device()
+	lease, err := cli.Lock(r.GameID, deviceID, device, leaseTTL, p.steal)
+	if err != nil {
+		var lockErr *client.LockError
+		switch {
+		case errors.As(err, &lockErr):
+			return nil, fmt.Errorf("this save is checked out by %s since %s, use -steal to take it over", lockErr.Lease.Device, lockErr.Lease.Since.Local().Format(time.DateTime))
+		case errors.Is(err, client.ErrNotFound):
+			// the game is not on the server yet, or the server has no leases
+			slog.Debug("the save cannot be checked out", "err", err)
+		default:
+			fmt.Fprintln(os.Stderr, "warning: failed to check out the save:", err)
+		}
+		return func() {}, nil
+	}
+	slog.Debug("save checked out", "expires", lease.Expires)
+
+	done := make(chan struct{})
+	stopped := make(chan struct{})
+	go func() {
+		defer close(stopped)
+
+		ticker := time.NewTicker(leaseTTL / 3)
+		defer ticker.Stop()
+
+		for {
+			select {
+			case <-done:
+				return
+			case <-ticker.C:
+				_, err := cli.Renew(r.GameID, deviceID, leaseTTL)
+				var lockErr *client.LockError
+				if errors.As(err, &lockErr) {
+					fmt.Fprintf(os.Stderr, "warning: the save was taken over by %s\n", lockErr.Lease.Device)
+					return
+				}
+				if err != nil {
+					slog.Warn("failed to renew the lease of the save", "err", err)
+				}
+			}
+		}
+	}()
+
+	return func() {
+		close(done)
+		<-stopped
+		if err := cli.Unlock(r.GameID, deviceID, false); err != nil && !errors.Is(err, client.ErrLocked) {
+			fmt.Fprintln(os.Stderr, "warning: failed to release the save:", err)
+		}
+	}, nil
+}
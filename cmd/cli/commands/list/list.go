@@ -4,6 +4,7 @@ import (
 	"cloudsave/cmd/cli/tools/prompt/credentials"
 	"cloudsave/pkg/data"
 	"cloudsave/pkg/remote/client"
+	"cloudsave/pkg/repository"
 	"context"
 	"flag"
 	"fmt"
@@ -74,6 +75,9 @@ func (p *ListCmd) local(includeBackup bool) error {
 		fmt.Println("Last Version:", g.Date)
 		fmt.Println("Version:", g.Version)
 		fmt.Println("MD5:", g.MD5)
+		if len(g.Digest) > 0 {
+			fmt.Println("Digest:", g.Digest)
+		}
 		if includeBackup {
 			bk, err := p.Service.AllBackups(g.ID)
 			if err != nil {
@@ -82,7 +86,7 @@ func (p *ListCmd) local(includeBackup bool) error {
 			if len(bk) > 0 {
 				fmt.Println("Backup:")
 				for _, b := range bk {
-					fmt.Printf("   - %s (%s)\n", b.UUID, b.CreatedAt)
+					fmt.Printf("   - %s (%s)%s\n", b.UUID, b.CreatedAt, label(b))
 				}
 			}
 		}
@@ -113,6 +117,9 @@ func (p *ListCmd) server(url, username, password string, includeBackup bool) err
 		fmt.Println("Last Version:", g.Date)
 		fmt.Println("Version:", g.Version)
 		fmt.Println("MD5:", g.MD5)
+		if len(g.Digest) > 0 {
+			fmt.Println("Digest:", g.Digest)
+		}
 		if includeBackup {
 			bk, err := cli.ListArchives(g.ID)
 			if err != nil {
@@ -125,7 +132,7 @@ func (p *ListCmd) server(url, username, password string, includeBackup bool) err
 					if err != nil {
 						return fmt.Errorf("failed to list backup files: %w", err)
 					}
-					fmt.Printf("   - %s (%s)\n", b.UUID, b.CreatedAt)
+					fmt.Printf("   - %s (%s)%s\n", b.UUID, b.CreatedAt, label(b))
 				}
 			}
 		}
@@ -134,3 +141,10 @@ func (p *ListCmd) server(url, username, password string, includeBackup bool) err
 
 	return nil
 }
+
+func label(b repository.Backup) string {
+	if len(b.Label) == 0 {
+		return ""
+	}
+	return " " + b.Label
+}
@@ -0,0 +1,116 @@
+package lock
+
+import (
+	"cloudsave/cmd/cli/commands/sync"
+	"cloudsave/pkg/data"
+	"cloudsave/pkg/remote"
+	"cloudsave/pkg/remote/client"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"time"
+
+	"github.com/google/subcommands"
+)
+
+type (
+	LockCmd struct {
+		Service *data.Service
+		status  bool
+		release bool
+		steal   bool
+		ttl     time.Duration
+	}
+)
+
+func (*LockCmd) Name() string     { return "lock" }
+func (*LockCmd) Synopsis() string { return "check out a save so the other devices are warned" }
+func (*LockCmd) Usage() string {
+	return `Usage: cloudsave lock [-status | -release | -ttl DURATION] [-steal] <GAME_ID>
+
+Check out the save of the game on its remote for the duration, the other
+devices are warned when they sync it and cannot run it until it is
+released or expires. The run command checks out the save by itself.
+
+With -release, the save is released. With -status, the device that
+checked out the save is printed.
+
+Options:
+`
+}
+
+func (p *LockCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&p.status, "status", false, "print the device that checked out the save")
+	f.BoolVar(&p.release, "release", false, "release the save")
+	f.BoolVar(&p.steal, "steal", false, "check out or release the save even if another device checked it out")
+	f.DurationVar(&p.ttl, "ttl", time.Hour, "how long the save stays checked out (at most 24h)")
+}
+
+func (p *LockCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() != 1 || (p.status && p.release) {
+		subcommands.HelpCommand().Execute(ctx, f, nil)
+		return subcommands.ExitUsageError
+	}
+
+	g, err := p.Service.One(f.Arg(0))
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to get the game:", err)
+		return subcommands.ExitFailure
+	}
+
+	cli, r, err := sync.New(p.Service, sync.PolicySkip).Client(g.ID)
+	if err != nil {
+		if errors.Is(err, remote.ErrNoRemote) {
+			fmt.Fprintln(os.Stderr, "error: no remote configured for", g.Name)
+			return subcommands.ExitFailure
+		}
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return subcommands.ExitFailure
+	}
+
+	deviceID, device := p.Service.Device()
+	switch {
+	case p.status:
+		lease, err := cli.Lease(r.GameID)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to get the lease:", err)
+			return subcommands.ExitFailure
+		}
+		if lease == nil {
+			fmt.Println(g.Name + ": not checked out")
+			break
+		}
+		fmt.Printf("%s: checked out by %s since %s, until %s\n", g.Name, lease.Device, lease.Since.Local().Format(time.DateTime), lease.Expires.Local().Format(time.DateTime))
+
+	case p.release:
+		if err := cli.Unlock(r.GameID, deviceID, p.steal); err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to release the save:", describe(err))
+			return subcommands.ExitFailure
+		}
+		fmt.Println(g.Name + ": released")
+
+	default:
+		lease, err := cli.Lock(r.GameID, deviceID, device, p.ttl, p.steal)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to check out the save:", describe(err))
+			return subcommands.ExitFailure
+		}
+		fmt.Printf("%s: checked out until %s\n", g.Name, lease.Expires.Local().Format(time.DateTime))
+	}
+
+	return subcommands.ExitSuccess
+}
+
+// describe explains the errors of the lease requests
+func describe(err error) string {
+	var lockErr *client.LockError
+	switch {
+	case errors.As(err, &lockErr):
+		return lockErr.Error() + ", use -steal to take it over"
+	case errors.Is(err, client.ErrNotFound):
+		return "the game is not on the server, or the server does not support the leases"
+	}
+	return err.Error()
+}
@@ -0,0 +1,48 @@
+package migrate
+
+import (
+	"cloudsave/pkg/repository"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+)
+
+type (
+	MigrateCmd struct {
+		DataPath  string
+		ChunkPath string
+	}
+)
+
+func (*MigrateCmd) Name() string     { return "migrate" }
+func (*MigrateCmd) Synopsis() string { return "migrate the datastore to the deduplicated store" }
+func (*MigrateCmd) Usage() string {
+	return `Usage: cloudsave migrate
+
+Convert the archives of the datastore into content-defined chunks.
+The chunks are shared between every archive and backup, so the data
+that did not change between two versions are stored only once.
+Once migrated, the datastore always uses the chunk store.
+`
+}
+
+func (p *MigrateCmd) SetFlags(f *flag.FlagSet) {}
+
+func (p *MigrateCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	r, err := repository.NewChunkRepository(p.DataPath, p.ChunkPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to open the chunk store:", err)
+		return subcommands.ExitFailure
+	}
+
+	if err := r.Migrate(); err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to migrate the datastore:", err)
+		return subcommands.ExitFailure
+	}
+
+	fmt.Println("done.")
+	return subcommands.ExitSuccess
+}
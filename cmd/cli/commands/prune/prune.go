@@ -0,0 +1,109 @@
+package prune
+
+import (
+	"cloudsave/pkg/data"
+	"cloudsave/pkg/repository"
+	"cloudsave/pkg/retention"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+)
+
+type (
+	PruneCmd struct {
+		Service       *data.Service
+		RetentionPath string
+		dryRun        bool
+	}
+)
+
+func (*PruneCmd) Name() string     { return "prune" }
+func (*PruneCmd) Synopsis() string { return "remove the backups according to the retention policy" }
+func (*PruneCmd) Usage() string {
+	return `Usage: cloudsave prune [-dry-run] [GAME_ID]
+
+Remove the backups that are not kept by the retention policy.
+The policy of the game is used if it is defined, otherwise
+the global policy is used (see the retention command).
+
+Options:
+`
+}
+
+func (p *PruneCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&p.dryRun, "dry-run", false, "list the backups that would be removed")
+}
+
+func (p *PruneCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	global, err := retention.Load(p.RetentionPath)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to load the global retention policy:", err)
+		return subcommands.ExitFailure
+	}
+
+	var games []repository.Metadata
+	if f.NArg() > 0 {
+		for _, gameID := range f.Args() {
+			g, err := p.Service.One(gameID)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error: failed to load game:", err)
+				return subcommands.ExitFailure
+			}
+			games = append(games, g)
+		}
+	} else {
+		games, err = p.Service.AllGames()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to load datastore:", err)
+			return subcommands.ExitFailure
+		}
+	}
+
+	failed := false
+	for _, g := range games {
+		n, err := Prune(p.Service, g, global, p.dryRun)
+		if err != nil {
+			fmt.Println("❌", g.Name, ":", err.Error())
+			failed = true
+			continue
+		}
+		if n == 0 {
+			fmt.Println("🆗", g.Name, ": nothing to prune")
+		}
+	}
+
+	if !p.dryRun {
+		if _, err := p.Service.CollectGarbage(); err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to remove unreferenced data:", err)
+			return subcommands.ExitFailure
+		}
+	}
+
+	fmt.Println("done.")
+	if failed {
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
+
+// Prune applies the retention policy on a game, prints the removed backups
+// and returns their number
+func Prune(s *data.Service, g repository.Metadata, global retention.Policy, dryRun bool) (int, error) {
+	removed, err := s.Prune(g.ID, global, dryRun)
+	if err != nil {
+		return 0, err
+	}
+
+	verb := "removed"
+	if dryRun {
+		verb = "would remove"
+	}
+	for _, b := range removed {
+		fmt.Printf("🗑️ %s : %s %s (%s, %d bytes)\n", g.Name, verb, b.UUID, b.CreatedAt, b.Size)
+	}
+
+	return len(removed), nil
+}
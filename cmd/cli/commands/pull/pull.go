@@ -1,13 +1,19 @@
 package pull
 
 import (
+	"cloudsave/cmd/cli/tools/flags"
+	"cloudsave/cmd/cli/tools/prompt"
 	"cloudsave/cmd/cli/tools/prompt/credentials"
 	"cloudsave/pkg/data"
 	"cloudsave/pkg/remote/client"
+	"cloudsave/pkg/repository"
+	"cloudsave/pkg/tools/paths"
 	"context"
 	"flag"
 	"fmt"
 	"os"
+	"path/filepath"
+	"slices"
 
 	"github.com/google/subcommands"
 )
@@ -15,31 +21,37 @@ import (
 type (
 	PullCmd struct {
 		Service *data.Service
+		roots   flags.Roots
 	}
 )
 
 func (*PullCmd) Name() string     { return "pull" }
 func (*PullCmd) Synopsis() string { return "pull a game save from the remote" }
 func (*PullCmd) Usage() string {
-	return `Usage: cloudsave pull <GAME_ID>
+	return `Usage: cloudsave pull [-root NAME=PATH]... <URL> <GAME_ID> [PATH]
 
 Pull a game save from the remote
+
+Without PATH, the save directory is asked, the directory of another
+computer is suggested. The other folders of the game are extracted
+where -root tells, or in the folder ` + data.RootsDir + ` of PATH.
+
+Options:
 `
 }
 
 func (p *PullCmd) SetFlags(f *flag.FlagSet) {
-
+	f.Var(&p.roots, "root", "where to extract another folder of the game, as NAME=PATH, can be repeated")
 }
 
 func (p *PullCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
-	if f.NArg() != 3 {
+	if f.NArg() != 2 && f.NArg() != 3 {
 		fmt.Fprintln(os.Stderr, "error: missing arguments")
 		return subcommands.ExitUsageError
 	}
 
 	url := f.Arg(0)
 	gameID := f.Arg(1)
-	path := f.Arg(2)
 
 	username, password, err := credentials.Read()
 	if err != nil {
@@ -54,11 +66,54 @@ func (p *PullCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{})
 		return subcommands.ExitFailure
 	}
 
-	if err := p.Service.PullCurrent(gameID, path, cli); err != nil {
+	m, err := cli.Metadata(gameID)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to get the game from the remote: %s\n", err)
+		return subcommands.ExitFailure
+	}
+
+	if f.NArg() == 3 {
+		path, err := paths.Abs(f.Arg(2))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: cannot get the absolute path for this entry:", err)
+			return subcommands.ExitFailure
+		}
+		p.Service.SetPath(&m, path)
+	}
+	for _, r := range p.roots {
+		i := slices.IndexFunc(m.Roots, func(v repository.Root) bool { return v.Name == r.Name })
+		if i < 0 {
+			m.Roots = append(m.Roots, repository.Root{Name: r.Name})
+			i = len(m.Roots) - 1
+		}
+		p.Service.SetRootPath(&m.Roots[i], r.Path)
+	}
+	prompt.Locate(p.Service, &m)
+
+	path, err := p.Service.Location(m)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return subcommands.ExitUsageError
+	}
+
+	if err := p.Service.PullCurrent(gameID, m, cli); err != nil {
 		fmt.Fprintf(os.Stderr, "error: failed to pull current archive: %s", err)
 		return subcommands.ExitFailure
 	}
 
+	names, err := p.Service.ArchiveRoots(gameID, "")
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "error: failed to list the folders of the archive: %s", err)
+		return subcommands.ExitFailure
+	}
+	roots := p.Service.LocalRoots(m)
+	for _, name := range names {
+		if !slices.ContainsFunc(roots, func(r repository.Root) bool { return r.Name == name && len(r.Path) > 0 }) {
+			fmt.Fprintf(os.Stderr, "warning: the folder %q is extracted in %s, set its path with `cloudsave edit -root %s=PATH %s` then apply the save\n",
+				name, filepath.Join(path, data.RootsDir, name), name, gameID)
+		}
+	}
+
 	ids, err := cli.ListArchives(gameID)
 	if err != nil {
 		fmt.Fprintf(os.Stderr, "error: failed to list backup archive: %s", err)
@@ -0,0 +1,112 @@
+package retention
+
+import (
+	"cloudsave/pkg/data"
+	"cloudsave/pkg/retention"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+)
+
+type (
+	RetentionCmd struct {
+		Service       *data.Service
+		RetentionPath string
+		policy        retention.Policy
+		maxSize       int64
+		unset         bool
+	}
+)
+
+func (*RetentionCmd) Name() string     { return "retention" }
+func (*RetentionCmd) Synopsis() string { return "show or set the retention policy" }
+func (*RetentionCmd) Usage() string {
+	return `Usage: cloudsave retention [-keep-last N] [-keep-daily N] [-keep-weekly N] [-keep-monthly N] [-max-size MB] [-unset] [GAME_ID]
+
+Show or set the retention policy used by the prune command.
+Without GAME_ID, the global policy is used. The policy of a game
+replaces the global policy for this game.
+
+Options:
+`
+}
+
+func (p *RetentionCmd) SetFlags(f *flag.FlagSet) {
+	f.IntVar(&p.policy.KeepLast, "keep-last", 0, "keep the last N backups")
+	f.IntVar(&p.policy.KeepDaily, "keep-daily", 0, "keep the last backup of the last N days")
+	f.IntVar(&p.policy.KeepWeekly, "keep-weekly", 0, "keep the last backup of the last N weeks")
+	f.IntVar(&p.policy.KeepMonthly, "keep-monthly", 0, "keep the last backup of the last N months")
+	f.Int64Var(&p.maxSize, "max-size", 0, "maximum total size of the backups in MB")
+	f.BoolVar(&p.unset, "unset", false, "remove the policy")
+}
+
+func (p *RetentionCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "error: the command is expecting for 0 or 1 argument")
+		return subcommands.ExitUsageError
+	}
+	gameID := f.Arg(0)
+
+	set := false
+	f.Visit(func(*flag.Flag) { set = true })
+
+	if !set {
+		if err := p.show(gameID); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+
+	var policy *retention.Policy
+	if !p.unset {
+		p.policy.MaxSize = p.maxSize << 20
+		policy = &p.policy
+	}
+
+	if len(gameID) > 0 {
+		if err := p.Service.SetRetention(gameID, policy); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			return subcommands.ExitFailure
+		}
+		return subcommands.ExitSuccess
+	}
+
+	if policy == nil {
+		policy = &retention.Policy{}
+	}
+	if err := retention.Save(p.RetentionPath, *policy); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return subcommands.ExitFailure
+	}
+
+	return subcommands.ExitSuccess
+}
+
+func (p *RetentionCmd) show(gameID string) error {
+	global, err := retention.Load(p.RetentionPath)
+	if err != nil {
+		return fmt.Errorf("failed to load the global retention policy: %w", err)
+	}
+
+	fmt.Println("Global:", global)
+	if len(gameID) == 0 {
+		return nil
+	}
+
+	policy, err := p.Service.Retention(gameID)
+	if err != nil {
+		return err
+	}
+
+	if policy == nil {
+		fmt.Println("Game: (global)")
+		return nil
+	}
+	fmt.Println("Game:", policy)
+
+	return nil
+}
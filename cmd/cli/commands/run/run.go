@@ -1,7 +1,9 @@
 package run
 
 import (
+	"cloudsave/cmd/cli/commands/prune"
 	"cloudsave/pkg/data"
+	"cloudsave/pkg/retention"
 	"context"
 	"flag"
 	"fmt"
@@ -12,22 +14,28 @@ import (
 
 type (
 	RunCmd struct {
-		Service *data.Service
+		Service       *data.Service
+		RetentionPath string
+		prune         bool
 	}
 )
 
 func (*RunCmd) Name() string     { return "scan" }
 func (*RunCmd) Synopsis() string { return "check and process all the folder" }
 func (*RunCmd) Usage() string {
-	return `Usage: cloudsave scan
+	return `Usage: cloudsave scan [-prune]
 
-Check if the files have been modified. If so,
+Check if the content of the files has been modified. If so,
 the current archive is moved to the backup list
 and a new archive is created with a new version number. 
+
+Options:
 `
 }
 
-func (p *RunCmd) SetFlags(f *flag.FlagSet) {}
+func (p *RunCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&p.prune, "prune", false, "apply the retention policy after the scan")
+}
 
 func (p *RunCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
 	datastore, err := p.Service.AllGames()
@@ -36,6 +44,15 @@ func (p *RunCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) s
 		return subcommands.ExitFailure
 	}
 
+	var global retention.Policy
+	if p.prune {
+		global, err = retention.Load(p.RetentionPath)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to load the global retention policy:", err)
+			return subcommands.ExitFailure
+		}
+	}
+
 	for _, metadata := range datastore {
 		changed, err := p.Service.Scan(metadata.ID)
 		if err != nil {
@@ -47,6 +64,19 @@ func (p *RunCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) s
 		} else {
 			fmt.Println("🆗", metadata.Name, ": up to date")
 		}
+		if p.prune {
+			// only the removed backups are printed
+			if _, err := prune.Prune(p.Service, metadata, global, false); err != nil {
+				fmt.Println("❌", metadata.Name, ":", err.Error())
+			}
+		}
+	}
+
+	if p.prune {
+		if _, err := p.Service.CollectGarbage(); err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to remove unreferenced data:", err)
+			return subcommands.ExitFailure
+		}
 	}
 
 	fmt.Println("done.")
@@ -6,6 +6,7 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"strings"
 
 	"github.com/google/subcommands"
 )
@@ -44,8 +45,27 @@ func (p *ShowCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{})
 	fmt.Println(g.Name)
 	fmt.Println("------")
 	fmt.Println("Version: ", g.Version)
-	fmt.Println("Path: ", g.Path)
+	if path, err := p.Service.Location(g); err == nil {
+		fmt.Println("Path: ", path)
+	} else {
+		fmt.Println("Path:  not set on this device")
+	}
 	fmt.Println("MD5: ", g.MD5)
+	if len(g.Digest) > 0 {
+		fmt.Println("Digest: ", g.Digest)
+	}
+	for _, r := range p.Service.LocalRoots(g) {
+		if len(r.Path) == 0 {
+			r.Path = "not set on this device"
+		}
+		fmt.Printf("Root %s:  %s\n", r.Name, r.Path)
+	}
+	if len(g.Include) > 0 {
+		fmt.Println("Include: ", strings.Join(g.Include, " "))
+	}
+	if len(g.Exclude) > 0 {
+		fmt.Println("Exclude: ", strings.Join(g.Exclude, " "))
+	}
 
 	return subcommands.ExitSuccess
 }
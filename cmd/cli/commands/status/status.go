@@ -0,0 +1,79 @@
+package status
+
+import (
+	"cloudsave/pkg/data"
+	"cloudsave/pkg/repository"
+	"context"
+	"flag"
+	"fmt"
+	"os"
+
+	"github.com/google/subcommands"
+)
+
+type (
+	StatusCmd struct {
+		Service *data.Service
+	}
+)
+
+func (*StatusCmd) Name() string     { return "status" }
+func (*StatusCmd) Synopsis() string { return "list the files modified since the last scan" }
+func (*StatusCmd) Usage() string {
+	return `Usage: cloudsave status [GAME_ID]
+
+List the files added (+), changed (~) or deleted (-) since the last scan,
+for every game or only the given one.
+`
+}
+
+func (p *StatusCmd) SetFlags(f *flag.FlagSet) {
+}
+
+func (p *StatusCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if f.NArg() > 1 {
+		fmt.Fprintln(os.Stderr, "error: the command is expecting for 0 or 1 argument")
+		return subcommands.ExitUsageError
+	}
+
+	var games []repository.Metadata
+	if f.NArg() == 1 {
+		g, err := p.Service.One(f.Arg(0))
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to get the game:", err)
+			return subcommands.ExitFailure
+		}
+		games = append(games, g)
+	} else {
+		var err error
+		if games, err = p.Service.AllGames(); err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to load datastore:", err)
+			return subcommands.ExitFailure
+		}
+	}
+
+	for _, g := range games {
+		c, err := p.Service.Status(g.ID)
+		if err != nil {
+			fmt.Println("❌", g.Name, ":", err.Error())
+			continue
+		}
+		if len(c.Added)+len(c.Changed)+len(c.Deleted) == 0 {
+			fmt.Println("🆗", g.Name, ": up to date")
+			continue
+		}
+
+		fmt.Println("📝", g.Name, ":")
+		for _, name := range c.Added {
+			fmt.Println("  +", name)
+		}
+		for _, name := range c.Changed {
+			fmt.Println("  ~", name)
+		}
+		for _, name := range c.Deleted {
+			fmt.Println("  -", name)
+		}
+	}
+
+	return subcommands.ExitSuccess
+}
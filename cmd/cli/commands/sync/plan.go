@@ -0,0 +1,226 @@
+package sync
+
+import (
+	"cloudsave/cmd/cli/tools/prompt"
+	"cloudsave/pkg/data"
+	"cloudsave/pkg/remote"
+	"cloudsave/pkg/remote/client"
+	"cloudsave/pkg/repository"
+	"errors"
+	"fmt"
+	"log/slog"
+)
+
+type (
+	Action string
+
+	// ConflictPolicy tells how a conflict is resolved
+	ConflictPolicy string
+
+	// Step is what sync does for one game
+	Step struct {
+		GameID      string   `json:"game_id"`
+		Name        string   `json:"name"`
+		Action      Action   `json:"action"`
+		Resolution  string   `json:"resolution,omitempty"`
+		Apply       bool     `json:"apply,omitempty"`
+		PullBackups []string `json:"pull_backups,omitempty"`
+		PushBackups []string `json:"push_backups,omitempty"`
+		Error       string   `json:"error,omitempty"`
+		// Lease is set when another device plays the game
+		Lease *repository.Lease `json:"lease,omitempty"`
+
+		local          repository.Metadata
+		remoteMetadata repository.Metadata
+		remote         remote.Remote
+		cli            *client.Client
+		// save directory on this device, empty if it is not set
+		path string
+		// backups on the server before the step, see remote.Remote
+		backups []string
+	}
+)
+
+const (
+	ActionUpToDate Action = "up-to-date"
+	ActionPush     Action = "push"
+	ActionPull     Action = "pull"
+	ActionConflict Action = "conflict"
+	ActionNoRemote Action = "no-remote"
+	ActionError    Action = "error"
+)
+
+const (
+	PolicyAsk    ConflictPolicy = "ask"
+	PolicyLocal  ConflictPolicy = "local"
+	PolicyRemote ConflictPolicy = "remote"
+	PolicyNewest ConflictPolicy = "newest"
+	// PolicyKeepBoth keeps both versions in backups, the current
+	// save is left as is
+	PolicyKeepBoth ConflictPolicy = "keep-both"
+	PolicySkip     ConflictPolicy = "skip"
+)
+
+var (
+	policies = []ConflictPolicy{PolicyAsk, PolicyLocal, PolicyRemote, PolicyNewest, PolicyKeepBoth, PolicySkip}
+)
+
+func (c *ConflictPolicy) String() string {
+	return string(*c)
+}
+
+func (c *ConflictPolicy) Set(v string) error {
+	for _, p := range policies {
+		if string(p) == v {
+			*c = p
+			return nil
+		}
+	}
+	return fmt.Errorf("unknown conflict policy %q, expected one of %v", v, policies)
+}
+
+// resolve chooses the archive to keep, only PolicyAsk asks the user
+func (c ConflictPolicy) resolve(local, remoteMetadata repository.Metadata) prompt.ConflictResponse {
+	switch c {
+	case PolicyLocal:
+		return prompt.My
+	case PolicyRemote:
+		return prompt.Their
+	case PolicyNewest:
+		if local.Date.After(remoteMetadata.Date) {
+			return prompt.My
+		}
+		return prompt.Their
+	case PolicyKeepBoth:
+		return prompt.Both
+	case PolicyAsk:
+		return prompt.Conflict()
+	}
+	return prompt.Abort
+}
+
+// describe tells what resolve would do without asking anything
+func (c ConflictPolicy) describe(local, remoteMetadata repository.Metadata) string {
+	if c == PolicyAsk {
+		return "ask"
+	}
+
+	switch c.resolve(local, remoteMetadata) {
+	case prompt.My:
+		return "keep local"
+	case prompt.Their:
+		return "keep remote"
+	case prompt.Both:
+		return "keep both"
+	}
+	return "skip"
+}
+
+// plan finds what must be done for a game, nothing is modified
+// either on the remote or in the local datastore
+func (p *SyncCmd) plan(g repository.Metadata, r remote.Remote, cli *client.Client) (Step, error) {
+	s := Step{
+		GameID: g.ID,
+		Name:   g.Name,
+		local:  g,
+		remote: r,
+		cli:    cli,
+	}
+	s.path, _ = p.Service.Location(g)
+
+	localBackups, err := p.Service.AllBackups(g.ID)
+	if err != nil {
+		return s, fmt.Errorf("failed to list local backups: %w", err)
+	}
+
+	exists, err := cli.Exists(r.GameID)
+	if err != nil {
+		return s, fmt.Errorf("failed to check the remote: %w", err)
+	}
+
+	if !exists {
+		s.Action = ActionPush
+		for _, b := range localBackups {
+			s.PushBackups = append(s.PushBackups, b.UUID)
+		}
+		return s, nil
+	}
+
+	s.remoteMetadata, err = cli.Metadata(r.GameID)
+	if err != nil {
+		return s, fmt.Errorf("failed to get the game metadata from the remote: %w", err)
+	}
+
+	// the servers without the leases answer not found
+	if lease, err := cli.Lease(r.GameID); err != nil {
+		slog.Warn("failed to get the lease of the game", "err", err)
+	} else if id, _ := p.Service.Device(); lease != nil && lease.DeviceID != id {
+		s.Lease = lease
+	}
+
+	parents, err := p.Service.Lineage(g.ID)
+	if err != nil {
+		return s, fmt.Errorf("failed to load the history of the game: %w", err)
+	}
+
+	uuids, err := cli.ListArchives(r.GameID)
+	if err != nil {
+		return s, fmt.Errorf("failed to list remote backups: %w", err)
+	}
+
+	remoteBackups := make(map[string]struct{})
+	for _, uuid := range uuids {
+		rinfo, err := cli.ArchiveInfo(r.GameID, uuid)
+		if err != nil {
+			return s, fmt.Errorf("failed to get remote information about the backup file: %w", err)
+		}
+		remoteBackups[uuid] = struct{}{}
+		if len(rinfo.Parent) > 0 {
+			parents[rinfo.MD5] = rinfo.Parent
+		}
+
+		linfo, err := p.Service.Backup(g.ID, uuid)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			return s, err
+		}
+		if linfo.MD5 != rinfo.MD5 {
+			s.PullBackups = append(s.PullBackups, uuid)
+		}
+	}
+
+	// the backups that were on the server and are not anymore have been
+	// removed by its retention policy, they are not pushed again
+	known := make(map[string]struct{})
+	for _, uuid := range r.Backups {
+		known[uuid] = struct{}{}
+	}
+
+	s.backups = uuids
+	for _, b := range localBackups {
+		if _, ok := remoteBackups[b.UUID]; ok {
+			continue
+		}
+		if _, ok := known[b.UUID]; ok {
+			s.backups = append(s.backups, b.UUID)
+			continue
+		}
+		s.PushBackups = append(s.PushBackups, b.UUID)
+	}
+
+	switch data.Compare(g, s.remoteMetadata, parents) {
+	case data.Equal:
+		s.Action = ActionUpToDate
+	case data.Ahead:
+		s.Action = ActionPush
+	case data.Behind:
+		s.Action = ActionPull
+		s.Apply = !p.noApply && len(s.path) > 0
+	case data.Diverged:
+		s.Action = ActionConflict
+		s.Resolution = p.onConflict.describe(g, s.remoteMetadata)
+		// keep-both leaves the current save as is, there is nothing to apply
+		s.Apply = !p.noApply && len(s.path) > 0 && p.onConflict != PolicyKeepBoth
+	}
+
+	return s, nil
+}
@@ -8,6 +8,7 @@ import (
 	"cloudsave/pkg/remote/client"
 	"cloudsave/pkg/repository"
 	"context"
+	"encoding/json"
 	"errors"
 	"flag"
 	"fmt"
@@ -21,253 +22,528 @@ import (
 
 type (
 	SyncCmd struct {
-		Service *data.Service
+		Service    *data.Service
+		onConflict ConflictPolicy
+		dryRun     bool
+		json       bool
+		noApply    bool
+		// credentials of each remote, they are asked once
+		creds map[string]map[string]string
 	}
 )
 
+// result describes what was done for a game
+type result struct {
+	desc string
+	// unresolved is set when a conflict was left as is
+	unresolved bool
+}
+
+var (
+	conflictSkipped    = result{desc: "conflict skipped", unresolved: true}
+	conflictUnresolved = result{desc: "conflict not resolved", unresolved: true}
+	conflictKept       = result{desc: "conflict kept, both versions saved in backups", unresolved: true}
+)
+
+var (
+	// ErrUnresolved is returned by Sync when a conflict was skipped or failed
+	ErrUnresolved error = errors.New("a conflict is not resolved")
+)
+
+// New returns the command with the default options and the conflicts
+// resolved with policy, to synchronize from another command (see Sync)
+func New(s *data.Service, policy ConflictPolicy) *SyncCmd {
+	return &SyncCmd{Service: s, onConflict: policy}
+}
+
 func (*SyncCmd) Name() string     { return "sync" }
 func (*SyncCmd) Synopsis() string { return "list all game registered" }
 func (*SyncCmd) Usage() string {
-	return `Usage: cloudsave sync
+	return `Usage: cloudsave sync [-on-conflict=ask|local|remote|newest|keep-both|skip] [-no-apply] [-dry-run [-json]]
 
 Synchronize the archives with the server defined for each game.
+The pulled archives are extracted in the save directory of the game,
+the directory is saved in a backup before.
+
+Options:
 `
 }
 
 func (p *SyncCmd) SetFlags(f *flag.FlagSet) {
+	p.onConflict = PolicyAsk
+	f.Var(&p.onConflict, "on-conflict", "how to resolve a conflict: ask, local, remote, newest (most recent date), keep-both (save both versions in backups, the current save is left as is) or skip")
+	f.BoolVar(&p.dryRun, "dry-run", false, "only print what would be done")
+	f.BoolVar(&p.json, "json", false, "with -dry-run, print the plan as json")
+	f.BoolVar(&p.noApply, "no-apply", false, "only update the datastore, the save directories are not modified")
 }
 
 func (p *SyncCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if p.json && !p.dryRun {
+		fmt.Fprintln(os.Stderr, "error: -json requires -dry-run")
+		return subcommands.ExitUsageError
+	}
+
 	games, err := p.Service.AllGames()
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error: failed to load datastore:", err)
 		return subcommands.ExitFailure
 	}
 
-	remoteCred := make(map[string]map[string]string)
+	steps, err := p.plans(games)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return subcommands.ExitFailure
+	}
+
+	if p.dryRun {
+		if p.json {
+			e := json.NewEncoder(os.Stdout)
+			e.SetIndent("", "  ")
+			if err := e.Encode(steps); err != nil {
+				fmt.Fprintln(os.Stderr, "error: failed to encode the plan:", err)
+				return subcommands.ExitFailure
+			}
+			return subcommands.ExitSuccess
+		}
+		for _, s := range steps {
+			printStep(s)
+		}
+		return subcommands.ExitSuccess
+	}
+
+	if _, err := p.executeAll(steps); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return subcommands.ExitFailure
+	}
+
+	fmt.Println("done.")
+	return subcommands.ExitSuccess
+}
+
+// Sync synchronizes the games with their remote, ErrUnresolved is returned
+// once every game is done if a conflict was left as is
+func (p *SyncCmd) Sync(games ...repository.Metadata) error {
+	steps, err := p.plans(games)
+	if err != nil {
+		return err
+	}
+
+	unresolved, err := p.executeAll(steps)
+	if err != nil {
+		return err
+	}
+	if unresolved > 0 {
+		return ErrUnresolved
+	}
+	return nil
+}
+
+// plans finds what must be done for each game
+func (p *SyncCmd) plans(games []repository.Metadata) ([]Step, error) {
+	var steps []Step
 	for _, g := range games {
-		r, err := remote.One(g.ID)
+		cli, r, err := p.Client(g.ID)
 		if err != nil {
 			if errors.Is(err, remote.ErrNoRemote) {
-				fmt.Println(g.Name + ": no remote configured")
+				steps = append(steps, Step{GameID: g.ID, Name: g.Name, Action: ActionNoRemote})
 				continue
 			}
-			fmt.Fprintln(os.Stderr, "error: failed to load datastore:", err)
-			return subcommands.ExitFailure
+			return nil, err
 		}
-		cli, err := connect(remoteCred, r)
+
+		pg := p.progress()
+		pg.Describe(fmt.Sprintf("[%s] Checking status...", g.Name))
+		s, err := p.plan(g, r, cli)
+		destroy(pg)
 		if err != nil {
-			fmt.Fprintln(os.Stderr, "error: failed to connect to the remote:", err)
-			return subcommands.ExitFailure
+			slog.Error(err.Error())
+			s.Action = ActionError
+			s.Error = err.Error()
 		}
+		steps = append(steps, s)
+	}
+	return steps, nil
+}
+
+// Client connects to the remote of the game, the credentials are asked once
+// for each remote. remote.ErrNoRemote is returned if the game has no remote.
+func (p *SyncCmd) Client(gameID string) (*client.Client, remote.Remote, error) {
+	if p.creds == nil {
+		p.creds = make(map[string]map[string]string)
+	}
 
-		pg := progressbar.New(-1)
-		destroyPg := func() {
-			pg.Finish()
-			pg.Clear()
-			pg.Close()
+	r, err := remote.One(gameID)
+	if err != nil {
+		if errors.Is(err, remote.ErrNoRemote) {
+			return nil, remote.Remote{}, err
 		}
+		return nil, remote.Remote{}, fmt.Errorf("failed to load datastore: %w", err)
+	}
 
-		pg.Describe(fmt.Sprintf("[%s] Checking status...", g.Name))
-		exists, err := cli.Exists(r.GameID)
-		if err != nil {
-			slog.Error(err.Error())
+	cli, err := connect(p.creds, r)
+	if err != nil {
+		return nil, remote.Remote{}, fmt.Errorf("failed to connect to the remote: %w", err)
+	}
+	return cli, r, nil
+}
+
+// executeAll applies the steps and returns the number of conflicts
+// that are not resolved
+func (p *SyncCmd) executeAll(steps []Step) (int, error) {
+	unresolved := 0
+	for _, s := range steps {
+		switch s.Action {
+		case ActionNoRemote:
+			fmt.Println(s.Name + ": no remote configured")
+			continue
+		case ActionError:
 			continue
 		}
+		if s.Lease != nil {
+			fmt.Fprintf(os.Stderr, "warning: %s: %s\n", s.Name, checkedOut(*s.Lease))
+		}
 
-		if !exists {
-			pg.Describe(fmt.Sprintf("[%s] Pushing data...", g.Name))
-			if err := p.push(g, cli); err != nil {
-				destroyPg()
-				fmt.Fprintln(os.Stderr, "failed to push:", err)
-				return subcommands.ExitFailure
-			}
-			pg.Describe(fmt.Sprintf("[%s] Pushing backup...", g.Name))
-			if err := p.pushBackup(g, cli); err != nil {
-				destroyPg()
-				slog.Warn("failed to push backup files", "err", err)
-			}
-			destroyPg()
-			fmt.Println(g.Name + ": pushed")
-			continue
+		res, err := p.execute(s)
+		if err != nil {
+			return unresolved, err
+		}
+		if res.unresolved {
+			unresolved++
 		}
+		fmt.Println(s.Name + ": " + res.desc)
+	}
+	return unresolved, nil
+}
 
-		pg.Describe(fmt.Sprintf("[%s] Fetching metadata...", g.Name))
+// execute applies the step and returns what was done
+func (p *SyncCmd) execute(s Step) (result, error) {
+	g := s.local
+	cli := s.cli
+
+	// the directories of the other devices are kept to be suggested,
+	// the ones of this device are asked before they are needed, unless
+	// sync runs without a terminal
+	if len(s.remoteMetadata.MD5) > 0 {
+		p.Service.MergeLocations(&g, s.remoteMetadata)
+		if p.onConflict == PolicyAsk && (s.Action == ActionPull || s.Action == ActionConflict) {
+			prompt.Locate(p.Service, &g)
+		}
+		if err := p.Service.UpdateMetadata(g.ID, g); err != nil {
+			return result{}, fmt.Errorf("failed to update metadata: %w", err)
+		}
+	}
 
-		remoteMetadata, err := cli.Metadata(r.GameID)
-		if err != nil {
-			destroyPg()
-			fmt.Fprintln(os.Stderr, "error: failed to get the game metadata from the remote:", err)
-			continue
+	pg := p.progress()
+	stopped := false
+	stop := func() {
+		if !stopped {
+			stopped = true
+			destroy(pg)
 		}
+	}
+	defer stop()
 
+	for _, uuid := range s.PullBackups {
 		pg.Describe(fmt.Sprintf("[%s] Pulling backup...", g.Name))
-		if err := p.pullBackup(g, cli); err != nil {
+		if err := p.Service.PullBackup(g.ID, uuid, cli); err != nil {
 			slog.Warn("failed to pull backup files", "err", err)
 		}
+	}
 
-		pg.Describe(fmt.Sprintf("[%s] Pushing backup...", g.Name))
-		if err := p.pushBackup(g, cli); err != nil {
-			slog.Warn("failed to push backup files", "err", err)
-		}
+	// the server keeps the archive it replaces unless it already has it
+	// in its backups: the backups are sent first to avoid duplicates
+	exists := len(s.remoteMetadata.MD5) > 0
+	backups := s.backups
+	if exists {
+		backups = append(backups, p.pushBackups(s, pg)...)
+	}
 
-		if g.MD5 == remoteMetadata.MD5 {
-			destroyPg()
-			if g.Version != remoteMetadata.Version {
-				slog.Debug("version is not the same, but the hash is equal. Updating local database")
-				if err := p.Service.SetVersion(r.GameID, remoteMetadata.Version); err != nil {
-					fmt.Fprintln(os.Stderr, "error: failed to synchronize version number:", err)
-					continue
-				}
+	res := result{desc: "already up-to-date"}
+	switch s.Action {
+	case ActionUpToDate:
+		if g.Version != s.remoteMetadata.Version {
+			slog.Debug("version is not the same, but the hash is equal. Updating local database")
+			if err := p.Service.SetVersion(s.remote.GameID, s.remoteMetadata.Version); err != nil {
+				return result{}, fmt.Errorf("failed to synchronize version number: %w", err)
 			}
-			fmt.Println(g.Name + ": already up-to-date")
-			continue
 		}
 
-		if g.Version > remoteMetadata.Version {
-			pg.Describe(fmt.Sprintf("[%s] Pushing data...", g.Name))
-			if err := p.push(g, cli); err != nil {
-				destroyPg()
-				fmt.Fprintln(os.Stderr, "failed to push:", err)
-				return subcommands.ExitFailure
+	case ActionPush:
+		pg.Describe(fmt.Sprintf("[%s] Pushing data...", g.Name))
+		res = result{desc: "pushed"}
+		if err := p.push(g, s.remoteMetadata, cli); err != nil {
+			var conflictErr *client.ConflictError
+			if !errors.As(err, &conflictErr) {
+				return result{}, fmt.Errorf("failed to push: %w", err)
 			}
-			destroyPg()
-			fmt.Println(g.Name + ": pushed")
-			continue
-		}
-
-		if g.Version < remoteMetadata.Version {
-			destroyPg()
-			if err := p.pull(r.GameID, cli); err != nil {
-				destroyPg()
-				fmt.Fprintln(os.Stderr, "failed to push:", err)
-				return subcommands.ExitFailure
+			// the remote has been modified since the metadata were fetched
+			stop()
+			res, err = p.conflict(s.remote.GameID, conflictErr.Remote, cli)
+			if err != nil {
+				fmt.Fprintln(os.Stderr, "error: failed to resolve conflict:", err)
+				return conflictUnresolved, nil
 			}
+		}
 
-			g.Version = remoteMetadata.Version
-			g.Date = remoteMetadata.Date
+	case ActionPull:
+		pg.Describe(fmt.Sprintf("[%s] Pulling data...", g.Name))
+		res = result{desc: "pulled"}
+		if err := p.pull(g, s.remoteMetadata, cli); err != nil {
+			return result{}, fmt.Errorf("failed to pull: %w", err)
+		}
 
-			if err := p.Service.UpdateMetadata(g.ID, g); err != nil {
-				destroyPg()
-				fmt.Fprintln(os.Stderr, "failed to push:", err)
-				return subcommands.ExitFailure
-			}
-			fmt.Println(g.Name + ": pulled")
-			continue
+	case ActionConflict:
+		stop()
+		var err error
+		res, err = p.conflict(s.remote.GameID, s.remoteMetadata, cli)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "error: failed to resolve conflict:", err)
+			return conflictUnresolved, nil
 		}
+	}
 
-		destroyPg()
+	if !exists {
+		backups = append(backups, p.pushBackups(s, pg)...)
+	}
 
-		if g.Version == remoteMetadata.Version {
-			if err := p.conflict(r.GameID, g, remoteMetadata, cli); err != nil {
-				fmt.Fprintln(os.Stderr, "error: failed to resolve conflict:", err)
-				continue
-			}
+	if err := remote.SetBackups(s.GameID, backups); err != nil {
+		slog.Warn("failed to keep the backups of the server", "err", err)
+	}
+
+	return res, nil
+}
+
+// pushBackups returns the backups that are pushed
+func (p *SyncCmd) pushBackups(s Step, pg *progressbar.ProgressBar) []string {
+	var pushed []string
+	for _, uuid := range s.PushBackups {
+		pg.Describe(fmt.Sprintf("[%s] Pushing backup...", s.Name))
+		if err := p.Service.PushBackup(s.GameID, uuid, s.cli); err != nil {
+			slog.Warn("failed to push backup files", "err", err)
 			continue
 		}
+		pushed = append(pushed, uuid)
 	}
+	return pushed
+}
 
-	fmt.Println("done.")
-	return subcommands.ExitSuccess
+func (p *SyncCmd) progress() *progressbar.ProgressBar {
+	if p.json {
+		return progressbar.DefaultSilent(-1)
+	}
+	return progressbar.New(-1)
+}
+
+func destroy(pg *progressbar.ProgressBar) {
+	pg.Finish()
+	pg.Clear()
+	pg.Close()
 }
 
-func (p *SyncCmd) conflict(gameID string, m, remoteMetadata repository.Metadata, cli *client.Client) error {
+func printStep(s Step) {
+	switch s.Action {
+	case ActionPull:
+		if s.Apply {
+			fmt.Printf("%s: pull, apply to %s\n", s.Name, s.path)
+		} else {
+			fmt.Printf("%s: pull\n", s.Name)
+		}
+	case ActionConflict:
+		fmt.Printf("%s: conflict (%s)\n", s.Name, s.Resolution)
+	case ActionError:
+		fmt.Printf("%s: error: %s\n", s.Name, s.Error)
+	default:
+		fmt.Printf("%s: %s\n", s.Name, s.Action)
+	}
+	if s.Lease != nil {
+		fmt.Println(" ", checkedOut(*s.Lease))
+	}
+	for _, uuid := range s.PullBackups {
+		fmt.Println("  pull backup", uuid)
+	}
+	for _, uuid := range s.PushBackups {
+		fmt.Println("  push backup", uuid)
+	}
+}
+
+// conflict resolves the conflict according to the policy
+func (p *SyncCmd) conflict(gameID string, remoteMetadata repository.Metadata, cli *client.Client) (result, error) {
 	g, err := p.Service.One(gameID)
 	if err != nil {
 		slog.Warn("a conflict was found but the game is not found in the database")
 		slog.Debug("debug info", "gameID", gameID)
-		return nil
+		return result{}, nil
 	}
-	fmt.Println()
-	fmt.Println("--- /!\\ CONFLICT ---")
-	fmt.Println(g.Name, "(", g.Path, ")")
-	fmt.Println("----")
-	fmt.Println("Your version:", g.Date.Format(time.RFC1123))
-	fmt.Println("Their version:", remoteMetadata.Date.Format(time.RFC1123))
-	fmt.Println()
 
-	res := prompt.Conflict()
+	if p.onConflict == PolicyAsk {
+		fmt.Println()
+		fmt.Println("--- /!\\ CONFLICT ---")
+		path, _ := p.Service.Location(g)
+		fmt.Println(g.Name, "(", path, ")")
+		fmt.Println("----")
+		fmt.Println("Your version:", g.Date.Format(time.RFC1123), origin(g))
+		fmt.Println("Their version:", remoteMetadata.Date.Format(time.RFC1123), origin(remoteMetadata))
+		fmt.Println()
+	}
 
-	switch res {
+	switch p.onConflict.resolve(g, remoteMetadata) {
 	case prompt.My:
 		{
-			if err := p.push(m, cli); err != nil {
-				return fmt.Errorf("failed to push: %w", err)
+			// keep the remote archive before it is replaced
+			backupID, err := p.Service.PullAsBackup(gameID, conflictLabel(remoteMetadata), cli)
+			if err != nil {
+				return result{}, fmt.Errorf("failed to save the remote version: %w", err)
+			}
+			if err := p.Service.PushBackup(gameID, backupID, cli); err != nil {
+				return result{}, fmt.Errorf("failed to save the remote version on the server: %w", err)
 			}
+
+			// the local archive replaces the remote one: it becomes its child
+			// so the other devices fast-forward instead of seeing a conflict
+			g.Parent = remoteMetadata.MD5
+			if err := p.Service.UpdateMetadata(g.ID, g); err != nil {
+				return result{}, fmt.Errorf("failed to update metadata: %w", err)
+			}
+			if err := p.push(g, remoteMetadata, cli); err != nil {
+				return result{}, fmt.Errorf("failed to push: %w", err)
+			}
+			return result{desc: "conflict resolved, local version pushed"}, nil
 		}
 
 	case prompt.Their:
 		{
-			if err := p.pull(gameID, cli); err != nil {
-				return fmt.Errorf("failed to push: %w", err)
+			// keep the local archive before it is replaced
+			backupID, err := p.Service.ConflictBackup(gameID, conflictLabel(g))
+			if err != nil {
+				return result{}, fmt.Errorf("failed to save the local version: %w", err)
+			}
+			if len(backupID) > 0 {
+				if err := p.Service.PushBackup(gameID, backupID, cli); err != nil {
+					return result{}, fmt.Errorf("failed to save the local version on the server: %w", err)
+				}
 			}
-			g.Version = remoteMetadata.Version
-			g.Date = remoteMetadata.Date
 
-			if err := p.Service.UpdateMetadata(g.ID, g); err != nil {
-				return fmt.Errorf("failed to push: %w", err)
+			if err := p.pull(g, remoteMetadata, cli); err != nil {
+				return result{}, fmt.Errorf("failed to pull: %w", err)
+			}
+			return result{desc: "conflict resolved, remote version pulled"}, nil
+		}
+
+	case prompt.Both:
+		{
+			// the versions already kept by a previous sync are not saved again
+			backups, err := p.Service.AllBackups(gameID)
+			if err != nil {
+				return result{}, fmt.Errorf("failed to list the backups: %w", err)
+			}
+
+			if !backedUp(backups, g.MD5) {
+				backupID, err := p.Service.ConflictBackup(gameID, conflictLabel(g))
+				if err != nil {
+					return result{}, fmt.Errorf("failed to save the local version: %w", err)
+				}
+				if len(backupID) > 0 {
+					if err := p.Service.PushBackup(gameID, backupID, cli); err != nil {
+						return result{}, fmt.Errorf("failed to save the local version on the server: %w", err)
+					}
+				}
 			}
+
+			if !backedUp(backups, remoteMetadata.MD5) {
+				backupID, err := p.Service.PullAsBackup(gameID, conflictLabel(remoteMetadata), cli)
+				if err != nil {
+					return result{}, fmt.Errorf("failed to save the remote version: %w", err)
+				}
+				if err := p.Service.PushBackup(gameID, backupID, cli); err != nil {
+					return result{}, fmt.Errorf("failed to save the remote version on the server: %w", err)
+				}
+			}
+			return conflictKept, nil
 		}
 	}
-	return nil
+	return conflictSkipped, nil
 }
 
-func (p *SyncCmd) push(m repository.Metadata, cli *client.Client) error {
-	return p.Service.PushArchive(m.ID, "", cli)
+// push replaces the remote archive, the version is bumped above the remote one
+// so the other devices see the local archive as the newest
+func (p *SyncCmd) push(m, remoteMetadata repository.Metadata, cli *client.Client) error {
+	if len(remoteMetadata.MD5) > 0 && m.Version <= remoteMetadata.Version {
+		if err := p.Service.SetVersion(m.ID, remoteMetadata.Version+1); err != nil {
+			return fmt.Errorf("failed to update version number: %w", err)
+		}
+	}
+	return p.Service.PushArchive(m.ID, remoteMetadata.MD5, cli)
 }
 
-func (p *SyncCmd) pushBackup(m repository.Metadata, cli *client.Client) error {
-	bs, err := p.Service.AllBackups(m.ID)
-	if err != nil {
+// pull replaces the local archive and takes the version and the lineage of the remote one
+// The archive is then extracted in the save directory, after the directory was saved in a backup.
+func (p *SyncCmd) pull(m, remoteMetadata repository.Metadata, cli *client.Client) error {
+	path, err := p.Service.Location(m)
+	apply := !p.noApply && err == nil
+	if apply {
+		label := "before sync at " + time.Now().Format(time.DateTime)
+		if _, err := p.Service.BackupDirectory(m.ID, label); err != nil {
+			return fmt.Errorf("failed to save the save directory: %w", err)
+		}
+	}
+
+	// the older servers only send the md5 hash
+	expected := remoteMetadata.Digest
+	if len(expected) == 0 {
+		expected = remoteMetadata.MD5
+	}
+	if err := p.Service.Fetch(m.ID, expected, cli); err != nil {
 		return err
 	}
 
-	for _, b := range bs {
-		binfo, err := cli.ArchiveInfo(m.ID, b.UUID)
-		if err != nil {
-			if !errors.Is(err, client.ErrNotFound) {
-				return fmt.Errorf("failed to get remote information about the backup file: %w", err)
-			}
-		}
+	m.Version = remoteMetadata.Version
+	m.Date = remoteMetadata.Date
+	m.Parent = remoteMetadata.Parent
+	m.Device = remoteMetadata.Device
 
-		if binfo.MD5 != b.MD5 {
-			if err := cli.PushBackup(b, m); err != nil {
-				return fmt.Errorf("failed to push backup: %w", err)
-			}
-		}
+	if err := p.Service.UpdateMetadata(m.ID, m); err != nil {
+		return err
+	}
 
+	if !apply {
+		return nil
 	}
-	return nil
-}
 
-func (p *SyncCmd) pullBackup(m repository.Metadata, cli *client.Client) error {
-	bs, err := cli.ListArchives(m.ID)
-	if err != nil {
-		return err
+	if err := p.Service.ApplyCurrent(m.ID); err != nil {
+		return fmt.Errorf("failed to apply the archive to %s: %w", path, err)
 	}
 
-	for _, uuid := range bs {
-		rinfo, err := cli.ArchiveInfo(m.ID, uuid)
-		if err != nil {
-			return err
-		}
+	return nil
+}
 
-		linfo, err := p.Service.Backup(m.ID, uuid)
-		if err != nil {
-			return err
-		}
+// checkedOut describes the lease of another device
+func checkedOut(l repository.Lease) string {
+	return fmt.Sprintf("this save is checked out by %s since %s", l.Device, l.Since.Local().Format(time.DateTime))
+}
 
-		if linfo.MD5 != rinfo.MD5 {
-			if err := p.Service.PullBackup(m.ID, uuid, cli); err != nil {
-				return err
-			}
+// backedUp tells whether one of the backups is the archive with the md5 hash
+func backedUp(backups []repository.Backup, md5 string) bool {
+	for _, b := range backups {
+		if b.MD5 == md5 {
+			return true
 		}
 	}
-	return nil
+	return false
 }
 
-func (p *SyncCmd) pull(gameID string, cli *client.Client) error {
-	return p.Service.PullArchive(gameID, "", cli)
+func conflictLabel(m repository.Metadata) string {
+	device := m.Device
+	if len(device) == 0 {
+		device = "unknown device"
+	}
+	return fmt.Sprintf("conflict from %s at %s", device, m.Date.Local().Format(time.DateTime))
+}
+
+func origin(m repository.Metadata) string {
+	if len(m.Device) == 0 {
+		return ""
+	}
+	return "(from " + m.Device + ")"
 }
 
 func connect(remoteCred map[string]map[string]string, r remote.Remote) (*client.Client, error) {
@@ -0,0 +1,141 @@
+package watch
+
+import (
+	"context"
+	"io/fs"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+)
+
+type (
+	// notifier tells which game was modified once its directories were not
+	// written for delay. The notifications are not recursive, every
+	// sub-directory is watched.
+	notifier struct {
+		w     *fsnotify.Watcher
+		delay time.Duration
+		// game of each watched directory
+		dirs  map[string]string
+		ready chan string
+
+		mu     sync.Mutex
+		timers map[string]*time.Timer
+	}
+)
+
+func newNotifier(delay time.Duration) (*notifier, error) {
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return nil, err
+	}
+
+	return &notifier{
+		w:      w,
+		delay:  delay,
+		dirs:   make(map[string]string),
+		ready:  make(chan string),
+		timers: make(map[string]*time.Timer),
+	}, nil
+}
+
+// add watches root and its sub-directories for the game
+func (n *notifier) add(gameID, root string) error {
+	return filepath.WalkDir(root, func(path string, d fs.DirEntry, err error) error {
+		if err != nil {
+			// the directory was removed while it was read
+			if path != root && os.IsNotExist(err) {
+				return nil
+			}
+			return err
+		}
+		if !d.IsDir() {
+			return nil
+		}
+		if _, ok := n.dirs[path]; ok {
+			return nil
+		}
+		if err := n.w.Add(path); err != nil {
+			return err
+		}
+		n.dirs[path] = gameID
+		return nil
+	})
+}
+
+// handle schedules a scan of the game of the event, the new directories
+// are watched too
+func (n *notifier) handle(ctx context.Context, ev fsnotify.Event) error {
+	gameID, ok := n.dirs[filepath.Dir(ev.Name)]
+	if !ok {
+		if gameID, ok = n.dirs[ev.Name]; !ok {
+			return nil
+		}
+	}
+
+	// the watches of a removed directory are dropped, it is watched
+	// again if it comes back
+	if ev.Has(fsnotify.Remove) || ev.Has(fsnotify.Rename) {
+		for dir := range n.dirs {
+			if dir == ev.Name || strings.HasPrefix(dir, ev.Name+string(filepath.Separator)) {
+				delete(n.dirs, dir)
+			}
+		}
+	}
+
+	var err error
+	if ev.Has(fsnotify.Create) {
+		if fi, statErr := os.Lstat(ev.Name); statErr == nil && fi.IsDir() {
+			err = n.add(gameID, ev.Name)
+		}
+	}
+
+	n.schedule(ctx, gameID)
+	return err
+}
+
+// schedule tells that the game is ready after delay, the delay starts
+// again if the game is modified before
+func (n *notifier) schedule(ctx context.Context, gameID string) {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	if t, ok := n.timers[gameID]; ok {
+		t.Reset(n.delay)
+		return
+	}
+
+	n.timers[gameID] = time.AfterFunc(n.delay, func() {
+		n.mu.Lock()
+		delete(n.timers, gameID)
+		n.mu.Unlock()
+
+		select {
+		case n.ready <- gameID:
+		case <-ctx.Done():
+		}
+	})
+}
+
+// pending stops the delays and returns the games that were waiting
+func (n *notifier) pending() []string {
+	n.mu.Lock()
+	defer n.mu.Unlock()
+
+	var res []string
+	for gameID, t := range n.timers {
+		if t.Stop() {
+			res = append(res, gameID)
+		}
+	}
+	clear(n.timers)
+	return res
+}
+
+func (n *notifier) Close() error {
+	return n.w.Close()
+}
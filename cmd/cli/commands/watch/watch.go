@@ -0,0 +1,197 @@
+package watch
+
+import (
+	"cloudsave/cmd/cli/commands/sync"
+	"cloudsave/pkg/data"
+	"cloudsave/pkg/repository"
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"log/slog"
+	"os"
+	"os/signal"
+	"syscall"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+	"github.com/google/subcommands"
+)
+
+type (
+	WatchCmd struct {
+		Service    *data.Service
+		delay      time.Duration
+		poll       time.Duration
+		sync       bool
+		onConflict sync.ConflictPolicy
+		// keeps the credentials from a sync to another
+		syncer *sync.SyncCmd
+	}
+)
+
+func (*WatchCmd) Name() string     { return "watch" }
+func (*WatchCmd) Synopsis() string { return "scan the games when their files are modified" }
+func (*WatchCmd) Usage() string {
+	return `Usage: cloudsave watch [-delay DURATION] [-poll DURATION] [-sync [-on-conflict=local|remote|newest|keep-both|skip]]
+
+Watch the save directories and scan a game once its files were not
+modified for the delay. The directories that cannot be watched are
+scanned at each poll interval. Stop with Ctrl+C, the games that were
+waiting for their delay are scanned before.
+
+The games added after the start are not watched, restart the command.
+
+Options:
+`
+}
+
+func (p *WatchCmd) SetFlags(f *flag.FlagSet) {
+	p.onConflict = sync.PolicySkip
+	f.DurationVar(&p.delay, "delay", 10*time.Second, "time without modification before a scan")
+	f.DurationVar(&p.poll, "poll", 5*time.Minute, "interval of the scans of the directories that cannot be watched")
+	f.BoolVar(&p.sync, "sync", false, "synchronize a game with its remote after a new version")
+	f.Var(&p.onConflict, "on-conflict", "with -sync, how to resolve a conflict: local, remote, newest (most recent date), keep-both (save both versions in backups) or skip")
+}
+
+func (p *WatchCmd) Execute(ctx context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	if p.delay <= 0 || p.poll <= 0 {
+		fmt.Fprintln(os.Stderr, "error: the delay and the poll interval must be positive")
+		return subcommands.ExitUsageError
+	}
+	if p.onConflict == sync.PolicyAsk {
+		fmt.Fprintln(os.Stderr, "error: the conflicts cannot be asked while watching")
+		return subcommands.ExitUsageError
+	}
+
+	games, err := p.Service.AllGames()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to load datastore:", err)
+		return subcommands.ExitFailure
+	}
+	p.syncer = sync.New(p.Service, p.onConflict)
+
+	ctx, stop := signal.NotifyContext(ctx, os.Interrupt, syscall.SIGTERM)
+	defer stop()
+
+	n, err := newNotifier(p.delay)
+	if err != nil {
+		slog.Warn("the file system notifications are not available, the directories are polled", "err", err)
+	} else {
+		defer n.Close()
+	}
+
+	// games that are scanned at each poll interval
+	polled := make(map[string]struct{})
+	for _, g := range games {
+		if err := p.watch(n, g); err != nil {
+			slog.Warn("failed to watch the game, it is polled", "game", g.Name, "err", err)
+			polled[g.ID] = struct{}{}
+		}
+	}
+
+	var (
+		events <-chan fsnotify.Event
+		errs   <-chan error
+		ready  <-chan string
+	)
+	if n != nil {
+		events, errs, ready = n.w.Events, n.w.Errors, n.ready
+	}
+
+	ticker := time.NewTicker(p.poll)
+	defer ticker.Stop()
+
+	fmt.Printf("watching %d game(s), press Ctrl+C to stop\n", len(games))
+	for {
+		select {
+		case <-ctx.Done():
+			if n != nil {
+				for _, gameID := range n.pending() {
+					p.scan(n, gameID)
+				}
+			}
+			fmt.Println("done.")
+			return subcommands.ExitSuccess
+
+		case ev := <-events:
+			if err := n.handle(ctx, ev); err != nil {
+				slog.Warn("failed to watch a new directory", "path", ev.Name, "err", err)
+			}
+
+		case err := <-errs:
+			// some events were lost, every game may have been modified
+			if errors.Is(err, fsnotify.ErrEventOverflow) {
+				for _, g := range games {
+					n.schedule(ctx, g.ID)
+				}
+				continue
+			}
+			slog.Warn("file system notification error", "err", err)
+
+		case gameID := <-ready:
+			p.scan(n, gameID)
+
+		case <-ticker.C:
+			for gameID := range polled {
+				if g, err := p.Service.One(gameID); err == nil && p.watch(n, g) == nil {
+					delete(polled, gameID)
+				}
+				p.scan(n, gameID)
+			}
+		}
+	}
+}
+
+// watch adds the directories of the game to the notifier
+func (p *WatchCmd) watch(n *notifier, g repository.Metadata) error {
+	if n == nil {
+		return errors.New("no notifier")
+	}
+
+	dirs, err := p.Service.Directories(g)
+	if err != nil {
+		return err
+	}
+
+	for _, dir := range dirs {
+		if err := n.add(g.ID, dir); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// scan makes a new version of the game if needed and synchronizes it
+func (p *WatchCmd) scan(n *notifier, gameID string) {
+	g, err := p.Service.One(gameID)
+	if err != nil {
+		slog.Warn("the game is not in the datastore anymore", "id", gameID)
+		return
+	}
+
+	// the directories may have been replaced, e.g. by an applied archive
+	if n != nil {
+		defer func() { _ = p.watch(n, g) }()
+	}
+
+	now := time.Now().Format(time.DateTime)
+	changed, err := p.Service.Scan(gameID)
+	if err != nil {
+		fmt.Println(now, "❌", g.Name, ":", err.Error())
+		return
+	}
+	if !changed {
+		return
+	}
+	fmt.Println(now, "✅", g.Name, ": backed up")
+
+	if p.sync {
+		if g, err = p.Service.One(gameID); err == nil {
+			err = p.syncer.Sync(g)
+		}
+		if err != nil {
+			fmt.Println(now, "❌", g.Name, ": failed to sync:", err.Error())
+		}
+	}
+}
@@ -3,15 +3,24 @@ package main
 import (
 	"cloudsave/cmd/cli/commands/add"
 	"cloudsave/cmd/cli/commands/apply"
+	"cloudsave/cmd/cli/commands/edit"
+	"cloudsave/cmd/cli/commands/launch"
 	"cloudsave/cmd/cli/commands/list"
+	"cloudsave/cmd/cli/commands/lock"
+	"cloudsave/cmd/cli/commands/migrate"
+	"cloudsave/cmd/cli/commands/prune"
 	"cloudsave/cmd/cli/commands/pull"
 	"cloudsave/cmd/cli/commands/remote"
 	"cloudsave/cmd/cli/commands/remove"
+	"cloudsave/cmd/cli/commands/retention"
 	"cloudsave/cmd/cli/commands/run"
 	"cloudsave/cmd/cli/commands/show"
+	"cloudsave/cmd/cli/commands/status"
 	"cloudsave/cmd/cli/commands/sync"
 	"cloudsave/cmd/cli/commands/version"
+	"cloudsave/cmd/cli/commands/watch"
 	"cloudsave/pkg/data"
+	"cloudsave/pkg/device"
 	"cloudsave/pkg/repository"
 	"context"
 	"flag"
@@ -33,12 +42,36 @@ func main() {
 		panic("cannot make the datastore:" + err.Error())
 	}
 
-	repo, err := repository.NewLazyRepository(datastorepath)
+	var repo repository.Repository
+	chunkstorepath := filepath.Join(roaming, "cloudsave", "chunks")
+	if _, err := os.Stat(chunkstorepath); err == nil {
+		r, err := repository.NewChunkRepository(datastorepath, chunkstorepath)
+		if err != nil {
+			panic("cannot make the datastore:" + err.Error())
+		}
+		if err := r.Recover(); err != nil {
+			panic("cannot recover the datastore:" + err.Error())
+		}
+		repo = r
+	} else {
+		r, err := repository.NewLazyRepository(datastorepath)
+		if err != nil {
+			panic("cannot make the datastore:" + err.Error())
+		}
+		if err := r.Recover(); err != nil {
+			panic("cannot recover the datastore:" + err.Error())
+		}
+		repo = r
+	}
+
+	dev, err := device.Load(filepath.Join(roaming, "cloudsave", "device.json"))
 	if err != nil {
-		panic("cannot make the datastore:" + err.Error())
+		panic("cannot load the device identity:" + err.Error())
 	}
 
 	s := data.NewService(repo)
+	s.SetDevice(dev.ID, dev.Name)
+	retentionPath := filepath.Join(roaming, "cloudsave", "retention.json")
 
 	subcommands.Register(subcommands.HelpCommand(), "help")
 	subcommands.Register(subcommands.FlagsCommand(), "help")
@@ -46,16 +79,24 @@ func main() {
 	subcommands.Register(&version.VersionCmd{}, "help")
 
 	subcommands.Register(&add.AddCmd{Service: s}, "management")
-	subcommands.Register(&run.RunCmd{Service: s}, "management")
+	subcommands.Register(&run.RunCmd{Service: s, RetentionPath: retentionPath}, "management")
+	subcommands.Register(&status.StatusCmd{Service: s}, "management")
+	subcommands.Register(&watch.WatchCmd{Service: s}, "management")
 	subcommands.Register(&list.ListCmd{Service: s}, "management")
 	subcommands.Register(&remove.RemoveCmd{Service: s}, "management")
 	subcommands.Register(&show.ShowCmd{Service: s}, "management")
+	subcommands.Register(&edit.EditCmd{Service: s}, "management")
+	subcommands.Register(&retention.RetentionCmd{Service: s, RetentionPath: retentionPath}, "management")
+	subcommands.Register(&prune.PruneCmd{Service: s, RetentionPath: retentionPath}, "management")
+	subcommands.Register(&migrate.MigrateCmd{DataPath: datastorepath, ChunkPath: chunkstorepath}, "management")
 
 	subcommands.Register(&apply.ApplyCmd{Service: s}, "restore")
 
 	subcommands.Register(&remote.RemoteCmd{Service: s}, "remote")
 	subcommands.Register(&sync.SyncCmd{Service: s}, "remote")
 	subcommands.Register(&pull.PullCmd{Service: s}, "remote")
+	subcommands.Register(&launch.LaunchCmd{Service: s}, "remote")
+	subcommands.Register(&lock.LockCmd{Service: s}, "remote")
 
 	flag.Parse()
 	ctx := context.Background()
@@ -0,0 +1,48 @@
+package flags
+
+import (
+	"cloudsave/pkg/repository"
+	"cloudsave/pkg/tools/paths"
+	"fmt"
+	"strings"
+)
+
+type (
+	// Strings is a flag that can be repeated, each value is appended
+	Strings []string
+
+	// Roots is a flag that can be repeated, each value is a NAME=PATH pair
+	Roots []repository.Root
+)
+
+func (s *Strings) String() string {
+	return strings.Join(*s, ", ")
+}
+
+func (s *Strings) Set(v string) error {
+	*s = append(*s, v)
+	return nil
+}
+
+func (r *Roots) String() string {
+	var res []string
+	for _, v := range *r {
+		res = append(res, v.Name+"="+v.Path)
+	}
+	return strings.Join(res, ", ")
+}
+
+func (r *Roots) Set(v string) error {
+	name, path, ok := strings.Cut(v, "=")
+	if !ok || len(name) == 0 || len(path) == 0 {
+		return fmt.Errorf("expected NAME=PATH, got %q", v)
+	}
+
+	path, err := paths.Abs(path)
+	if err != nil {
+		return fmt.Errorf("cannot get the absolute path of %s: %w", name, err)
+	}
+
+	*r = append(*r, repository.Root{Name: name, Path: path})
+	return nil
+}
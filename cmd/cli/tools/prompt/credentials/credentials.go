@@ -9,7 +9,16 @@ import (
 	"golang.org/x/term"
 )
 
+// Read asks the username and the password, they are taken from the
+// environment when CLOUDSAVE_USERNAME and CLOUDSAVE_PASSWORD are set
+// (e.g. from a launcher, without a terminal)
 func Read() (string, string, error) {
+	if username, ok := os.LookupEnv("CLOUDSAVE_USERNAME"); ok {
+		if password, ok := os.LookupEnv("CLOUDSAVE_PASSWORD"); ok {
+			return username, password, nil
+		}
+	}
+
 	fmt.Print("Enter username: ")
 	reader := bufio.NewReader(os.Stdin)
 	username, _ := reader.ReadString('\n')
@@ -0,0 +1,57 @@
+package prompt
+
+import (
+	"cloudsave/pkg/data"
+	"cloudsave/pkg/repository"
+	"cloudsave/pkg/tools/paths"
+	"fmt"
+	"os"
+)
+
+// Locate asks for the directories of the game that are not set on this
+// device, the directory of another device is suggested when it exists here
+func Locate(s *data.Service, m *repository.Metadata) {
+	if _, err := s.Location(*m); err != nil {
+		msg := fmt.Sprintf("Where is the save directory of %s on this computer?", m.Name)
+		if v := abs(ScanString(msg, s.SuggestPath(*m))); len(v) > 0 {
+			s.SetPath(m, v)
+		}
+	}
+
+	path, err := s.Location(*m)
+	if err != nil {
+		return
+	}
+
+	for i, r := range s.LocalRoots(*m) {
+		if len(r.Path) > 0 {
+			continue
+		}
+
+		msg := fmt.Sprintf("Where is the folder %s of %s on this computer? (empty to keep it in %s)", r.Name, m.Name, data.RootsDir)
+		v := abs(ScanString(msg, s.SuggestRootPath(m.Roots[i])))
+		if len(v) == 0 {
+			continue
+		}
+
+		roots := s.LocalRoots(*m)
+		roots[i].Path = v
+		if err := data.CheckRoots(path, roots); err != nil {
+			fmt.Fprintln(os.Stderr, "error:", err)
+			continue
+		}
+		s.SetRootPath(&m.Roots[i], v)
+	}
+}
+
+func abs(p string) string {
+	if len(p) == 0 {
+		return ""
+	}
+	v, err := paths.Abs(p)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+		return ""
+	}
+	return v
+}
@@ -1,7 +1,9 @@
 package prompt
 
 import (
+	"bufio"
 	"fmt"
+	"os"
 	"strings"
 )
 
@@ -12,26 +14,33 @@ type (
 const (
 	My ConflictResponse = iota
 	Their
+	Both
 	Abort
 )
 
+// stdin is shared by the prompts, a reader of their own would keep the
+// answers to the next prompts in its buffer when the input is piped
+var stdin = bufio.NewReader(os.Stdin)
+
 func ScanBool(msg string, defaultValue bool) bool {
 	fmt.Printf("%s: ", msg)
 
-	var r string
-	if _, err := fmt.Scanln(&r); err != nil {
-		panic(err)
+	// no answer (empty line, closed or missing stdin) means the default value
+	r, ok := scanLine()
+	if !ok || len(r) == 0 {
+		return defaultValue
 	}
 
 	return strings.ToLower(r) == "y"
 }
 
 func Conflict() ConflictResponse {
-	fmt.Print("[M: My, T: Their, A: Abort]: ")
+	fmt.Print("[M: My, T: Their, B: Both, A: Abort]: ")
 
-	var r string
-	if _, err := fmt.Scanln(&r); err != nil {
-		panic(err)
+	// nobody can answer (e.g. run from cron): the conflict is left as is
+	r, ok := scanLine()
+	if !ok {
+		return Abort
 	}
 
 	switch strings.ToLower(r) {
@@ -39,7 +48,40 @@ func Conflict() ConflictResponse {
 		return My
 	case "t":
 		return Their
+	case "b":
+		return Both
 	default:
 		return Abort
 	}
 }
+
+// ScanString returns the line typed by the user, or the default value
+// if the line is empty. Nothing is returned if nobody can answer.
+func ScanString(msg, defaultValue string) string {
+	if len(defaultValue) > 0 {
+		fmt.Printf("%s [%s]: ", msg, defaultValue)
+	} else {
+		fmt.Printf("%s: ", msg)
+	}
+
+	r, ok := scanLine()
+	if !ok {
+		fmt.Println()
+		return ""
+	}
+
+	if len(r) == 0 {
+		return defaultValue
+	}
+	return r
+}
+
+// scanLine returns the line typed by the user without the surrounding
+// spaces, false if nobody can answer
+func scanLine() (string, bool) {
+	r, err := stdin.ReadString('\n')
+	if err != nil && len(r) == 0 {
+		return "", false
+	}
+	return strings.TrimSpace(r), true
+}
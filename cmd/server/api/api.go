@@ -3,6 +3,9 @@ package api
 import (
 	"cloudsave/pkg/data"
 	"cloudsave/pkg/repository"
+	"cloudsave/pkg/retention"
+	"cloudsave/pkg/tools/hash"
+	"encoding/json"
 	"errors"
 	"fmt"
 	"log/slog"
@@ -10,6 +13,7 @@ import (
 	"os"
 	"path/filepath"
 	"strconv"
+	"strings"
 	"time"
 
 	"github.com/go-chi/chi/v5"
@@ -21,18 +25,25 @@ type (
 		Server       *http.Server
 		Service      *data.Service
 		documentRoot string
+		// maximum size of an upload in bytes, 0 for no limit
+		maxUploadSize int64
+		uploads       *sessions
 	}
 )
 
 // NewServer start the http server
-func NewServer(documentRoot string, srv *data.Service, creds map[string]string, port int) *HTTPServer {
+func NewServer(documentRoot string, srv *data.Service, creds map[string]string, port int, maxUploadSize int64) *HTTPServer {
 	if !filepath.IsAbs(documentRoot) {
 		panic("the document root is not an absolute path")
 	}
 	s := &HTTPServer{
-		Service:      srv,
-		documentRoot: documentRoot,
+		Service:       srv,
+		documentRoot:  documentRoot,
+		maxUploadSize: maxUploadSize,
+		uploads:       newSessions(filepath.Join(documentRoot, "uploads"), 24*time.Hour),
 	}
+	go s.uploads.cleanEvery(time.Hour)
+
 	router := chi.NewRouter()
 	router.NotFound(func(writer http.ResponseWriter, request *http.Request) {
 		notFound("id not found", writer, request)
@@ -66,6 +77,18 @@ func NewServer(documentRoot string, srv *data.Service, creds map[string]string,
 						saveRouter.Post("/{id}/hist/{uuid}/data", s.histUpload)
 						saveRouter.Get("/{id}/hist/{uuid}/data", s.histDownload)
 						saveRouter.Get("/{id}/hist/{uuid}/info", s.histExists)
+						saveRouter.Post("/{id}/hist/{uuid}/restore", s.histRestore)
+
+						saveRouter.Post("/{id}/uploads", s.createUpload)
+						saveRouter.Get("/{id}/uploads/{session}", s.uploadStatus)
+						saveRouter.Put("/{id}/uploads/{session}", s.uploadChunk)
+						saveRouter.Delete("/{id}/uploads/{session}", s.abortUpload)
+						saveRouter.Post("/{id}/uploads/{session}/commit", s.commitUpload)
+
+						saveRouter.Get("/{id}/lock", s.lease)
+						saveRouter.Post("/{id}/lock", s.acquire)
+						saveRouter.Put("/{id}/lock", s.renew)
+						saveRouter.Delete("/{id}/lock", s.release)
 					})
 				})
 			})
@@ -91,16 +114,24 @@ func (s HTTPServer) all(w http.ResponseWriter, r *http.Request) {
 
 func (s HTTPServer) download(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
-	path := filepath.Clean(filepath.Join(s.documentRoot, "data", id))
 
-	fi, err := os.Stat(filepath.Join(path, "data.tar.gz"))
+	m, err := s.Service.One(id)
 	if err != nil {
-		notFound("id not found", w, r)
+		if errors.Is(err, repository.ErrNotFound) {
+			notFound("id not found", w, r)
+			return
+		}
+		slog.Error(err.Error())
+		internalServerError(w, r)
 		return
 	}
 
 	f, err := s.Service.Repository().ReadBlob(repository.NewGameIdentifier(id))
 	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			notFound("id not found", w, r)
+			return
+		}
 		slog.Error(err.Error())
 		internalServerError(w, r)
 		return
@@ -110,55 +141,67 @@ func (s HTTPServer) download(w http.ResponseWriter, r *http.Request) {
 	// Set headers
 	w.Header().Set("Content-Disposition", "attachment; filename=\"data.tar.gz\"")
 	w.Header().Set("Content-Type", "application/gzip")
-	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
-	w.WriteHeader(200)
+	w.Header().Set("ETag", etag(m.MD5))
+	w.Header().Set(digestHeader, hash.ReprDigest(m.Digest, m.MD5))
 
 	// Stream the file content
-	http.ServeContent(w, r, "data.tar.gz", fi.ModTime(), f)
+	http.ServeContent(w, r, "data.tar.gz", m.Date, f)
 }
 
 func (s HTTPServer) upload(w http.ResponseWriter, r *http.Request) {
-	const (
-		sizeLimit int64 = 500 << 20 // 500 MB
-	)
-
 	id := chi.URLParam(r, "id")
 
 	// Limit max upload size
-	r.Body = http.MaxBytesReader(w, r.Body, sizeLimit)
+	if s.maxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize)
+	}
 
-	// Parse multipart form
-	err := r.ParseMultipartForm(sizeLimit)
+	// the payload is written in the staging area of the repository as it
+	// arrives, the metadata may come before or after it
+	f, err := newForm(r)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error: failed to load payload:", err)
 		badRequest("bad payload", w, r)
 		return
 	}
 
-	m, err := parseFormMetadata(id, r.MultipartForm.Value)
+	file, err := f.payload()
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error: cannot find metadata in the form:", err)
-		badRequest("metadata not found", w, r)
+		if !formError(err, w, r) {
+			internalServerError(w, r)
+		}
 		return
 	}
 
-	// Retrieve file
-	file, _, err := r.FormFile("payload")
+	v, err := newVerifier(file, r)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error: cannot find payload in the form:", err)
-		badRequest("payload not found", w, r)
+		formError(err, w, r)
 		return
 	}
-	defer file.Close()
+	defer v.verify()
 
-	//TODO make a transaction
-	if err := s.Service.UpdateMetadata(id, m); err != nil {
-		fmt.Fprintln(os.Stderr, "error: failed to write metadata to disk:", err)
-		internalServerError(w, r)
-		return
-	}
-
-	if err := s.Service.Copy(id, file); err != nil {
+	err = s.Service.Upload(id, parseETag(r.Header.Get("If-Match")), v, func() (repository.Metadata, error) {
+		values, err := f.rest()
+		if err != nil {
+			return repository.Metadata{}, err
+		}
+		if err := v.verify(); err != nil {
+			return repository.Metadata{}, err
+		}
+		m, err := parseFormMetadata(id, values)
+		if err != nil {
+			return repository.Metadata{}, fmt.Errorf("%w: %w", errNoMetadata, err)
+		}
+		return m, nil
+	})
+	if err != nil {
+		if errors.Is(err, data.ErrConflict) {
+			s.conflict(id, w, r)
+			return
+		}
+		if formError(err, w, r) {
+			return
+		}
 		fmt.Fprintln(os.Stderr, "error: failed to write data to disk:", err)
 		internalServerError(w, r)
 		return
@@ -170,6 +213,8 @@ func (s HTTPServer) upload(w http.ResponseWriter, r *http.Request) {
 		return
 	}
 
+	s.prune(id)
+
 	// Respond success
 	w.WriteHeader(http.StatusCreated)
 }
@@ -193,34 +238,55 @@ func (s HTTPServer) allHist(w http.ResponseWriter, r *http.Request) {
 }
 
 func (s HTTPServer) histUpload(w http.ResponseWriter, r *http.Request) {
-	const (
-		sizeLimit int64 = 500 << 20 // 500 MB
-	)
-
 	gameID := chi.URLParam(r, "id")
 	uuid := chi.URLParam(r, "uuid")
 
 	// Limit max upload size
-	r.Body = http.MaxBytesReader(w, r.Body, sizeLimit)
+	if s.maxUploadSize > 0 {
+		r.Body = http.MaxBytesReader(w, r.Body, s.maxUploadSize)
+	}
 
-	// Parse multipart form
-	err := r.ParseMultipartForm(sizeLimit)
+	f, err := newForm(r)
 	if err != nil {
 		fmt.Fprintln(os.Stderr, "error: failed to load payload:", err)
 		badRequest("bad payload", w, r)
 		return
 	}
 
-	// Retrieve file
-	file, _, err := r.FormFile("payload")
+	file, err := f.payload()
+	if err != nil {
+		if !formError(err, w, r) {
+			internalServerError(w, r)
+		}
+		return
+	}
+
+	v, err := newVerifier(file, r)
 	if err != nil {
-		fmt.Fprintln(os.Stderr, "error: cannot find payload in the form:", err)
-		badRequest("payload not found", w, r)
+		formError(err, w, r)
 		return
 	}
-	defer file.Close()
+	defer v.verify()
 
-	if err := s.Service.CopyBackup(gameID, uuid, file); err != nil {
+	err = s.Service.CopyBackup(gameID, uuid, v, func() (*repository.Metadata, error) {
+		values, err := f.rest()
+		if err != nil {
+			return nil, err
+		}
+		if err := v.verify(); err != nil {
+			return nil, err
+		}
+		// the metadata are optional, old clients do not send the metadata of the backup
+		m, err := parseFormMetadata(gameID, values)
+		if err != nil {
+			return nil, nil
+		}
+		return &m, nil
+	})
+	if err != nil {
+		if formError(err, w, r) {
+			return
+		}
 		fmt.Fprintln(os.Stderr, "error: failed to write data to the disk:", err)
 		internalServerError(w, r)
 		return
@@ -239,16 +305,24 @@ func (s HTTPServer) histUpload(w http.ResponseWriter, r *http.Request) {
 func (s HTTPServer) histDownload(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	uuid := chi.URLParam(r, "uuid")
-	path := filepath.Clean(filepath.Join(s.documentRoot, "data", id, "hist", uuid))
 
-	fi, err := os.Stat(filepath.Join(path, "data.tar.gz"))
+	b, err := s.Service.Repository().Backup(repository.NewBackupIdentifier(id, uuid))
 	if err != nil {
-		notFound("id not found", w, r)
+		if errors.Is(err, repository.ErrNotFound) {
+			notFound("id not found", w, r)
+			return
+		}
+		slog.Error(err.Error())
+		internalServerError(w, r)
 		return
 	}
 
 	f, err := s.Service.Repository().ReadBlob(repository.NewBackupIdentifier(id, uuid))
 	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			notFound("id not found", w, r)
+			return
+		}
 		slog.Error(err.Error())
 		internalServerError(w, r)
 		return
@@ -258,11 +332,11 @@ func (s HTTPServer) histDownload(w http.ResponseWriter, r *http.Request) {
 	// Set headers
 	w.Header().Set("Content-Disposition", "attachment; filename=\"data.tar.gz\"")
 	w.Header().Set("Content-Type", "application/gzip")
-	w.Header().Set("Content-Length", strconv.FormatInt(fi.Size(), 10))
-	w.WriteHeader(200)
+	w.Header().Set("ETag", etag(b.MD5))
+	w.Header().Set(digestHeader, hash.ReprDigest(b.Digest, b.MD5))
 
 	// Stream the file content
-	http.ServeContent(w, r, "data.tar.gz", fi.ModTime(), f)
+	http.ServeContent(w, r, "data.tar.gz", b.CreatedAt, f)
 }
 
 func (s HTTPServer) histExists(w http.ResponseWriter, r *http.Request) {
@@ -283,6 +357,36 @@ func (s HTTPServer) histExists(w http.ResponseWriter, r *http.Request) {
 	ok(finfo, w, r)
 }
 
+func (s HTTPServer) histRestore(w http.ResponseWriter, r *http.Request) {
+	gameID := chi.URLParam(r, "id")
+	uuid := chi.URLParam(r, "uuid")
+
+	if err := s.Service.Restore(gameID, uuid); err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			notFound("not found", w, r)
+			return
+		}
+		fmt.Fprintln(os.Stderr, "error: failed to restore backup:", err)
+		internalServerError(w, r)
+		return
+	}
+
+	if err := s.Service.ReloadCache(gameID); err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to reload data from the disk:", err)
+		internalServerError(w, r)
+		return
+	}
+
+	metadata, err := s.Service.One(gameID)
+	if err != nil {
+		slog.Error(err.Error())
+		internalServerError(w, r)
+		return
+	}
+
+	ok(metadata, w, r)
+}
+
 func (s HTTPServer) metadata(w http.ResponseWriter, r *http.Request) {
 	id := chi.URLParam(r, "id")
 	metadata, err := s.Service.One(id)
@@ -295,9 +399,63 @@ func (s HTTPServer) metadata(w http.ResponseWriter, r *http.Request) {
 		internalServerError(w, r)
 		return
 	}
+	if len(metadata.MD5) > 0 {
+		w.Header().Set("ETag", etag(metadata.MD5))
+	}
 	ok(metadata, w, r)
 }
 
+// conflict responds with the current metadata of the game
+func (s HTTPServer) conflict(gameID string, w http.ResponseWriter, r *http.Request) {
+	metadata, err := s.Service.One(gameID)
+	if err != nil && !errors.Is(err, repository.ErrNotFound) {
+		slog.Error(err.Error())
+		internalServerError(w, r)
+		return
+	}
+	if len(metadata.MD5) > 0 {
+		w.Header().Set("ETag", etag(metadata.MD5))
+	}
+	conflict(metadata, w, r)
+}
+
+// etag makes an entity tag from the hash of an archive
+func etag(md5 string) string {
+	return strconv.Quote(md5)
+}
+
+// parseETag returns the hash of an entity tag, or "*"
+func parseETag(v string) string {
+	v = strings.TrimSpace(v)
+	v = strings.TrimPrefix(v, "W/")
+	return strings.Trim(v, `"`)
+}
+
+// prune applies the retention policy of the document root, errors are only logged
+func (s HTTPServer) prune(gameID string) {
+	global, err := retention.Load(filepath.Join(s.documentRoot, "retention.json"))
+	if err != nil {
+		slog.Error("failed to load the retention policy", "err", err)
+		return
+	}
+
+	removed, err := s.Service.Prune(gameID, global, false)
+	if err != nil {
+		slog.Error("failed to prune backups", "id", gameID, "err", err)
+		return
+	}
+
+	for _, b := range removed {
+		slog.Info("backup pruned", "id", gameID, "uuid", b.UUID)
+	}
+
+	if len(removed) > 0 {
+		if _, err := s.Service.CollectGarbage(); err != nil {
+			slog.Error("failed to remove unreferenced data", "err", err)
+		}
+	}
+}
+
 func parseFormMetadata(gameID string, values map[string][]string) (repository.Metadata, error) {
 	var name string
 	if v, ok := values["name"]; ok {
@@ -337,10 +495,46 @@ func parseFormMetadata(gameID string, values map[string][]string) (repository.Me
 		return repository.Metadata{}, fmt.Errorf("error: cannot find metadata in the form")
 	}
 
+	// the lineage is optional, older clients do not send it
+	var parent, device, label string
+	if v, ok := values["parent"]; ok && len(v) > 0 {
+		parent = v[0]
+	}
+	if v, ok := values["device"]; ok && len(v) > 0 {
+		device = v[0]
+	}
+	if v, ok := values["label"]; ok && len(v) > 0 {
+		label = v[0]
+	}
+	isConflict := false
+	if v, ok := values["conflict"]; ok && len(v) > 0 {
+		isConflict, _ = strconv.ParseBool(v[0])
+	}
+
+	// the save directories of the devices are optional too
+	var paths map[string]string
+	if v, ok := values["paths"]; ok && len(v) > 0 {
+		if err := json.Unmarshal([]byte(v[0]), &paths); err != nil {
+			return repository.Metadata{}, fmt.Errorf("error: corrupted metadata: %w", err)
+		}
+	}
+	var roots []repository.Root
+	if v, ok := values["roots"]; ok && len(v) > 0 {
+		if err := json.Unmarshal([]byte(v[0]), &roots); err != nil {
+			return repository.Metadata{}, fmt.Errorf("error: corrupted metadata: %w", err)
+		}
+	}
+
 	return repository.Metadata{
-		ID:      gameID,
-		Version: version,
-		Name:    name,
-		Date:    date,
+		ID:       gameID,
+		Version:  version,
+		Name:     name,
+		Date:     date,
+		Parent:   parent,
+		Device:   device,
+		Label:    label,
+		Conflict: isConflict,
+		Paths:    paths,
+		Roots:    roots,
 	}, nil
 }
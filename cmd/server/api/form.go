@@ -0,0 +1,142 @@
+package api
+
+import (
+	"cloudsave/pkg/tools/archive"
+	"errors"
+	"fmt"
+	"io"
+	"mime/multipart"
+	"net/http"
+	"os"
+)
+
+type (
+	// form reads a multipart upload as a stream: the payload is handed out
+	// as it arrives, the values are read before and after it
+	form struct {
+		mr     *multipart.Reader
+		values map[string][]string
+	}
+
+	// body marks the errors of the request body, to tell them from the
+	// errors of the disk
+	body struct {
+		r io.Reader
+	}
+)
+
+// maxValueSize is the maximum size of a value of the form
+const maxValueSize int64 = 1 << 20
+
+var (
+	errBadForm    error = errors.New("bad payload")
+	errNoPayload  error = errors.New("payload not found")
+	errNoMetadata error = errors.New("metadata not found")
+)
+
+func newForm(r *http.Request) (*form, error) {
+	mr, err := r.MultipartReader()
+	if err != nil {
+		return nil, err
+	}
+
+	return &form{
+		mr:     mr,
+		values: make(map[string][]string),
+	}, nil
+}
+
+// payload returns the content of the payload file, the values before it
+// are kept
+func (f *form) payload() (io.Reader, error) {
+	for {
+		p, err := f.mr.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return nil, errNoPayload
+			}
+			return nil, fmt.Errorf("%w: %w", errBadForm, err)
+		}
+
+		if p.FormName() == "payload" && len(p.FileName()) > 0 {
+			return body{p}, nil
+		}
+
+		if err := f.value(p); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// rest returns the values of the form, once the parts after the payload
+// are read
+func (f *form) rest() (map[string][]string, error) {
+	for {
+		p, err := f.mr.NextPart()
+		if err != nil {
+			if errors.Is(err, io.EOF) {
+				return f.values, nil
+			}
+			return nil, fmt.Errorf("%w: %w", errBadForm, err)
+		}
+
+		if err := f.value(p); err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (f *form) value(p *multipart.Part) error {
+	defer p.Close()
+
+	v, err := io.ReadAll(io.LimitReader(p, maxValueSize+1))
+	if err != nil {
+		return fmt.Errorf("%w: %w", errBadForm, err)
+	}
+	if int64(len(v)) > maxValueSize {
+		return fmt.Errorf("%w: the value %q is too large", errBadForm, p.FormName())
+	}
+
+	f.values[p.FormName()] = append(f.values[p.FormName()], string(v))
+	return nil
+}
+
+func (b body) Read(p []byte) (int, error) {
+	n, err := b.r.Read(p)
+	if err != nil && !errors.Is(err, io.EOF) {
+		err = fmt.Errorf("%w: %w", errBadForm, err)
+	}
+	return n, err
+}
+
+// formError responds to the errors of the form, it returns false if err
+// does not come from the request
+func formError(err error, w http.ResponseWriter, r *http.Request) bool {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.As(err, &maxErr):
+		fmt.Fprintln(os.Stderr, "error: the upload is larger than", maxErr.Limit, "bytes")
+		tooLarge(maxErr.Limit, w, r)
+	case errors.Is(err, errNoPayload):
+		fmt.Fprintln(os.Stderr, "error: cannot find payload in the form:", err)
+		badRequest("payload not found", w, r)
+	case errors.Is(err, errNoMetadata):
+		fmt.Fprintln(os.Stderr, "error: cannot find metadata in the form:", err)
+		badRequest("metadata not found", w, r)
+	case errors.Is(err, errNoDigest):
+		fmt.Fprintln(os.Stderr, "error: the upload has no digest")
+		badRequest("a Repr-Digest header with the digest of the archive is required", w, r)
+	case errors.Is(err, errDigest):
+		fmt.Fprintln(os.Stderr, "error: upload rejected:", err)
+		unprocessable(errDigest.Error(), w, r)
+	case errors.Is(err, archive.ErrInvalid):
+		fmt.Fprintln(os.Stderr, "error: upload rejected:", err)
+		unprocessable(archive.ErrInvalid.Error(), w, r)
+	case errors.Is(err, errBadForm):
+		fmt.Fprintln(os.Stderr, "error: failed to load payload:", err)
+		badRequest("bad payload", w, r)
+	default:
+		return false
+	}
+	return true
+}
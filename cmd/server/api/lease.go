@@ -0,0 +1,127 @@
+package api
+
+import (
+	"cloudsave/pkg/data"
+	"cloudsave/pkg/remote/obj"
+	"cloudsave/pkg/repository"
+	"cmp"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"time"
+
+	"github.com/go-chi/chi/v5"
+)
+
+const (
+	defaultLeaseTTL = 15 * time.Minute
+	minLeaseTTL     = time.Minute
+	maxLeaseTTL     = 24 * time.Hour
+)
+
+func (s HTTPServer) lease(w http.ResponseWriter, r *http.Request) {
+	gameID := chi.URLParam(r, "id")
+
+	lease, err := s.Service.Lease(gameID)
+	if err != nil {
+		s.leaseError(err, w, r)
+		return
+	}
+	if lease == nil {
+		notFound("no lease", w, r)
+		return
+	}
+
+	ok(lease, w, r)
+}
+
+func (s HTTPServer) acquire(w http.ResponseWriter, r *http.Request) {
+	gameID := chi.URLParam(r, "id")
+
+	req, err := parseLeaseRequest(w, r)
+	if err != nil {
+		badRequest(err.Error(), w, r)
+		return
+	}
+
+	lease, err := s.Service.Acquire(gameID, req.DeviceID, cmp.Or(req.Device, req.DeviceID), leaseTTL(req.TTL), req.Steal)
+	if err != nil {
+		s.leaseError(err, w, r)
+		return
+	}
+
+	ok(lease, w, r)
+}
+
+func (s HTTPServer) renew(w http.ResponseWriter, r *http.Request) {
+	gameID := chi.URLParam(r, "id")
+
+	req, err := parseLeaseRequest(w, r)
+	if err != nil {
+		badRequest(err.Error(), w, r)
+		return
+	}
+
+	lease, err := s.Service.Renew(gameID, req.DeviceID, leaseTTL(req.TTL))
+	if err != nil {
+		s.leaseError(err, w, r)
+		return
+	}
+
+	ok(lease, w, r)
+}
+
+func (s HTTPServer) release(w http.ResponseWriter, r *http.Request) {
+	gameID := chi.URLParam(r, "id")
+
+	deviceID := r.URL.Query().Get("device_id")
+	if len(deviceID) == 0 {
+		badRequest("device_id is required", w, r)
+		return
+	}
+
+	if err := s.Service.Release(gameID, deviceID, r.URL.Query().Get("force") == "true"); err != nil {
+		s.leaseError(err, w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// leaseError responds with the lease of the other device when the game
+// is locked
+func (s HTTPServer) leaseError(err error, w http.ResponseWriter, r *http.Request) {
+	var lerr *data.LeaseError
+	if errors.As(err, &lerr) {
+		conflict(lerr.Lease, w, r)
+		return
+	}
+	if errors.Is(err, repository.ErrNotFound) {
+		notFound("not found", w, r)
+		return
+	}
+	fmt.Fprintln(os.Stderr, "error: failed to update the lease:", err)
+	internalServerError(w, r)
+}
+
+func parseLeaseRequest(w http.ResponseWriter, r *http.Request) (obj.LeaseRequest, error) {
+	var req obj.LeaseRequest
+	d := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10))
+	if err := d.Decode(&req); err != nil {
+		return obj.LeaseRequest{}, errors.New("bad payload")
+	}
+	if len(req.DeviceID) == 0 {
+		return obj.LeaseRequest{}, errors.New("device_id is required")
+	}
+	return req, nil
+}
+
+// leaseTTL returns the duration of a lease from the requested seconds
+func leaseTTL(seconds int64) time.Duration {
+	if seconds <= 0 {
+		return defaultLeaseTTL
+	}
+	return min(max(time.Duration(seconds)*time.Second, minLeaseTTL), maxLeaseTTL)
+}
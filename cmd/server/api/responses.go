@@ -3,6 +3,7 @@ package api
 import (
 	"cloudsave/pkg/remote/obj"
 	"encoding/json"
+	"fmt"
 	"log/slog"
 	"net/http"
 	"time"
@@ -119,3 +120,59 @@ func badRequest(message string, w http.ResponseWriter, r *http.Request) {
 		slog.Error(err.Error())
 	}
 }
+
+// unprocessable responds that the content of the request cannot be accepted
+func unprocessable(message string, w http.ResponseWriter, r *http.Request) {
+	payload := obj.HTTPError{
+		HTTPCore: obj.HTTPCore{
+			Status:    http.StatusUnprocessableEntity,
+			Path:      r.RequestURI,
+			Timestamp: time.Now(),
+		},
+		Error:   "Unprocessable Entity",
+		Message: message,
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusUnprocessableEntity)
+	e := json.NewEncoder(w)
+	if err := e.Encode(payload); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+func conflict(o interface{}, w http.ResponseWriter, r *http.Request) {
+	payload := obj.HTTPObject{
+		HTTPCore: obj.HTTPCore{
+			Status:    http.StatusConflict,
+			Path:      r.RequestURI,
+			Timestamp: time.Now(),
+		},
+		Data: o,
+	}
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusConflict)
+	e := json.NewEncoder(w)
+	if err := e.Encode(payload); err != nil {
+		slog.Error(err.Error())
+	}
+}
+
+func tooLarge(limit int64, w http.ResponseWriter, r *http.Request) {
+	payload := obj.HTTPError{
+		HTTPCore: obj.HTTPCore{
+			Status:    http.StatusRequestEntityTooLarge,
+			Path:      r.RequestURI,
+			Timestamp: time.Now(),
+		},
+		Error:   "Request Entity Too Large",
+		Message: fmt.Sprintf("The uploads are limited to %d bytes by the server.", limit),
+	}
+
+	w.Header().Add("Content-Type", "application/json")
+	w.WriteHeader(http.StatusRequestEntityTooLarge)
+	e := json.NewEncoder(w)
+	if err := e.Encode(payload); err != nil {
+		slog.Error(err.Error())
+	}
+}
@@ -0,0 +1,258 @@
+package api
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// sessions keeps the chunked uploads until they are committed. Each
+	// session is a directory with the description of the upload and the
+	// data received so far.
+	sessions struct {
+		dir string
+		// a session is removed when it is not written for ttl
+		ttl time.Duration
+		// one mutex per session, held while it is written
+		locks sync.Map
+	}
+
+	session struct {
+		ID      string    `json:"id"`
+		GameID  string    `json:"game_id"`
+		Size    int64     `json:"size"`
+		Offset  int64     `json:"offset"`
+		Created time.Time `json:"created"`
+		Expires time.Time `json:"expires"`
+	}
+)
+
+var (
+	errNoSession  error = errors.New("upload session not found")
+	errOffset     error = errors.New("the offset is not the one of the session")
+	errOverflow   error = errors.New("the data are larger than the size of the session")
+	errIncomplete error = errors.New("the upload is not complete")
+)
+
+func newSessions(dir string, ttl time.Duration) *sessions {
+	return &sessions{dir: dir, ttl: ttl}
+}
+
+func (s *sessions) lock(id string) func() {
+	v, _ := s.locks.LoadOrStore(id, new(sync.Mutex))
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
+// create starts the upload of size bytes for the game
+func (s *sessions) create(gameID string, size int64) (session, error) {
+	now := time.Now()
+	ss := session{
+		ID:      uuid.NewString(),
+		GameID:  gameID,
+		Size:    size,
+		Created: now,
+		Expires: now.Add(s.ttl),
+	}
+
+	if err := os.MkdirAll(filepath.Join(s.dir, ss.ID), 0740); err != nil {
+		return session{}, fmt.Errorf("failed to make the session directory: %w", err)
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dir, ss.ID, "session.json"), os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0740)
+	if err != nil {
+		return session{}, fmt.Errorf("failed to open the session: %w", err)
+	}
+	defer f.Close()
+
+	e := json.NewEncoder(f)
+	if err := e.Encode(ss); err != nil {
+		return session{}, fmt.Errorf("failed to encode the session: %w", err)
+	}
+
+	if err := os.WriteFile(s.data(ss.ID), nil, 0740); err != nil {
+		return session{}, fmt.Errorf("failed to make the session data: %w", err)
+	}
+
+	return ss, nil
+}
+
+// get returns the session of the game, with the number of bytes received
+func (s *sessions) get(gameID, id string) (session, error) {
+	if _, err := uuid.Parse(id); err != nil {
+		return session{}, errNoSession
+	}
+
+	f, err := os.OpenFile(filepath.Join(s.dir, id, "session.json"), os.O_RDONLY, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return session{}, errNoSession
+		}
+		return session{}, fmt.Errorf("failed to open the session: %w", err)
+	}
+	defer f.Close()
+
+	var ss session
+	d := json.NewDecoder(f)
+	if err := d.Decode(&ss); err != nil {
+		return session{}, fmt.Errorf("failed to parse the session: %w", err)
+	}
+	if ss.GameID != gameID {
+		return session{}, errNoSession
+	}
+
+	fi, err := os.Stat(s.data(id))
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return session{}, errNoSession
+		}
+		return session{}, fmt.Errorf("failed to read the session data: %w", err)
+	}
+	ss.Offset = fi.Size()
+	ss.Expires = fi.ModTime().Add(s.ttl)
+
+	return ss, nil
+}
+
+// write appends src to the session, offset must be the number of bytes
+// already received. The bytes received before an error are kept so that
+// the upload can resume from there.
+func (s *sessions) write(gameID, id string, offset int64, src io.Reader) (session, error) {
+	unlock := s.lock(id)
+	defer unlock()
+
+	ss, err := s.get(gameID, id)
+	if err != nil {
+		return session{}, err
+	}
+	if offset != ss.Offset {
+		return ss, errOffset
+	}
+
+	f, err := os.OpenFile(s.data(id), os.O_WRONLY|os.O_APPEND, 0)
+	if err != nil {
+		return session{}, fmt.Errorf("failed to open the session data: %w", err)
+	}
+	defer f.Close()
+
+	n, err := io.Copy(f, io.LimitReader(src, ss.Size-ss.Offset+1))
+	ss.Offset += n
+	if ss.Offset > ss.Size {
+		if err := f.Truncate(offset); err != nil {
+			return session{}, fmt.Errorf("failed to truncate the session data: %w", err)
+		}
+		return session{}, errOverflow
+	}
+	if err != nil {
+		return ss, err
+	}
+
+	if err := f.Close(); err != nil {
+		return session{}, fmt.Errorf("failed to write the session data: %w", err)
+	}
+
+	ss.Expires = time.Now().Add(s.ttl)
+	return ss, nil
+}
+
+// open returns the data of a complete session, to be committed
+func (s *sessions) open(gameID, id string) (*os.File, error) {
+	ss, err := s.get(gameID, id)
+	if err != nil {
+		return nil, err
+	}
+	if ss.Offset != ss.Size {
+		return nil, errIncomplete
+	}
+
+	f, err := os.OpenFile(s.data(id), os.O_RDONLY, 0)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open the session data: %w", err)
+	}
+	return f, nil
+}
+
+// remove drops the session of the game
+func (s *sessions) remove(gameID, id string) error {
+	unlock := s.lock(id)
+	defer unlock()
+
+	if _, err := s.get(gameID, id); err != nil {
+		return err
+	}
+
+	return s.drop(id)
+}
+
+func (s *sessions) drop(id string) error {
+	defer s.locks.Delete(id)
+
+	if err := os.RemoveAll(filepath.Join(s.dir, id)); err != nil {
+		return fmt.Errorf("failed to remove the session: %w", err)
+	}
+	return nil
+}
+
+// clean removes the sessions that were not written for ttl
+func (s *sessions) clean() {
+	entries, err := os.ReadDir(s.dir)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return
+		}
+		slog.Error("failed to list the upload sessions", "err", err)
+		return
+	}
+
+	for _, e := range entries {
+		if _, err := uuid.Parse(e.Name()); err != nil || !e.IsDir() {
+			continue
+		}
+
+		// the session directory is used when the data are missing
+		fi, err := os.Stat(s.data(e.Name()))
+		if err != nil {
+			fi, err = e.Info()
+			if err != nil {
+				continue
+			}
+		}
+		if time.Since(fi.ModTime()) < s.ttl {
+			continue
+		}
+
+		unlock := s.lock(e.Name())
+		if err := s.drop(e.Name()); err != nil {
+			slog.Error("failed to remove an abandoned upload", "id", e.Name(), "err", err)
+		} else {
+			slog.Info("abandoned upload removed", "id", e.Name())
+		}
+		unlock()
+	}
+}
+
+// cleanEvery removes the abandoned sessions at each interval
+func (s *sessions) cleanEvery(interval time.Duration) {
+	s.clean()
+
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		s.clean()
+	}
+}
+
+func (s *sessions) data(id string) string {
+	return filepath.Join(s.dir, id, "data")
+}
@@ -0,0 +1,212 @@
+package api
+
+import (
+	"cloudsave/pkg/data"
+	"cloudsave/pkg/remote/obj"
+	"cloudsave/pkg/repository"
+	"cloudsave/pkg/tools/archive"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"os"
+	"strconv"
+
+	"github.com/go-chi/chi/v5"
+	"github.com/google/uuid"
+)
+
+const (
+	// maxChunkSize is the maximum size of a chunk of an upload session
+	maxChunkSize int64 = 64 << 20
+)
+
+func (s HTTPServer) createUpload(w http.ResponseWriter, r *http.Request) {
+	gameID := chi.URLParam(r, "id")
+
+	var req obj.UploadRequest
+	d := json.NewDecoder(http.MaxBytesReader(w, r.Body, 1<<10))
+	if err := d.Decode(&req); err != nil || req.Size <= 0 {
+		badRequest("the size of the upload is required", w, r)
+		return
+	}
+	if s.maxUploadSize > 0 && req.Size > s.maxUploadSize {
+		tooLarge(s.maxUploadSize, w, r)
+		return
+	}
+
+	ss, err := s.uploads.create(gameID, req.Size)
+	if err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to start an upload:", err)
+		internalServerError(w, r)
+		return
+	}
+
+	ok(ss, w, r)
+}
+
+func (s HTTPServer) uploadStatus(w http.ResponseWriter, r *http.Request) {
+	gameID := chi.URLParam(r, "id")
+	sessionID := chi.URLParam(r, "session")
+
+	ss, err := s.uploads.get(gameID, sessionID)
+	if err != nil {
+		s.sessionError(err, ss, w, r)
+		return
+	}
+
+	ok(ss, w, r)
+}
+
+func (s HTTPServer) uploadChunk(w http.ResponseWriter, r *http.Request) {
+	gameID := chi.URLParam(r, "id")
+	sessionID := chi.URLParam(r, "session")
+
+	offset, err := strconv.ParseInt(r.URL.Query().Get("offset"), 10, 64)
+	if err != nil || offset < 0 {
+		badRequest("a valid offset is required", w, r)
+		return
+	}
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxChunkSize)
+
+	ss, err := s.uploads.write(gameID, sessionID, offset, r.Body)
+	if err != nil {
+		s.sessionError(err, ss, w, r)
+		return
+	}
+
+	ok(ss, w, r)
+}
+
+func (s HTTPServer) abortUpload(w http.ResponseWriter, r *http.Request) {
+	gameID := chi.URLParam(r, "id")
+	sessionID := chi.URLParam(r, "session")
+
+	if err := s.uploads.remove(gameID, sessionID); err != nil {
+		s.sessionError(err, session{}, w, r)
+		return
+	}
+
+	w.WriteHeader(http.StatusNoContent)
+}
+
+// commitUpload makes the data of a complete session the current archive of
+// the game, or one of its backups. The body is a form with the metadata, the
+// digest of the data is in the Repr-Digest header.
+func (s HTTPServer) commitUpload(w http.ResponseWriter, r *http.Request) {
+	gameID := chi.URLParam(r, "id")
+	sessionID := chi.URLParam(r, "session")
+
+	r.Body = http.MaxBytesReader(w, r.Body, maxValueSize)
+	if err := r.ParseForm(); err != nil {
+		badRequest("bad payload", w, r)
+		return
+	}
+
+	backupID := r.PostForm.Get("backup")
+	if _, err := uuid.Parse(backupID); len(backupID) > 0 && err != nil {
+		badRequest("invalid backup id", w, r)
+		return
+	}
+
+	unlock := s.uploads.lock(sessionID)
+	defer unlock()
+
+	f, err := s.uploads.open(gameID, sessionID)
+	if err != nil {
+		s.sessionError(err, session{}, w, r)
+		return
+	}
+	defer f.Close()
+
+	v, err := newVerifier(f, r)
+	if err != nil {
+		formError(err, w, r)
+		return
+	}
+	defer v.verify()
+
+	if len(backupID) > 0 {
+		err = s.Service.CopyBackup(gameID, backupID, v, func() (*repository.Metadata, error) {
+			if err := v.verify(); err != nil {
+				return nil, err
+			}
+			// the metadata are optional, old clients do not send the metadata of the backup
+			m, err := parseFormMetadata(gameID, r.PostForm)
+			if err != nil {
+				return nil, nil
+			}
+			return &m, nil
+		})
+	} else {
+		err = s.Service.Upload(gameID, parseETag(r.Header.Get("If-Match")), v, func() (repository.Metadata, error) {
+			if err := v.verify(); err != nil {
+				return repository.Metadata{}, err
+			}
+			m, err := parseFormMetadata(gameID, r.PostForm)
+			if err != nil {
+				return repository.Metadata{}, fmt.Errorf("%w: %w", errNoMetadata, err)
+			}
+			return m, nil
+		})
+	}
+	if err != nil {
+		if errors.Is(err, data.ErrConflict) {
+			s.dropSession(sessionID)
+			s.conflict(gameID, w, r)
+			return
+		}
+		// the data must be uploaded again
+		if errors.Is(err, errDigest) || errors.Is(err, archive.ErrInvalid) {
+			s.dropSession(sessionID)
+		}
+		if formError(err, w, r) {
+			return
+		}
+		fmt.Fprintln(os.Stderr, "error: failed to write data to disk:", err)
+		internalServerError(w, r)
+		return
+	}
+	s.dropSession(sessionID)
+
+	if err := s.Service.ReloadCache(gameID); err != nil {
+		fmt.Fprintln(os.Stderr, "error: failed to reload data from the disk:", err)
+		internalServerError(w, r)
+		return
+	}
+
+	if len(backupID) == 0 {
+		s.prune(gameID)
+	}
+
+	// Respond success
+	w.WriteHeader(http.StatusCreated)
+}
+
+// dropSession removes a session that cannot be committed anymore, errors
+// are only logged: the session is removed once abandoned
+func (s HTTPServer) dropSession(id string) {
+	if err := s.uploads.drop(id); err != nil {
+		fmt.Fprintln(os.Stderr, "error:", err)
+	}
+}
+
+// sessionError responds to the errors of the upload sessions, the session
+// is sent back when the offset is not the expected one
+func (s HTTPServer) sessionError(err error, ss session, w http.ResponseWriter, r *http.Request) {
+	var maxErr *http.MaxBytesError
+	switch {
+	case errors.Is(err, errNoSession):
+		notFound("upload session not found", w, r)
+	case errors.Is(err, errOffset):
+		conflict(ss, w, r)
+	case errors.Is(err, errOverflow), errors.Is(err, errIncomplete):
+		badRequest(err.Error(), w, r)
+	case errors.As(err, &maxErr):
+		tooLarge(maxErr.Limit, w, r)
+	default:
+		fmt.Fprintln(os.Stderr, "error: failed to write the upload:", err)
+		internalServerError(w, r)
+	}
+}
@@ -0,0 +1,121 @@
+package api
+
+import (
+	"cloudsave/pkg/tools/archive"
+	"cloudsave/pkg/tools/hash"
+	"crypto"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+type (
+	// verifier checks an archive as it is read: it must match the digest
+	// sent by the client and it must be a valid gzip/tar stream
+	verifier struct {
+		r         io.Reader
+		h         *hash.Hasher
+		validator *archive.Validator
+		digest    func() (string, bool)
+		done      bool
+		err       error
+	}
+)
+
+const (
+	digestHeader = "Repr-Digest"
+	// versionHeader holds the API version of the client, the clients that
+	// do not send it are older than digestAPIVersion
+	versionHeader = "Api-Version"
+	// digestAPIVersion is the first API version whose clients send the
+	// digest of their archives
+	digestAPIVersion = 2
+)
+
+var (
+	errNoDigest error = errors.New("the digest of the archive is required")
+	errDigest   error = errors.New("the archive does not match its digest")
+)
+
+// newVerifier reads src, the digest is taken from the headers of the
+// request or, when it is announced there, from its trailers. The strongest
+// digest is checked when there are several. The archives of the clients
+// older than digestAPIVersion are accepted without a digest, it is then
+// computed as they are read.
+func newVerifier(src io.Reader, r *http.Request) (*verifier, error) {
+	v := &verifier{validator: archive.NewValidator()}
+
+	if digests := hash.ParseReprDigest(r.Header.Get(digestHeader)); len(digests) > 0 {
+		alg, _, _ := hash.ParseDigest(digests[0])
+		v.h = hash.NewHasher(alg)
+		v.digest = func() (string, bool) { return digests[0], true }
+	} else if _, ok := r.Trailer[digestHeader]; ok {
+		// the algorithm is only known once the body has been read to the
+		// end, when the trailers are set
+		v.h = hash.NewHasher(hash.Algorithms()...)
+		v.digest = func() (string, bool) {
+			if _, err := io.Copy(io.Discard, r.Body); err != nil {
+				return "", false
+			}
+			digests := hash.ParseReprDigest(r.Trailer.Get(digestHeader))
+			if len(digests) == 0 {
+				return "", false
+			}
+			return digests[0], true
+		}
+	} else if sum := r.PostForm.Get("md5"); len(sum) > 0 {
+		// the upload sessions of the older clients send the md5 hash in the form
+		v.h = hash.NewHasher(crypto.MD5)
+		v.digest = func() (string, bool) { return hash.Digest(crypto.MD5, strings.ToLower(sum)), true }
+	} else if clientVersion(r) < digestAPIVersion {
+		v.h = hash.NewHasher(hash.Default)
+		v.digest = func() (string, bool) { return v.h.Digest(hash.Default), true }
+	} else {
+		v.validator.Close()
+		return nil, errNoDigest
+	}
+
+	v.r = io.TeeReader(src, io.MultiWriter(v.h, v.validator))
+	return v, nil
+}
+
+// clientVersion returns the API version sent by the client, 1 when there is none
+func clientVersion(r *http.Request) int {
+	version, err := strconv.Atoi(r.Header.Get(versionHeader))
+	if err != nil || version < 1 {
+		return 1
+	}
+	return version
+}
+
+func (v *verifier) Read(p []byte) (int, error) {
+	return v.r.Read(p)
+}
+
+// verify ends the checks once the archive has been read, it must be
+// called even if the archive is not read to the end
+func (v *verifier) verify() error {
+	if v.done {
+		return v.err
+	}
+	v.done = true
+
+	if err := v.validator.Close(); err != nil {
+		v.err = err
+		return v.err
+	}
+
+	expected, ok := v.digest()
+	if !ok {
+		v.err = errNoDigest
+		return v.err
+	}
+	alg, _, _ := hash.ParseDigest(expected)
+	if actual := v.h.Digest(alg); actual != expected {
+		v.err = fmt.Errorf("%w: got %s, expected %s", errDigest, actual, expected)
+	}
+	return v.err
+}
@@ -6,6 +6,7 @@ import (
 	"cloudsave/pkg/constants"
 	"cloudsave/pkg/data"
 	"cloudsave/pkg/repository"
+	"cloudsave/pkg/retention"
 	"flag"
 	"fmt"
 	"log/slog"
@@ -17,13 +18,18 @@ import (
 func run() {
 	fmt.Printf("CloudSave server -- v%s.%s.%s\n\n", constants.Version, runtime.GOOS, runtime.GOARCH)
 
-	var documentRoot string
+	var documentRoot, store string
 	var port int
-	var noCache, verbose bool
+	var maxUploadSize int64
+	var noCache, verbose, prune, dryRun bool
 	flag.StringVar(&documentRoot, "document-root", defaultDocumentRoot, "Define the path to the document root")
 	flag.IntVar(&port, "port", 8080, "Define the port of the server")
+	flag.Int64Var(&maxUploadSize, "max-upload-size", 500, "Define the maximum size of an uploaded archive in MB, 0 for no limit")
+	flag.StringVar(&store, "store", "directory", "Define how the archives are stored: directory or chunk (deduplicated)")
 	flag.BoolVar(&noCache, "no-cache", false, "Disable the cache")
 	flag.BoolVar(&verbose, "verbose", false, "Show more logs")
+	flag.BoolVar(&prune, "prune", false, "Apply the retention policy on every game and exit")
+	flag.BoolVar(&dryRun, "dry-run", false, "With -prune, only list the backups that would be removed")
 	flag.Parse()
 
 	if verbose {
@@ -38,31 +44,97 @@ func run() {
 	slog.Info("users loaded: " + strconv.Itoa(len(h.Content())) + " user(s) loaded")
 
 	var repo repository.Repository
-	if !noCache {
-		slog.Info("loading eager repository...")
-		r, err := repository.NewEagerRepository(filepath.Join(documentRoot, "data"))
+	switch store {
+	case "directory":
+		r, err := repository.NewLazyRepository(filepath.Join(documentRoot, "data"))
 		if err != nil {
 			fatal("failed to load datastore: "+err.Error(), 1)
 		}
-		if err := r.Preload(); err != nil {
-			fatal("failed to load datastore: "+err.Error(), 1)
+		if err := r.Recover(); err != nil {
+			fatal("failed to recover datastore: "+err.Error(), 1)
 		}
 		repo = r
-	} else {
-		slog.Info("loading lazy repository...")
-		repo, err = repository.NewLazyRepository(filepath.Join(documentRoot, "data"))
+	case "chunk":
+		r, err := repository.NewChunkRepository(filepath.Join(documentRoot, "data"), filepath.Join(documentRoot, "chunks"))
 		if err != nil {
 			fatal("failed to load datastore: "+err.Error(), 1)
 		}
+		if err := r.Recover(); err != nil {
+			fatal("failed to recover datastore: "+err.Error(), 1)
+		}
+		slog.Info("migrating archives to the chunk store...")
+		if err := r.Migrate(); err != nil {
+			fatal("failed to migrate datastore: "+err.Error(), 1)
+		}
+		repo = r
+	default:
+		fatal("unknown store: "+store, 1)
+	}
+
+	if !noCache {
+		slog.Info("loading eager repository...")
+		r := repository.NewEagerRepositoryWith(repo)
+		if err := r.Preload(); err != nil {
+			fatal("failed to load datastore: "+err.Error(), 1)
+		}
+		repo = r
+	} else {
+		slog.Info("cache disabled")
 	}
 
 	slog.Info("repository loaded")
 	s := data.NewService(repo)
 
-	server := api.NewServer(documentRoot, s, h.Content(), port)
+	if prune {
+		if err := pruneAll(s, filepath.Join(documentRoot, "retention.json"), dryRun); err != nil {
+			fatal("failed to prune: "+err.Error(), 1)
+		}
+		return
+	}
+
+	if maxUploadSize < 0 {
+		fatal("the maximum upload size cannot be negative", 1)
+	}
+
+	server := api.NewServer(documentRoot, s, h.Content(), port, maxUploadSize<<20)
 
 	fmt.Println("server started at :" + strconv.Itoa(port))
 	if err := server.Server.ListenAndServe(); err != nil {
 		fatal("failed to start server: "+err.Error(), 1)
 	}
 }
+
+func pruneAll(s *data.Service, policyPath string, dryRun bool) error {
+	global, err := retention.Load(policyPath)
+	if err != nil {
+		return err
+	}
+
+	games, err := s.AllGames()
+	if err != nil {
+		return err
+	}
+
+	verb := "removed"
+	if dryRun {
+		verb = "would remove"
+	}
+
+	for _, g := range games {
+		removed, err := s.Prune(g.ID, global, dryRun)
+		if err != nil {
+			return fmt.Errorf("[%s] %w", g.ID, err)
+		}
+		for _, b := range removed {
+			fmt.Printf("%s (%s): %s %s (%s, %d bytes)\n", g.Name, g.ID, verb, b.UUID, b.CreatedAt, b.Size)
+		}
+	}
+
+	if !dryRun {
+		if _, err := s.CollectGarbage(); err != nil {
+			return fmt.Errorf("failed to remove unreferenced data: %w", err)
+		}
+	}
+
+	return nil
+}
@@ -3,6 +3,7 @@ module cloudsave
 go 1.24
 
 require (
+	github.com/fsnotify/fsnotify v1.9.0
 	github.com/go-chi/chi/v5 v5.2.1
 	github.com/google/subcommands v1.2.0
 	github.com/google/uuid v1.6.0
@@ -2,4 +2,4 @@ package constants
 
 const Version = "0.0.4c"
 
-const ApiVersion = 1
+const ApiVersion = 2
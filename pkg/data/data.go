@@ -3,29 +3,89 @@ package data
 import (
 	"cloudsave/pkg/remote/client"
 	"cloudsave/pkg/repository"
+	"cloudsave/pkg/retention"
 	"cloudsave/pkg/tools/archive"
+	"cloudsave/pkg/tools/filter"
+	"cloudsave/pkg/tools/hash"
+	"cloudsave/pkg/tools/manifest"
 	"errors"
 	"fmt"
 	"io"
 	"os"
 	"path/filepath"
+	"slices"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
 type (
+	// Changes lists the files that differ from an archive to a directory
+	Changes struct {
+		Added   []string
+		Changed []string
+		Deleted []string
+	}
+
 	Service struct {
 		repo repository.Repository
+		// one mutex per game, held while the archive of the game is replaced
+		locks *sync.Map
+		// name of the device recorded in the archives made by Scan
+		device string
+		// identifier of the device, the save directories are set per device
+		deviceID string
+		// restrictions applied when an archive is extracted
+		extract archive.Options
 	}
 )
 
+var (
+	// ErrConflict is returned when the current archive is not the expected one
+	ErrConflict error = errors.New("the archive has been modified")
+	// ErrCorrupted is returned when a downloaded archive does not match its hash
+	ErrCorrupted error = errors.New("the downloaded archive does not match the expected hash")
+)
+
 func NewService(repo repository.Repository) *Service {
 	return &Service{
-		repo: repo,
+		repo:    repo,
+		locks:   new(sync.Map),
+		extract: archive.DefaultOptions,
 	}
 }
 
+// SetDevice sets the device the service runs on, its name is recorded
+// in the new archives
+func (s *Service) SetDevice(id, name string) {
+	s.deviceID = id
+	s.device = name
+}
+
+// Device returns the ID and the name of the device the service runs on
+func (s *Service) Device() (string, string) {
+	return s.deviceID, s.device
+}
+
+// SetExtractOptions sets the restrictions applied when an archive is extracted
+func (s *Service) SetExtractOptions(opts archive.Options) {
+	s.extract = opts
+}
+
+// ExtractOptions returns the restrictions applied when an archive is extracted
+func (s *Service) ExtractOptions() archive.Options {
+	return s.extract
+}
+
+func (l Service) lock(gameID string) func() {
+	v, _ := l.locks.LoadOrStore(gameID, new(sync.Mutex))
+	mu := v.(*sync.Mutex)
+	mu.Lock()
+	return mu.Unlock
+}
+
 func (s *Service) Add(name, path, remote string) (string, error) {
 	gameID := repository.NewGameIdentifier(uuid.NewString())
 
@@ -36,10 +96,10 @@ func (s *Service) Add(name, path, remote string) (string, error) {
 	m := repository.Metadata{
 		ID:      gameID.Key(),
 		Name:    name,
-		Path:    path,
 		Version: 0,
 		Date:    time.Now(),
 	}
+	s.SetPath(&m, path)
 
 	if err := s.repo.WriteMetadata(gameID, m); err != nil {
 		return "", fmt.Errorf("failed to add game reference: %w", err)
@@ -61,11 +121,6 @@ func (s *Service) One(gameID string) (repository.Metadata, error) {
 
 func (s *Service) Backup(gameID, backupID string) (repository.Backup, error) {
 	id := repository.NewBackupIdentifier(gameID, backupID)
-
-	if err := s.repo.Mkdir(id); err != nil {
-		return repository.Backup{}, fmt.Errorf("failed to make game dir: %w", err)
-	}
-
 	return s.repo.Backup(id)
 }
 
@@ -83,20 +138,90 @@ func (s *Service) UpdateMetadata(gameID string, m repository.Metadata) error {
 	return nil
 }
 
-func (s *Service) Scan(gameID string) (bool, error) {
+// SetFilters replaces the include and exclude patterns of a game
+func (s *Service) SetFilters(gameID string, include, exclude []string) error {
+	if _, err := filter.New(include, exclude); err != nil {
+		return err
+	}
+
+	id := repository.NewGameIdentifier(gameID)
+
+	m, err := s.repo.Metadata(id)
+	if err != nil {
+		return fmt.Errorf("failed to get metadata: %w", err)
+	}
+
+	m.Include = include
+	m.Exclude = exclude
+
+	if err := s.repo.WriteMetadata(id, m); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+	return nil
+}
+
+// SetRoots replaces the roots of a game other than the main one,
+// the paths of the roots are the ones of this device
+func (s *Service) SetRoots(gameID string, roots []repository.Root) error {
 	id := repository.NewGameIdentifier(gameID)
 
-	lastRun, err := s.repo.LastScan(id)
+	m, err := s.repo.Metadata(id)
+	if err != nil {
+		return fmt.Errorf("failed to get metadata: %w", err)
+	}
+
+	path, err := s.Location(m)
 	if err != nil {
-		return false, fmt.Errorf("failed to get last scan time: %w", err)
+		return err
+	}
+
+	if err := CheckRoots(path, roots); err != nil {
+		return err
+	}
+
+	m.Roots = nil
+	for _, r := range roots {
+		v := repository.Root{Name: r.Name}
+		s.SetRootPath(&v, r.Path)
+		m.Roots = append(m.Roots, v)
+	}
+
+	if err := s.repo.WriteMetadata(id, m); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
 	}
+	return nil
+}
+
+// Scan makes a new version of the save if the content of its files changed
+// since the last scan, true is returned if a version was made
+func (s *Service) Scan(gameID string) (bool, error) {
+	id := repository.NewGameIdentifier(gameID)
 
 	m, err := s.repo.Metadata(id)
 	if err != nil {
 		return false, fmt.Errorf("failed to get game metadata: %w", err)
 	}
 
-	if !IsDirectoryChanged(m.Path, lastRun) {
+	roots, err := s.roots(m)
+	if err != nil {
+		return false, err
+	}
+
+	// the save directory is not there (yet), there is nothing to archive
+	if _, err := os.Stat(roots[0].path); errors.Is(err, os.ErrNotExist) {
+		return false, nil
+	}
+
+	cur, same, err := s.compare(id, roots)
+	if err != nil {
+		return false, err
+	}
+
+	if same {
+		// keep the new mtimes so the files are not hashed again
+		if err := s.repo.WriteManifest(id, cur); err != nil {
+			return false, fmt.Errorf("failed to write manifest: %w", err)
+		}
 		return false, nil
 	}
 
@@ -104,301 +229,1208 @@ func (s *Service) Scan(gameID string) (bool, error) {
 		return false, fmt.Errorf("failed to make the backup: %w", err)
 	}
 
-	f, err := s.repo.WriteBlob(id)
+	tx, err := s.repo.Begin(id)
 	if err != nil {
-		return false, fmt.Errorf("failed to get datastore stream: %w", err)
+		return false, fmt.Errorf("failed to start transaction: %w", err)
 	}
-	if v, ok := f.(io.Closer); ok {
-		defer v.Close()
+	defer tx.Rollback()
+
+	f, err := tx.WriteBlob()
+	if err != nil {
+		return false, fmt.Errorf("failed to get datastore stream: %w", err)
 	}
+	defer f.Abort()
 
-	if err := archive.Tar(f, m.Path); err != nil {
+	if err := archive.TarSources(f, sources(roots)...); err != nil {
 		return false, fmt.Errorf("failed to make archive: %w", err)
 	}
 
-	if err := s.repo.ResetLastScan(id); err != nil {
-		return false, fmt.Errorf("failed to reset scan date: %w", err)
+	if err := f.Close(); err != nil {
+		return false, fmt.Errorf("failed to write archive: %w", err)
 	}
 
 	m.Date = time.Now()
 	m.Version += 1
+	m.Parent = m.MD5
+	m.Device = s.device
 
-	if err := s.repo.WriteMetadata(id, m); err != nil {
+	if err := tx.WriteMetadata(m); err != nil {
 		return false, fmt.Errorf("failed to update metadata: %w", err)
 	}
 
+	if err := tx.Commit(); err != nil {
+		return false, fmt.Errorf("failed to save the new version: %w", err)
+	}
+
+	if err := s.repo.WriteManifest(id, cur); err != nil {
+		return false, fmt.Errorf("failed to write manifest: %w", err)
+	}
+
 	return true, nil
 }
 
 func (s *Service) MakeBackup(gameID string) error {
+	_, err := s.makeBackup(gameID)
+	return err
+}
+
+// makeBackup copies the current archive and its metadata in a new backup,
+// an empty id is returned if there is no archive yet
+func (s *Service) makeBackup(gameID string) (string, error) {
 	var id repository.Identifier = repository.NewGameIdentifier(gameID)
 
+	m, err := s.repo.Metadata(repository.NewGameIdentifier(gameID))
+	if err != nil {
+		return "", err
+	}
+
 	src, err := s.repo.ReadBlob(id)
 	if err != nil {
 		if errors.Is(err, repository.ErrNotFound) {
-			return nil
+			return "", nil
 		}
-		return err
+		return "", err
 	}
 	if v, ok := src.(io.Closer); ok {
 		defer v.Close()
 	}
 
-	id = repository.NewBackupIdentifier(gameID, uuid.NewString())
+	u := uuid.NewString()
+	backupID := repository.NewBackupIdentifier(gameID, u)
 
-	if err := s.repo.Mkdir(id); err != nil {
-		return err
+	if err := s.repo.Mkdir(backupID); err != nil {
+		return "", err
 	}
 
-	dst, err := s.repo.WriteBlob(id)
-	if err != nil {
-		return err
-	}
-	if v, ok := dst.(io.Closer); ok {
-		defer v.Close()
+	if err := s.write(backupID, src); err != nil {
+		return "", err
 	}
 
-	if _, err := io.Copy(dst, src); err != nil {
-		return err
+	if err := s.repo.WriteBackupMetadata(backupID, m); err != nil {
+		return "", err
 	}
 
-	return nil
+	return u, nil
 }
 
-func (s *Service) AllGames() ([]repository.Metadata, error) {
-	ids, err := s.repo.All()
-	if err != nil {
-		return nil, fmt.Errorf("failed to get the list of ids: %w", err)
-	}
+// LabelledBackup copies the current archive in a new backup described by label
+func (s *Service) LabelledBackup(gameID, label string) (string, error) {
+	return s.labelledBackup(gameID, label, false)
+}
 
-	var ms []repository.Metadata
-	for _, id := range ids {
-		m, err := s.repo.Metadata(repository.NewGameIdentifier(id))
-		if err != nil {
-			return nil, fmt.Errorf("failed to open metadata: %w", err)
-		}
-		ms = append(ms, m)
+// ConflictBackup copies the current archive in a new backup described by
+// label, as the discarded side of a conflict
+func (s *Service) ConflictBackup(gameID, label string) (string, error) {
+	return s.labelledBackup(gameID, label, true)
+}
+
+func (s *Service) labelledBackup(gameID, label string, conflict bool) (string, error) {
+	backupID, err := s.makeBackup(gameID)
+	if err != nil || len(backupID) == 0 {
+		return backupID, err
 	}
 
-	return ms, nil
-}
+	id := repository.NewBackupIdentifier(gameID, backupID)
 
-func (s *Service) AllBackups(gameID string) ([]repository.Backup, error) {
-	ids, err := s.repo.AllHist(repository.NewGameIdentifier(gameID))
+	m, err := s.repo.Metadata(repository.NewGameIdentifier(gameID))
 	if err != nil {
-		return nil, fmt.Errorf("failed to get the list of ids: %w", err)
+		return "", err
 	}
+	m.Label = label
+	m.Conflict = conflict
 
-	var bs []repository.Backup
-	for _, id := range ids {
-		b, err := s.repo.Backup(repository.NewBackupIdentifier(gameID, id))
-		if err != nil {
-			return nil, fmt.Errorf("failed to open metadata: %w", err)
-		}
-		bs = append(bs, b)
+	if err := s.repo.WriteBackupMetadata(id, m); err != nil {
+		return "", fmt.Errorf("failed to label the backup: %w", err)
 	}
 
-	return bs, nil
+	return backupID, nil
 }
 
-func (l Service) PullArchive(gameID, backupID string, cli *client.Client) error {
-	if len(backupID) > 0 {
-		path := l.repo.DataPath(repository.NewBackupIdentifier(gameID, backupID))
-		return cli.PullBackup(gameID, backupID, filepath.Join(path, "data.tar.gz"))
-	}
-
-	path := l.repo.DataPath(repository.NewGameIdentifier(gameID))
-	return cli.Pull(gameID, filepath.Join(path, "data.tar.gz"))
-}
+// BackupDirectory archives the save directory as it is on the disk in a new
+// backup described by label. Nothing is done if the directory does not exist.
+func (s *Service) BackupDirectory(gameID, label string) (string, error) {
+	id := repository.NewGameIdentifier(gameID)
 
-func (l Service) PushArchive(gameID, backupID string, cli *client.Client) error {
-	m, err := l.repo.Metadata(repository.NewGameIdentifier(gameID))
+	m, err := s.repo.Metadata(id)
 	if err != nil {
-		return err
+		return "", err
 	}
 
-	if len(backupID) > 0 {
-		path := l.repo.DataPath(repository.NewBackupIdentifier(gameID, backupID))
-		return cli.PushSave(filepath.Join(path, "data.taz.gz"), m)
+	path, err := s.Location(m)
+	if err != nil {
+		return "", err
 	}
 
-	path := l.repo.DataPath(repository.NewGameIdentifier(gameID))
-	return cli.PushSave(filepath.Join(path, "data.tar.gz"), m)
-}
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return "", nil
+		}
+		return "", err
+	}
 
-func (l Service) PullCurrent(id, path string, cli *client.Client) error {
-	gameID := repository.NewGameIdentifier(id)
-	if err := l.repo.Mkdir(gameID); err != nil {
-		return err
+	roots, err := s.roots(m)
+	if err != nil {
+		return "", err
 	}
 
-	m, err := cli.Metadata(id)
+	_, same, err := s.compare(id, roots)
 	if err != nil {
-		return fmt.Errorf("failed to get metadata from the server: %w", err)
+		return "", err
 	}
 
-	if err := l.repo.WriteMetadata(gameID, m); err != nil {
-		return fmt.Errorf("failed to write metadata: %w", err)
+	// the directory is the current archive: copy it unless it is already saved
+	if len(m.MD5) > 0 && same {
+		bs, err := s.AllBackups(gameID)
+		if err != nil {
+			return "", err
+		}
+		for _, b := range bs {
+			if b.MD5 == m.MD5 {
+				return b.UUID, nil
+			}
+		}
+		return s.LabelledBackup(gameID, label)
 	}
 
-	archivePath := filepath.Join(l.repo.DataPath(gameID), "data.tar.gz")
+	u := uuid.NewString()
+	backupID := repository.NewBackupIdentifier(gameID, u)
 
-	if err := cli.Pull(id, archivePath); err != nil {
-		return fmt.Errorf("failed to pull from the server: %w", err)
+	if err := s.repo.Mkdir(backupID); err != nil {
+		return "", err
 	}
 
-	f, err := l.repo.ReadBlob(gameID)
+	f, err := s.repo.WriteBlob(backupID)
 	if err != nil {
-		return fmt.Errorf("failed to open blob from local repository: %w", err)
+		return "", err
 	}
+	defer f.Abort()
 
-	if err := os.MkdirAll(path, 0740); err != nil {
-		return fmt.Errorf("failed to create destination directory: %w", err)
+	if err := archive.TarSources(f, sources(roots)...); err != nil {
+		return "", fmt.Errorf("failed to make archive: %w", err)
 	}
 
-	if err := archive.Untar(f, path); err != nil {
-		return fmt.Errorf("failed to untar archive: %w", err)
+	if err := f.Close(); err != nil {
+		return "", fmt.Errorf("failed to write archive: %w", err)
 	}
 
-	if err := l.repo.ResetLastScan(gameID); err != nil {
-		return fmt.Errorf("failed to create .last_run file: %w", err)
+	m.Date = time.Now()
+	m.Parent = m.MD5
+	m.Device = s.device
+	m.Label = label
+	if err := s.repo.WriteBackupMetadata(backupID, m); err != nil {
+		return "", fmt.Errorf("failed to write backup metadata: %w", err)
 	}
 
-	return nil
+	return u, nil
 }
 
-func (l Service) PullBackup(gameID, backupID string, cli *client.Client) error {
-	id := repository.NewBackupIdentifier(gameID, backupID)
-
-	archivePath := filepath.Join(l.repo.DataPath(id), "data.tar.gz")
-
-	if err := cli.PullBackup(gameID, backupID, archivePath); err != nil {
-		return fmt.Errorf("failed to pull backup: %w", err)
+// PullAsBackup downloads the current remote archive in a new local backup
+// described by label, as the discarded side of a conflict. The local archive
+// is left untouched.
+func (l Service) PullAsBackup(gameID, label string, cli *client.Client) (string, error) {
+	m, err := cli.Metadata(gameID)
+	if err != nil {
+		return "", fmt.Errorf("failed to get metadata from the server: %w", err)
 	}
 
-	return nil
-}
-
-func (l Service) RemoveGame(gameID string) error {
-	return l.repo.Remove(repository.NewGameIdentifier(gameID))
-}
-
-func (l Service) SetVersion(gameID string, value int) error {
-	id := repository.NewGameIdentifier(gameID)
+	u := uuid.NewString()
+	id := repository.NewBackupIdentifier(gameID, u)
 
-	m, err := l.repo.Metadata(id)
+	err = l.download(id, func(archivePath string) error {
+		return cli.Pull(gameID, archivePath)
+	})
 	if err != nil {
-		return fmt.Errorf("failed to get metadata from the server: %w", err)
+		return "", fmt.Errorf("failed to pull from the server: %w", err)
 	}
 
-	m.Version = value
-
-	if err := l.repo.WriteMetadata(id, m); err != nil {
-		return fmt.Errorf("failed to write metadata: %w", err)
+	m.Label = label
+	m.Conflict = true
+	if err := l.repo.WriteBackupMetadata(id, m); err != nil {
+		return "", fmt.Errorf("failed to write backup metadata: %w", err)
 	}
 
-	return nil
+	return u, nil
 }
 
-func IsDirectoryChanged(path string, lastRun time.Time) bool {
-	changed := false
-	_ = filepath.Walk(path, func(path string, info os.FileInfo, walkErr error) error {
-		if walkErr != nil {
+// Snapshot keeps the current archive as a backup, unless a backup
+// of the same archive already exists
+func (s *Service) Snapshot(gameID string) error {
+	m, err := s.repo.Metadata(repository.NewGameIdentifier(gameID))
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
 			return nil
 		}
-		if info.ModTime().After(lastRun) {
-			changed = true
-			return io.EOF // early exit
-		}
+		return err
+	}
+
+	if len(m.MD5) == 0 {
 		return nil
-	})
-	return changed
-}
+	}
 
-func (l Service) Copy(id string, src io.Reader) error {
-	dst, err := l.repo.WriteBlob(repository.NewGameIdentifier(id))
+	bs, err := s.AllBackups(gameID)
 	if err != nil {
 		return err
 	}
-	if v, ok := dst.(io.Closer); ok {
-		defer v.Close()
-	}
 
-	if _, err := io.Copy(dst, src); err != nil {
-		return err
+	for _, b := range bs {
+		if b.MD5 == m.MD5 {
+			return nil
+		}
 	}
 
-	return nil
+	return s.MakeBackup(gameID)
 }
 
-func (l Service) CopyBackup(gameID, backupID string, src io.Reader) error {
+// Restore makes a backup the current archive of a game. The version number
+// is incremented so that the clients see it as a new version.
+func (s *Service) Restore(gameID, backupID string) error {
 	id := repository.NewBackupIdentifier(gameID, backupID)
 
-	if err := l.repo.Mkdir(id); err != nil {
+	unlock := s.lock(gameID)
+	defer unlock()
+
+	if _, err := s.repo.Backup(id); err != nil {
 		return err
 	}
 
-	dst, err := l.repo.WriteBlob(id)
+	m, err := s.repo.Metadata(repository.NewGameIdentifier(gameID))
 	if err != nil {
 		return err
 	}
-	if v, ok := dst.(io.Closer); ok {
-		defer v.Close()
-	}
 
-	if _, err := io.Copy(dst, src); err != nil {
+	src, err := s.repo.ReadBlob(id)
+	if err != nil {
 		return err
 	}
+	defer src.Close()
 
-	return nil
+	m.Version += 1
+	m.Date = time.Now()
+
+	return s.upload(gameID, "", src, func() (repository.Metadata, error) { return m, nil })
 }
 
-func (l Service) ApplyCurrent(gameID string) error {
-	id := repository.NewGameIdentifier(gameID)
-	path := l.repo.DataPath(id)
+// Prune removes the backups of a game that are not selected by the retention policy.
+// The policy of the game takes precedence over the global one. When dryRun is set,
+// the backups are only listed.
+func (s *Service) Prune(gameID string, global retention.Policy, dryRun bool) ([]repository.Backup, error) {
+	p, err := s.Retention(gameID)
+	if err != nil {
+		return nil, err
+	}
+	if p == nil {
+		p = &global
+	}
 
-	g, err := l.repo.Metadata(id)
+	if p.IsZero() {
+		return nil, nil
+	}
+
+	bs, err := s.AllBackups(gameID)
 	if err != nil {
-		return err
+		return nil, err
 	}
 
-	return l.apply(filepath.Join(path, "data.tar.gz"), g.Path)
-}
+	backups := make(map[string]repository.Backup)
+	entries := make([]retention.Entry, 0, len(bs))
+	for _, b := range bs {
+		// the discarded sides of the conflicts are never removed by the
+		// retention policy
+		if b.Conflict {
+			continue
+		}
+		backups[b.UUID] = b
+		entries = append(entries, retention.Entry{
+			ID:        b.UUID,
+			CreatedAt: b.CreatedAt,
+			Size:      b.Size,
+		})
+	}
 
-func (l Service) ApplyBackup(gameID, backupID string) error {
-	id := repository.NewGameIdentifier(gameID)
-	fullID := repository.NewBackupIdentifier(gameID, backupID)
-	path := l.repo.DataPath(fullID)
+	_, remove := retention.Select(*p, entries)
 
-	g, err := l.repo.Metadata(id)
-	if err != nil {
-		return err
+	var removed []repository.Backup
+	for _, e := range remove {
+		if !dryRun {
+			if err := s.repo.RemoveBackup(repository.NewBackupIdentifier(gameID, e.ID)); err != nil {
+				return removed, fmt.Errorf("failed to remove backup %s: %w", e.ID, err)
+			}
+		}
+		removed = append(removed, backups[e.ID])
 	}
 
-	return l.apply(filepath.Join(path, "data.tar.gz"), g.Path)
+	return removed, nil
 }
 
-func (l Service) Repository() repository.Repository {
-	return l.repo
+func (s *Service) Retention(gameID string) (*retention.Policy, error) {
+	p, err := s.repo.Retention(repository.NewGameIdentifier(gameID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get retention policy: %w", err)
+	}
+
+	return p, nil
 }
 
-func (l Service) ReloadCache(gameID string) error {
-	if er, ok := l.repo.(*repository.EagerRepository); ok {
-		return er.ReloadMetadata(repository.NewGameIdentifier(gameID))
+func (s *Service) SetRetention(gameID string, p *retention.Policy) error {
+	id := repository.NewGameIdentifier(gameID)
+
+	if _, err := s.repo.Metadata(id); err != nil {
+		return fmt.Errorf("failed to get game metadata: %w", err)
+	}
+
+	if err := s.repo.SetRetention(id, p); err != nil {
+		return fmt.Errorf("failed to set retention policy: %w", err)
 	}
+
 	return nil
 }
 
-func (l Service) apply(src, dst string) error {
-	if err := os.RemoveAll(dst); err != nil {
-		return fmt.Errorf("failed to remove old save: %w", err)
+func (s *Service) AllGames() ([]repository.Metadata, error) {
+	ids, err := s.repo.All()
+	if err != nil {
+		return nil, fmt.Errorf("failed to get the list of ids: %w", err)
+	}
+
+	var ms []repository.Metadata
+	for _, id := range ids {
+		m, err := s.repo.Metadata(repository.NewGameIdentifier(id))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open metadata: %w", err)
+		}
+		ms = append(ms, m)
 	}
 
-	f, err := os.OpenFile(src, os.O_RDONLY, 0)
+	return ms, nil
+}
+
+func (s *Service) AllBackups(gameID string) ([]repository.Backup, error) {
+	ids, err := s.repo.AllHist(repository.NewGameIdentifier(gameID))
 	if err != nil {
-		return fmt.Errorf("failed to open archive: %w", err)
+		return nil, fmt.Errorf("failed to get the list of ids: %w", err)
 	}
-	defer f.Close()
 
-	return archive.Untar(f, dst)
+	var bs []repository.Backup
+	for _, id := range ids {
+		b, err := s.repo.Backup(repository.NewBackupIdentifier(gameID, id))
+		if err != nil {
+			return nil, fmt.Errorf("failed to open metadata: %w", err)
+		}
+		bs = append(bs, b)
+	}
+
+	return bs, nil
+}
+
+func (l Service) PullArchive(gameID, backupID string, cli *client.Client) error {
+	if len(backupID) > 0 {
+		return l.PullBackup(gameID, backupID, cli)
+	}
+
+	return l.Fetch(gameID, "", cli)
+}
+
+// Fetch replaces the local archive with the remote one. If expected is set,
+// the downloaded archive must have this digest (see hash.ParseDigest) or
+// ErrCorrupted is returned and the local archive is left untouched.
+func (l Service) Fetch(gameID, expected string, cli *client.Client) error {
+	return l.download(repository.NewGameIdentifier(gameID), func(archivePath string) error {
+		if err := cli.Pull(gameID, archivePath); err != nil {
+			return err
+		}
+		if len(expected) == 0 {
+			return nil
+		}
+
+		alg, sum, err := hash.ParseDigest(expected)
+		if err != nil {
+			return err
+		}
+		h, err := hash.FileDigest(archivePath, alg)
+		if err != nil {
+			return fmt.Errorf("failed to hash the downloaded archive: %w", err)
+		}
+		if h != hash.Digest(alg, sum) {
+			return fmt.Errorf("%w: got %s, expected %s", ErrCorrupted, h, expected)
+		}
+		return nil
+	})
+}
+
+// PushArchive sends the current archive of a game, base is the hash
+// of the remote archive the local one is based on (see client.PushSave)
+func (l Service) PushArchive(gameID, base string, cli *client.Client) error {
+	id := repository.NewGameIdentifier(gameID)
+
+	m, err := l.repo.Metadata(id)
+	if err != nil {
+		return err
+	}
+
+	src, err := l.repo.ReadBlob(id)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return cli.PushSave(src, m, base)
+}
+
+func (l Service) PushBackup(gameID, backupID string, cli *client.Client) error {
+	m, err := l.repo.Metadata(repository.NewGameIdentifier(gameID))
+	if err != nil {
+		return err
+	}
+
+	id := repository.NewBackupIdentifier(gameID, backupID)
+
+	b, err := l.repo.Backup(id)
+	if err != nil {
+		return err
+	}
+
+	src, err := l.repo.ReadBlob(id)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	return cli.PushBackup(src, b, m)
+}
+
+// PullCurrent downloads the current archive of a game that is not in the
+// datastore yet and extracts it in the directories of m on this device
+// (see Location). The content of the roots that are not set on this device
+// is extracted in the RootsDir of the save directory.
+func (l Service) PullCurrent(id string, m repository.Metadata, cli *client.Client) error {
+	path, err := l.Location(m)
+	if err != nil {
+		return err
+	}
+	if err := CheckRoots(path, l.LocalRoots(m)); err != nil {
+		return err
+	}
+
+	gameID := repository.NewGameIdentifier(id)
+	if err := l.repo.Mkdir(gameID); err != nil {
+		return err
+	}
+
+	if err := l.repo.WriteMetadata(gameID, m); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	err = l.download(gameID, func(archivePath string) error {
+		return cli.Pull(id, archivePath)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pull from the server: %w", err)
+	}
+
+	f, err := l.repo.ReadBlob(gameID)
+	if err != nil {
+		return fmt.Errorf("failed to open blob from local repository: %w", err)
+	}
+	defer f.Close()
+
+	rs, err := l.roots(m)
+	if err != nil {
+		return err
+	}
+
+	for _, r := range rs {
+		if err := os.MkdirAll(r.path, 0740); err != nil {
+			return fmt.Errorf("failed to create destination directory: %w", err)
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		opts := l.extract
+		opts.Select = r.selects
+		if err := archive.UntarWith(f, r.path, opts); err != nil {
+			return fmt.Errorf("failed to untar archive: %w", err)
+		}
+	}
+
+	return l.record(gameID, rs)
+}
+
+func (l Service) PullBackup(gameID, backupID string, cli *client.Client) error {
+	id := repository.NewBackupIdentifier(gameID, backupID)
+
+	err := l.download(id, func(archivePath string) error {
+		return cli.PullBackup(gameID, backupID, archivePath)
+	})
+	if err != nil {
+		return fmt.Errorf("failed to pull backup: %w", err)
+	}
+
+	b, err := cli.ArchiveInfo(gameID, backupID)
+	if err != nil {
+		return fmt.Errorf("failed to get backup information: %w", err)
+	}
+
+	if b.Version > 0 {
+		m, err := l.repo.Metadata(repository.NewGameIdentifier(gameID))
+		if err != nil {
+			return fmt.Errorf("failed to get metadata: %w", err)
+		}
+		m.Version = b.Version
+		m.Date = b.Date
+		m.Parent = b.Parent
+		m.Device = b.Device
+		m.Label = b.Label
+		m.Conflict = b.Conflict
+
+		if err := l.repo.WriteBackupMetadata(id, m); err != nil {
+			return fmt.Errorf("failed to write backup metadata: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// download fetches an archive in a temporary file next to the data,
+// then copies it in the repository
+func (l Service) download(id repository.Identifier, fetch func(archivePath string) error) error {
+	if err := l.repo.Mkdir(id); err != nil {
+		return err
+	}
+
+	// the archive is removed even if fetch fails once it is downloaded,
+	// e.g. when it does not match its digest
+	tmp := filepath.Join(l.repo.DataPath(id), "download.tar.gz")
+	defer os.Remove(tmp)
+
+	if err := fetch(tmp); err != nil {
+		return err
+	}
+
+	src, err := os.OpenFile(tmp, os.O_RDONLY, 0)
+	if err != nil {
+		return fmt.Errorf("failed to open downloaded archive: %w", err)
+	}
+	defer src.Close()
+
+	if err := l.write(id, src); err != nil {
+		return fmt.Errorf("failed to copy downloaded archive: %w", err)
+	}
+
+	return nil
+}
+
+// write replaces the blob, the current blob is kept if the copy fails
+func (l Service) write(id repository.Identifier, src io.Reader) error {
+	dst, err := l.repo.WriteBlob(id)
+	if err != nil {
+		return err
+	}
+	defer dst.Abort()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return err
+	}
+
+	return dst.Close()
+}
+
+func (l Service) RemoveGame(gameID string) error {
+	if err := l.repo.Remove(repository.NewGameIdentifier(gameID)); err != nil {
+		return err
+	}
+
+	if _, err := l.CollectGarbage(); err != nil {
+		return fmt.Errorf("failed to remove unreferenced data: %w", err)
+	}
+
+	return nil
+}
+
+// CollectGarbage removes the data that are not used anymore, when the
+// repository shares data between the games
+func (l Service) CollectGarbage() (int, error) {
+	if gc, ok := l.repo.(repository.GarbageCollector); ok {
+		return gc.GC()
+	}
+	return 0, nil
+}
+
+func (l Service) SetVersion(gameID string, value int) error {
+	id := repository.NewGameIdentifier(gameID)
+
+	m, err := l.repo.Metadata(id)
+	if err != nil {
+		return fmt.Errorf("failed to get metadata from the server: %w", err)
+	}
+
+	m.Version = value
+
+	if err := l.repo.WriteMetadata(id, m); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	return nil
+}
+
+// Status lists the files of the save directories that were added, changed
+// or deleted since the last scan
+func (s *Service) Status(gameID string) (Changes, error) {
+	id := repository.NewGameIdentifier(gameID)
+
+	m, err := s.repo.Metadata(id)
+	if err != nil {
+		return Changes{}, fmt.Errorf("failed to get game metadata: %w", err)
+	}
+
+	roots, err := s.roots(m)
+	if err != nil {
+		return Changes{}, err
+	}
+
+	prev, err := s.last(id)
+	if err != nil {
+		return Changes{}, err
+	}
+
+	cur, err := files(roots, prev)
+	if err != nil {
+		return Changes{}, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	return diff(prev, cur), nil
+}
+
+// compare reads the files of the roots and tells whether their content
+// is the one of the last scan
+func (s *Service) compare(id repository.GameIdentifier, roots []root) (manifest.Manifest, bool, error) {
+	prev, err := s.last(id)
+	if err != nil {
+		return manifest.Manifest{}, false, err
+	}
+
+	cur, err := files(roots, prev)
+	if err != nil {
+		return manifest.Manifest{}, false, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	return cur, prev.Files != nil && prev.Equal(cur), nil
+}
+
+// last returns the files as they were at the last scan. The datastores
+// of older versions have no manifest, the files of the current archive
+// are returned instead. The files are nil if there is no archive yet.
+func (s *Service) last(id repository.GameIdentifier) (manifest.Manifest, error) {
+	m, err := s.repo.Manifest(id)
+	if err != nil {
+		return manifest.Manifest{}, fmt.Errorf("failed to read manifest: %w", err)
+	}
+	if m.Files != nil {
+		return m, nil
+	}
+
+	f, err := s.repo.ReadBlob(id)
+	if err != nil {
+		if errors.Is(err, repository.ErrNotFound) {
+			return manifest.Manifest{}, nil
+		}
+		return manifest.Manifest{}, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	if m, err = archive.Manifest(f); err != nil {
+		return manifest.Manifest{}, fmt.Errorf("failed to read archive: %w", err)
+	}
+	return m, nil
+}
+
+// record keeps the files of the roots as the state of the last scan,
+// after an archive was extracted in them
+func (l Service) record(id repository.GameIdentifier, roots []root) error {
+	m, err := files(roots, manifest.Manifest{})
+	if err != nil {
+		return fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	if err := l.repo.WriteManifest(id, m); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+	return nil
+}
+
+// Upload replaces the archive and the metadata of a game at once, the
+// metadata are asked once src is written in the staging area so that they
+// can follow the archive in a stream.
+// When ifMatch is set, the upload is rejected with ErrConflict if the hash of the current
+// archive is not ifMatch ("*" accepts any existing archive).
+func (l Service) Upload(gameID, ifMatch string, src io.Reader, metadata func() (repository.Metadata, error)) error {
+	unlock := l.lock(gameID)
+	defer unlock()
+
+	return l.upload(gameID, ifMatch, src, metadata)
+}
+
+func (l Service) upload(gameID, ifMatch string, src io.Reader, metadata func() (repository.Metadata, error)) (err error) {
+	id := repository.NewGameIdentifier(gameID)
+
+	if len(ifMatch) > 0 {
+		current, err := l.repo.Metadata(id)
+		if err != nil && !errors.Is(err, repository.ErrNotFound) {
+			return fmt.Errorf("failed to get metadata: %w", err)
+		}
+		if len(current.MD5) == 0 || (ifMatch != "*" && ifMatch != current.MD5) {
+			return ErrConflict
+		}
+	}
+
+	// the directory of a new game is removed if the upload fails, the
+	// datastore cannot be loaded with a game without metadata
+	if _, statErr := os.Stat(l.repo.DataPath(id)); errors.Is(statErr, os.ErrNotExist) {
+		defer func() {
+			if err != nil {
+				if rmErr := l.repo.Remove(id); rmErr != nil {
+					err = errors.Join(err, rmErr)
+				}
+			}
+		}()
+	}
+
+	if err := l.repo.Mkdir(id); err != nil {
+		return fmt.Errorf("failed to make game dir: %w", err)
+	}
+
+	if err := l.Snapshot(gameID); err != nil {
+		return fmt.Errorf("failed to keep the current version: %w", err)
+	}
+
+	tx, err := l.repo.Begin(id)
+	if err != nil {
+		return fmt.Errorf("failed to start transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	dst, err := tx.WriteBlob()
+	if err != nil {
+		return fmt.Errorf("failed to open blob: %w", err)
+	}
+	defer dst.Abort()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("failed to write data: %w", err)
+	}
+
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to write data: %w", err)
+	}
+
+	m, err := metadata()
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	if err := tx.WriteMetadata(m); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	return tx.Commit()
+}
+
+// CopyBackup writes a backup, metadata returns the metadata of the game at
+// the time of the backup once src is written, nil if they are not known.
+// The backup is not kept if metadata returns an error.
+func (l Service) CopyBackup(gameID, backupID string, src io.Reader, metadata func() (*repository.Metadata, error)) (err error) {
+	id := repository.NewBackupIdentifier(gameID, backupID)
+
+	// a new backup is removed if the copy fails, it would have no data
+	if _, statErr := os.Stat(l.repo.DataPath(id)); errors.Is(statErr, os.ErrNotExist) {
+		defer func() {
+			if err != nil {
+				if rmErr := l.repo.RemoveBackup(id); rmErr != nil {
+					err = errors.Join(err, rmErr)
+				}
+			}
+		}()
+	}
+
+	if err := l.repo.Mkdir(id); err != nil {
+		return err
+	}
+
+	dst, err := l.repo.WriteBlob(id)
+	if err != nil {
+		return err
+	}
+	defer dst.Abort()
+
+	if _, err := io.Copy(dst, src); err != nil {
+		return fmt.Errorf("failed to write data: %w", err)
+	}
+
+	m, err := metadata()
+	if err != nil {
+		return fmt.Errorf("failed to read metadata: %w", err)
+	}
+
+	if err := dst.Close(); err != nil {
+		return fmt.Errorf("failed to write data: %w", err)
+	}
+
+	if m != nil {
+		return l.repo.WriteBackupMetadata(id, *m)
+	}
+
+	return nil
+}
+
+func (l Service) ApplyCurrent(gameID string) error {
+	id := repository.NewGameIdentifier(gameID)
+
+	g, err := l.repo.Metadata(id)
+	if err != nil {
+		return err
+	}
+
+	roots, err := l.roots(g)
+	if err != nil {
+		return err
+	}
+
+	applied, err := l.apply(id, roots)
+	if err != nil {
+		return err
+	}
+
+	// the directories are the current archive, there is nothing to scan.
+	// The roots that are not in the archive are left for the next scan
+	return l.record(id, applied)
+}
+
+func (l Service) ApplyBackup(gameID, backupID string) error {
+	id := repository.NewGameIdentifier(gameID)
+
+	g, err := l.repo.Metadata(id)
+	if err != nil {
+		return err
+	}
+
+	roots, err := l.roots(g)
+	if err != nil {
+		return err
+	}
+
+	// the files differ from the last scan, the next one makes a new
+	// version of them even if they keep their old mtimes
+	_, err = l.apply(repository.NewBackupIdentifier(gameID, backupID), roots)
+	return err
+}
+
+func (l Service) Repository() repository.Repository {
+	return l.repo
+}
+
+func (l Service) ReloadCache(gameID string) error {
+	if er, ok := l.repo.(*repository.EagerRepository); ok {
+		return er.ReloadMetadata(repository.NewGameIdentifier(gameID))
+	}
+	return nil
+}
+
+// ApplyTo extracts the archive (the current one if backupID is empty) in dst,
+// dst must not exist or be empty
+func (l Service) ApplyTo(gameID, backupID, dst string) error {
+	entries, err := os.ReadDir(dst)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	if len(entries) > 0 {
+		return fmt.Errorf("%s is not empty", dst)
+	}
+
+	_, err = l.apply(identifier(gameID, backupID), []root{{path: dst}})
+	return err
+}
+
+// Preview compares the archive (the current one if backupID is empty) with
+// the directory dst, the save directories of the game if dst is empty. The
+// ignored files of the save directories are not listed, they are kept on apply.
+func (l Service) Preview(gameID, backupID, dst string) (Changes, error) {
+	roots := []root{{path: dst}}
+	if len(dst) == 0 {
+		g, err := l.repo.Metadata(repository.NewGameIdentifier(gameID))
+		if err != nil {
+			return Changes{}, err
+		}
+
+		if roots, err = l.roots(g); err != nil {
+			return Changes{}, err
+		}
+	}
+
+	f, err := l.repo.ReadBlob(identifier(gameID, backupID))
+	if err != nil {
+		return Changes{}, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	want, err := archive.Manifest(f)
+	if err != nil {
+		return Changes{}, fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	// a root that is not in the archive is left untouched by apply
+	roots = slices.DeleteFunc(roots, func(r root) bool {
+		if len(r.prefix) == 0 {
+			return false
+		}
+		for name := range want.Files {
+			if strings.HasPrefix(name, r.prefix+"/") {
+				return false
+			}
+		}
+		return true
+	})
+
+	have, err := files(roots, manifest.Manifest{})
+	if err != nil {
+		return Changes{}, fmt.Errorf("failed to read directory: %w", err)
+	}
+
+	return diff(have, want), nil
+}
+
+// diff lists the files to add, change or delete to go from the files
+// of from to the ones of to
+func diff(from, to manifest.Manifest) Changes {
+	var c Changes
+	for name, e := range to.Files {
+		v, ok := from.Files[name]
+		switch {
+		case !ok:
+			c.Added = append(c.Added, name)
+		case !v.Same(e):
+			c.Changed = append(c.Changed, name)
+		}
+	}
+	for name := range from.Files {
+		if _, ok := to.Files[name]; !ok {
+			c.Deleted = append(c.Deleted, name)
+		}
+	}
+
+	slices.Sort(c.Added)
+	slices.Sort(c.Changed)
+	slices.Sort(c.Deleted)
+	return c
+}
+
+func identifier(gameID, backupID string) repository.Identifier {
+	if len(backupID) > 0 {
+		return repository.NewBackupIdentifier(gameID, backupID)
+	}
+	return repository.NewGameIdentifier(gameID)
+}
+
+// apply extracts the archive next to each root then replaces the roots,
+// they are left untouched if the archive cannot be extracted. A root
+// that is not in the archive is left as is. The files of a root that
+// are not kept by its rules are moved in the new directory. The roots
+// that were replaced are returned.
+func (l Service) apply(id repository.Identifier, roots []root) ([]root, error) {
+	f, err := l.repo.ReadBlob(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	type staged struct {
+		tmp, dst string
+		root     root
+	}
+
+	var stages []staged
+	for _, r := range roots {
+		// a symbolic link to the save directory is kept, its target is replaced
+		dst := filepath.Clean(r.path)
+		if v, err := filepath.EvalSymlinks(dst); err == nil {
+			dst = v
+		}
+		if err := os.MkdirAll(filepath.Dir(dst), 0740); err != nil {
+			return nil, fmt.Errorf("failed to create parent directory: %w", err)
+		}
+
+		tmp, err := os.MkdirTemp(filepath.Dir(dst), "."+filepath.Base(dst)+".cloudsave-")
+		if err != nil {
+			return nil, fmt.Errorf("failed to create temporary directory: %w", err)
+		}
+		defer os.RemoveAll(tmp)
+
+		var mode os.FileMode = 0755
+		if fi, err := os.Stat(dst); err == nil {
+			mode = fi.Mode().Perm()
+		}
+		if err := os.Chmod(tmp, mode); err != nil {
+			return nil, fmt.Errorf("failed to set permissions: %w", err)
+		}
+
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return nil, fmt.Errorf("failed to read archive: %w", err)
+		}
+
+		opts := l.extract
+		found := false
+		if len(r.prefix) > 0 || len(r.skip) > 0 {
+			opts.Select = func(name string) (string, bool) {
+				v, ok := r.selects(name)
+				found = found || ok
+				return v, ok
+			}
+		}
+
+		if err := archive.UntarWith(f, tmp, opts); err != nil {
+			if len(r.name) > 0 {
+				return nil, fmt.Errorf("failed to extract archive in %s: %w", r.name, err)
+			}
+			return nil, fmt.Errorf("failed to extract archive: %w", err)
+		}
+
+		if len(r.prefix) > 0 && !found {
+			continue
+		}
+		stages = append(stages, staged{tmp: tmp, dst: dst, root: r})
+	}
+
+	applied := make([]root, 0, len(stages))
+	for _, s := range stages {
+		if err := swap(s.tmp, s.dst, s.root.rules); err != nil {
+			return nil, err
+		}
+		applied = append(applied, s.root)
+	}
+	return applied, nil
+}
+
+// swap replaces dst by src. The old dst is renamed before src takes its
+// place, it is put back if src cannot be moved. The entries of the old dst
+// that are not kept by rules are moved in the new one.
+func swap(src, dst string, rules *filter.Filter) error {
+	old := src + ".old"
+	if err := os.Rename(dst, old); err != nil {
+		if !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to move the old save: %w", err)
+		}
+		old = ""
+	}
+
+	if err := os.Rename(src, dst); err != nil {
+		if len(old) > 0 {
+			os.Rename(old, dst)
+		}
+		return fmt.Errorf("failed to move the new save: %w", err)
+	}
+
+	if len(old) > 0 {
+		if err := carry(old, dst, rules); err != nil {
+			return fmt.Errorf("failed to move the ignored files, they are still in %s: %w", old, err)
+		}
+		if err := os.RemoveAll(old); err != nil {
+			return fmt.Errorf("failed to remove the old save: %w", err)
+		}
+	}
+
+	return nil
+}
+
+// carry moves the entries of src that are not kept by rules in dst,
+// unless dst already has an entry with the same name
+func carry(src, dst string, rules *filter.Filter) error {
+	if rules == nil {
+		return nil
+	}
+
+	return filepath.Walk(src, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(src, path)
+		if err != nil {
+			return err
+		}
+		if rules.Match(filepath.ToSlash(rel), info.IsDir()) {
+			return nil
+		}
+
+		target := filepath.Join(dst, rel)
+		if _, err := os.Lstat(target); err == nil {
+			return nil
+		}
+		if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
+			return err
+		}
+		if err := os.Rename(path, target); err != nil {
+			return err
+		}
+		if info.IsDir() {
+			return filepath.SkipDir
+		}
+		return nil
+	})
+}
+
+// files reads the regular files and the symbolic links of the roots that
+// are kept by their rules, indexed by their slash-separated name in the
+// archive. The hash of the files that did not change since prev is not
+// computed again.
+func files(roots []root, prev manifest.Manifest) (manifest.Manifest, error) {
+	res := manifest.New()
+	for _, r := range roots {
+		err := filepath.Walk(r.path, func(path string, info os.FileInfo, err error) error {
+			if err != nil {
+				if errors.Is(err, os.ErrNotExist) && path == r.path {
+					return nil
+				}
+				return err
+			}
+			rel, err := filepath.Rel(r.path, path)
+			if err != nil {
+				return err
+			}
+			rel = filepath.ToSlash(rel)
+			if !r.keep(rel, info.IsDir()) {
+				if info.IsDir() {
+					return filepath.SkipDir
+				}
+				return nil
+			}
+			if len(r.prefix) > 0 {
+				rel = r.prefix + "/" + rel
+			}
+
+			e := manifest.Entry{Size: info.Size(), ModTime: info.ModTime()}
+			switch {
+			case info.Mode()&os.ModeSymlink != 0:
+				link, err := os.Readlink(path)
+				if err != nil {
+					return err
+				}
+				e.Link = filepath.ToSlash(link)
+			case info.Mode().IsRegular():
+				h, ok := prev.Cached(rel, info)
+				if !ok {
+					if h, err = hash.FileMD5(path); err != nil {
+						return err
+					}
+				}
+				e.Hash = h
+			default:
+				return nil
+			}
+			res.Files[rel] = e
+			return nil
+		})
+		if err != nil {
+			return manifest.Manifest{}, err
+		}
+	}
+	return res, nil
 }
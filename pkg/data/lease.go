@@ -0,0 +1,139 @@
+package data
+
+import (
+	"cloudsave/pkg/repository"
+	"errors"
+	"fmt"
+	"time"
+)
+
+type (
+	// LeaseError is returned when another device holds the lease of a game
+	LeaseError struct {
+		Lease repository.Lease
+	}
+)
+
+var (
+	// ErrLocked is returned when the game is played on another device
+	ErrLocked error = errors.New("the game is checked out by another device")
+)
+
+func (e *LeaseError) Error() string {
+	return fmt.Sprintf("the game is checked out by %s since %s", e.Lease.Device, e.Lease.Since.Format(time.DateTime))
+}
+
+func (e *LeaseError) Is(err error) bool {
+	return err == ErrLocked
+}
+
+// Lease returns the lease of the game, nil if nobody holds it
+func (l Service) Lease(gameID string) (*repository.Lease, error) {
+	unlock := l.lock(gameID)
+	defer unlock()
+
+	return l.lease(repository.NewGameIdentifier(gameID))
+}
+
+// Acquire gives the lease of the game to the device for ttl. A *LeaseError
+// is returned when another device holds it, unless steal is set.
+func (l Service) Acquire(gameID, deviceID, device string, ttl time.Duration, steal bool) (repository.Lease, error) {
+	unlock := l.lock(gameID)
+	defer unlock()
+
+	id := repository.NewGameIdentifier(gameID)
+	cur, err := l.lease(id)
+	if err != nil {
+		return repository.Lease{}, err
+	}
+	if cur != nil && cur.DeviceID != deviceID && !steal {
+		return repository.Lease{}, &LeaseError{Lease: *cur}
+	}
+
+	now := time.Now()
+	lease := repository.Lease{DeviceID: deviceID, Device: device, Since: now, Expires: now.Add(ttl)}
+	// the device keeps the date it took the game
+	if cur != nil && cur.DeviceID == deviceID {
+		lease.Since = cur.Since
+	}
+
+	if err := l.repo.SetLease(id, &lease); err != nil {
+		return repository.Lease{}, fmt.Errorf("failed to set lease: %w", err)
+	}
+	return lease, nil
+}
+
+// Renew extends the lease the device holds by ttl. It fails with
+// repository.ErrNotFound if the lease expired and was released meanwhile,
+// and with a *LeaseError if another device took it.
+func (l Service) Renew(gameID, deviceID string, ttl time.Duration) (repository.Lease, error) {
+	unlock := l.lock(gameID)
+	defer unlock()
+
+	id := repository.NewGameIdentifier(gameID)
+	if _, err := l.repo.Metadata(id); err != nil {
+		return repository.Lease{}, fmt.Errorf("failed to get game metadata: %w", err)
+	}
+
+	// an expired lease is renewed as long as no other device took it
+	cur, err := l.repo.Lease(id)
+	if err != nil {
+		return repository.Lease{}, fmt.Errorf("failed to get lease: %w", err)
+	}
+	if cur == nil {
+		return repository.Lease{}, fmt.Errorf("no lease to renew: %w", repository.ErrNotFound)
+	}
+	if cur.DeviceID != deviceID {
+		if cur.Expires.After(time.Now()) {
+			return repository.Lease{}, &LeaseError{Lease: *cur}
+		}
+		return repository.Lease{}, fmt.Errorf("no lease to renew: %w", repository.ErrNotFound)
+	}
+
+	cur.Expires = time.Now().Add(ttl)
+	if err := l.repo.SetLease(id, cur); err != nil {
+		return repository.Lease{}, fmt.Errorf("failed to set lease: %w", err)
+	}
+	return *cur, nil
+}
+
+// Release removes the lease the device holds. A *LeaseError is returned when
+// another device holds it, unless force is set.
+func (l Service) Release(gameID, deviceID string, force bool) error {
+	unlock := l.lock(gameID)
+	defer unlock()
+
+	id := repository.NewGameIdentifier(gameID)
+	cur, err := l.lease(id)
+	if err != nil {
+		return err
+	}
+	if cur == nil {
+		return nil
+	}
+	if cur.DeviceID != deviceID && !force {
+		return &LeaseError{Lease: *cur}
+	}
+
+	if err := l.repo.SetLease(id, nil); err != nil {
+		return fmt.Errorf("failed to remove lease: %w", err)
+	}
+	return nil
+}
+
+// lease returns the lease of an existing game, nil if there is none or
+// if it expired
+func (l Service) lease(id repository.GameIdentifier) (*repository.Lease, error) {
+	if _, err := l.repo.Metadata(id); err != nil {
+		return nil, fmt.Errorf("failed to get game metadata: %w", err)
+	}
+
+	cur, err := l.repo.Lease(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to get lease: %w", err)
+	}
+	if cur == nil || !cur.Expires.After(time.Now()) {
+		return nil, nil
+	}
+	return cur, nil
+}
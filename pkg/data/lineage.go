@@ -0,0 +1,112 @@
+package data
+
+import (
+	"cloudsave/pkg/repository"
+	"fmt"
+)
+
+type (
+	// Relation describes how the local archive relates to the remote one
+	Relation int
+)
+
+const (
+	// Equal means both sides have the same archive
+	Equal Relation = iota
+	// Ahead means the local archive descends from the remote one
+	Ahead
+	// Behind means the remote archive descends from the local one
+	Behind
+	// Diverged means both sides were modified since their common ancestor
+	Diverged
+)
+
+func (r Relation) String() string {
+	switch r {
+	case Equal:
+		return "equal"
+	case Ahead:
+		return "ahead"
+	case Behind:
+		return "behind"
+	case Diverged:
+		return "diverged"
+	}
+	return "unknown"
+}
+
+// Lineage returns the parent hash of every archive known locally for a game,
+// indexed by the hash of the archive
+func (s *Service) Lineage(gameID string) (map[string]string, error) {
+	parents := make(map[string]string)
+
+	m, err := s.repo.Metadata(repository.NewGameIdentifier(gameID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to get metadata: %w", err)
+	}
+	if len(m.MD5) > 0 && len(m.Parent) > 0 {
+		parents[m.MD5] = m.Parent
+	}
+
+	bs, err := s.AllBackups(gameID)
+	if err != nil {
+		return nil, fmt.Errorf("failed to list backups: %w", err)
+	}
+	for _, b := range bs {
+		if len(b.Parent) > 0 {
+			parents[b.MD5] = b.Parent
+		}
+	}
+
+	return parents, nil
+}
+
+// Compare tells whether the local archive is a fast-forward of the remote one,
+// the other way around, or whether both sides diverged. parents maps the hash
+// of an archive to the hash of the archive it was made from (see Lineage).
+// The version numbers are compared when the lineage is unknown, e.g. for
+// archives made by an older version of the tool.
+func Compare(local, remote repository.Metadata, parents map[string]string) Relation {
+	if local.MD5 == remote.MD5 {
+		return Equal
+	}
+	if len(local.MD5) == 0 {
+		return Behind
+	}
+	if len(remote.MD5) == 0 {
+		return Ahead
+	}
+
+	if descends(remote, local.MD5, parents) {
+		return Behind
+	}
+	if descends(local, remote.MD5, parents) {
+		return Ahead
+	}
+
+	if len(local.Parent) == 0 || len(remote.Parent) == 0 {
+		switch {
+		case local.Version > remote.Version:
+			return Ahead
+		case local.Version < remote.Version:
+			return Behind
+		}
+	}
+
+	return Diverged
+}
+
+// descends walks up the ancestors of m looking for the given hash
+func descends(m repository.Metadata, ancestor string, parents map[string]string) bool {
+	seen := make(map[string]struct{})
+	for h := m.Parent; len(h) > 0; h = parents[h] {
+		if h == ancestor {
+			return true
+		}
+		if _, ok := seen[h]; ok {
+			return false
+		}
+		seen[h] = struct{}{}
+	}
+	return false
+}
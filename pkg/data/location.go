@@ -0,0 +1,164 @@
+package data
+
+import (
+	"cloudsave/pkg/repository"
+	"cloudsave/pkg/tools/paths"
+	"errors"
+	"fmt"
+	"maps"
+	"os"
+	"path/filepath"
+	"slices"
+)
+
+var (
+	// ErrNoPath is returned when the save directory of a game is not set on this device
+	ErrNoPath error = errors.New("the save directory is not set on this device")
+)
+
+// Location returns the save directory of the game on this device,
+// with its variables expanded
+func (s *Service) Location(m repository.Metadata) (string, error) {
+	p, ok := s.path(m.Path, m.Paths)
+	if !ok {
+		return "", ErrNoPath
+	}
+	return expand(p)
+}
+
+// rootLocation returns the directory of the root on this device,
+// false is returned if it is not set
+func (s *Service) rootLocation(r repository.Root) (string, bool, error) {
+	p, ok := s.path(r.Path, r.Paths)
+	if !ok {
+		return "", false, nil
+	}
+	v, err := expand(p)
+	return v, err == nil, err
+}
+
+func (s *Service) path(path string, byDevice map[string]string) (string, bool) {
+	if v, ok := byDevice[s.deviceID]; ok && len(s.deviceID) > 0 {
+		return v, true
+	}
+	if len(byDevice) > 0 || len(path) == 0 {
+		return "", false
+	}
+	return path, true
+}
+
+func expand(p string) (string, error) {
+	v, err := paths.Expand(p)
+	if err != nil {
+		return "", fmt.Errorf("failed to expand %s: %w", p, err)
+	}
+	if !filepath.IsAbs(v) {
+		return "", fmt.Errorf("%s is not an absolute path on this device", p)
+	}
+	return v, nil
+}
+
+// SetPath sets the save directory of the game on this device
+func (s *Service) SetPath(m *repository.Metadata, path string) {
+	m.Path, m.Paths = s.setPath(m.Path, m.Paths, path)
+}
+
+// SetRootPath sets the directory of the root on this device
+func (s *Service) SetRootPath(r *repository.Root, path string) {
+	r.Path, r.Paths = s.setPath(r.Path, r.Paths, path)
+}
+
+func (s *Service) setPath(path string, byDevice map[string]string, v string) (string, map[string]string) {
+	v = paths.Portable(v)
+	if len(s.deviceID) == 0 {
+		return v, byDevice
+	}
+
+	// the path shared by every device of an older version becomes
+	// the path of this device only
+	if byDevice == nil {
+		byDevice = make(map[string]string)
+	}
+	byDevice[s.deviceID] = v
+	return "", byDevice
+}
+
+// LocalRoots returns the roots of the game with their directory on this
+// device, the path of the roots that are not set on this device is empty
+func (s *Service) LocalRoots(m repository.Metadata) []repository.Root {
+	res := make([]repository.Root, 0, len(m.Roots))
+	for _, r := range m.Roots {
+		v, _, _ := s.rootLocation(r)
+		res = append(res, repository.Root{Name: r.Name, Path: v})
+	}
+	return res
+}
+
+// SuggestPath returns the save directory of another device that also
+// exists on this one, e.g. a path made of variables. An empty string
+// is returned if there is none.
+func (s *Service) SuggestPath(m repository.Metadata) string {
+	return suggest(m.Path, m.Paths)
+}
+
+// SuggestRootPath works like SuggestPath for a root
+func (s *Service) SuggestRootPath(r repository.Root) string {
+	return suggest(r.Path, r.Paths)
+}
+
+func suggest(path string, byDevice map[string]string) string {
+	candidates := slices.Sorted(maps.Values(byDevice))
+	if len(path) > 0 {
+		candidates = append(candidates, path)
+	}
+
+	var res string
+	for _, c := range candidates {
+		v, err := expand(c)
+		if err != nil {
+			continue
+		}
+		if fi, err := os.Stat(v); err == nil && fi.IsDir() {
+			return v
+		}
+		if len(res) == 0 {
+			res = v
+		}
+	}
+	return res
+}
+
+// MergeLocations copies the directories of the other devices known by the
+// remote in the local metadata, the directories of this device are kept
+func (s *Service) MergeLocations(local *repository.Metadata, remote repository.Metadata) {
+	local.Paths = s.merge(&local.Path, local.Paths, remote.Paths)
+
+	for _, rr := range remote.Roots {
+		i := slices.IndexFunc(local.Roots, func(r repository.Root) bool { return r.Name == rr.Name })
+		if i < 0 {
+			local.Roots = append(local.Roots, repository.Root{Name: rr.Name})
+			i = len(local.Roots) - 1
+		}
+		local.Roots[i].Paths = s.merge(&local.Roots[i].Path, local.Roots[i].Paths, rr.Paths)
+	}
+}
+
+func (s *Service) merge(path *string, local, remote map[string]string) map[string]string {
+	// the path shared by every device of an older version is the one
+	// of this device, it would not be used once the others are known
+	if len(local) == 0 && len(*path) > 0 && len(s.deviceID) > 0 {
+		local = map[string]string{s.deviceID: *path}
+		*path = ""
+	}
+
+	for id, v := range remote {
+		if id == s.deviceID {
+			continue
+		}
+		if local == nil {
+			local = make(map[string]string)
+		}
+		local[id] = v
+	}
+	return local
+}
@@ -0,0 +1,203 @@
+package data
+
+import (
+	"cloudsave/pkg/repository"
+	"cloudsave/pkg/tools/archive"
+	"cloudsave/pkg/tools/filter"
+	"cloudsave/pkg/tools/paths"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type (
+	// root is a directory of a save, its entries are named after prefix
+	// in the archive
+	root struct {
+		name   string
+		prefix string
+		path   string
+		rules  *filter.Filter
+		// prefixes of the other roots, they are not part of this one
+		skip []string
+	}
+)
+
+// RootsDir is the directory of the archive that holds the roots other than
+// the main one, each of them in a sub-directory named after the root
+const RootsDir = ".cloudsave-roots"
+
+var (
+	ErrInvalidRoot error = errors.New("invalid root")
+)
+
+// CheckRoots checks that the roots have distinct and valid names, and that
+// no directory of the save is inside another one. path is the main directory,
+// the paths are the ones of this device (see LocalRoots).
+func CheckRoots(path string, roots []repository.Root) error {
+	seen := make(map[string]struct{})
+	dirs := []string{expandOrClean(path)}
+	for _, r := range roots {
+		if len(r.Name) == 0 || r.Name == "." || r.Name == ".." || strings.ContainsAny(r.Name, `/\`) {
+			return fmt.Errorf("%w: %q is not a valid name", ErrInvalidRoot, r.Name)
+		}
+		if _, ok := seen[r.Name]; ok {
+			return fmt.Errorf("%w: %q is defined twice", ErrInvalidRoot, r.Name)
+		}
+		seen[r.Name] = struct{}{}
+
+		// the root is not on this device
+		if len(r.Path) == 0 {
+			continue
+		}
+
+		p := expandOrClean(r.Path)
+		for _, v := range dirs {
+			if within(p, v) || within(v, p) {
+				return fmt.Errorf("%w: %q overlaps %s", ErrInvalidRoot, r.Name, v)
+			}
+		}
+		dirs = append(dirs, p)
+	}
+	return nil
+}
+
+// expandOrClean returns the path with its variables, or as it is when one
+// of them is not defined
+func expandOrClean(p string) string {
+	if v, err := paths.Expand(p); err == nil {
+		return v
+	}
+	return filepath.Clean(p)
+}
+
+// within tells whether path is dir or is inside dir
+func within(path, dir string) bool {
+	rel, err := filepath.Rel(dir, path)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+// roots returns the main directory of the save then the other ones, as they
+// are on this device. The content of the roots that are not set on this
+// device is kept in the RootsDir of the main directory.
+func (s *Service) roots(m repository.Metadata) ([]root, error) {
+	path, err := s.Location(m)
+	if err != nil {
+		return nil, err
+	}
+	main := root{path: path}
+
+	var res []root
+	for _, r := range m.Roots {
+		dir, ok, err := s.rootLocation(r)
+		if err != nil {
+			return nil, fmt.Errorf("failed to locate %s: %w", r.Name, err)
+		}
+		if !ok {
+			continue
+		}
+
+		prefix := RootsDir + "/" + r.Name
+		main.skip = append(main.skip, prefix)
+
+		rules, err := filter.Load(dir, m.Include, m.Exclude)
+		if err != nil {
+			return nil, fmt.Errorf("failed to load the ignore rules of %s: %w", r.Name, err)
+		}
+		res = append(res, root{name: r.Name, prefix: prefix, path: dir, rules: rules})
+	}
+
+	rules, err := filter.Load(path, m.Include, m.Exclude)
+	if err != nil {
+		return nil, fmt.Errorf("failed to load the ignore rules: %w", err)
+	}
+	main.rules = rules
+
+	return append([]root{main}, res...), nil
+}
+
+// Directories returns the directories of the save on this device,
+// the main one first
+func (s *Service) Directories(m repository.Metadata) ([]string, error) {
+	roots, err := s.roots(m)
+	if err != nil {
+		return nil, err
+	}
+
+	res := make([]string, 0, len(roots))
+	for _, r := range roots {
+		res = append(res, r.path)
+	}
+	return res, nil
+}
+
+// keep tells whether an entry of the directory is archived
+func (r root) keep(name string, dir bool) bool {
+	for _, prefix := range r.skip {
+		if name == prefix || strings.HasPrefix(name, prefix+"/") {
+			return false
+		}
+	}
+	return r.rules.Match(name, dir)
+}
+
+// selects returns the name in the directory of an entry of the archive
+func (r root) selects(name string) (string, bool) {
+	name = strings.TrimPrefix(name, "./")
+	if len(r.prefix) == 0 {
+		return name, !slices.ContainsFunc(r.skip, func(prefix string) bool {
+			return name == prefix || strings.HasPrefix(name, prefix+"/")
+		})
+	}
+
+	if name == r.prefix {
+		return ".", true
+	}
+	if v, ok := strings.CutPrefix(name, r.prefix+"/"); ok {
+		return v, true
+	}
+	return "", false
+}
+
+// sources returns the roots to archive, the roots other than the main one
+// are left out when they do not exist on the disk
+func sources(roots []root) []archive.Source {
+	res := make([]archive.Source, 0, len(roots))
+	for _, r := range roots {
+		if _, err := os.Stat(r.path); len(r.prefix) > 0 && errors.Is(err, os.ErrNotExist) {
+			continue
+		}
+		res = append(res, archive.Source{Prefix: r.prefix, Root: r.path, Keep: r.keep})
+	}
+	return res
+}
+
+// ArchiveRoots returns the name of the roots other than the main one
+// in the archive (the current one if backupID is empty)
+func (l Service) ArchiveRoots(gameID, backupID string) ([]string, error) {
+	f, err := l.repo.ReadBlob(identifier(gameID, backupID))
+	if err != nil {
+		return nil, fmt.Errorf("failed to open archive: %w", err)
+	}
+	defer f.Close()
+
+	m, err := archive.Manifest(f)
+	if err != nil {
+		return nil, fmt.Errorf("failed to read archive: %w", err)
+	}
+
+	var res []string
+	for name := range m.Files {
+		if v, ok := strings.CutPrefix(name, RootsDir+"/"); ok {
+			v, _, _ = strings.Cut(v, "/")
+			if !slices.Contains(res, v) {
+				res = append(res, v)
+			}
+		}
+	}
+	slices.Sort(res)
+	return res, nil
+}
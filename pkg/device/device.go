@@ -0,0 +1,61 @@
+package device
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+
+	"github.com/google/uuid"
+)
+
+type (
+	// Device identifies the computer the client runs on
+	Device struct {
+		ID   string `json:"id"`
+		Name string `json:"name"`
+	}
+)
+
+// Load reads the identity of the device, it is created on the first call
+func Load(path string) (Device, error) {
+	content, err := os.ReadFile(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return create(path)
+		}
+		return Device{}, fmt.Errorf("failed to open device identity: %w", err)
+	}
+
+	var d Device
+	if err := json.Unmarshal(content, &d); err != nil {
+		return Device{}, fmt.Errorf("corrupted device identity (%s): %w", path, err)
+	}
+
+	return d, nil
+}
+
+func create(path string) (Device, error) {
+	name, err := os.Hostname()
+	if err != nil || len(name) == 0 {
+		name = "unknown"
+	}
+
+	d := Device{
+		ID:   uuid.NewString(),
+		Name: name,
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0740)
+	if err != nil {
+		return Device{}, fmt.Errorf("failed to create device identity: %w", err)
+	}
+	defer f.Close()
+
+	e := json.NewEncoder(f)
+	if err := e.Encode(d); err != nil {
+		return Device{}, fmt.Errorf("failed to write device identity: %w", err)
+	}
+
+	return d, nil
+}
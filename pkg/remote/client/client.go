@@ -2,21 +2,24 @@ package client
 
 import (
 	"bytes"
+	"cloudsave/pkg/constants"
 	"cloudsave/pkg/remote/obj"
 	"cloudsave/pkg/repository"
+	"cloudsave/pkg/tools/hash"
 	customtime "cloudsave/pkg/tools/time"
+	"crypto"
 	"encoding/json"
 	"errors"
 	"fmt"
 	"io"
+	"log/slog"
 	"mime/multipart"
 	"net/http"
 	"net/url"
-	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
-
-	"github.com/schollz/progressbar/v3"
 )
 
 type (
@@ -24,6 +27,23 @@ type (
 		baseURL  string
 		username string
 		password string
+
+		mu sync.Mutex
+		// api is the API version of the server, 0 until it is asked
+		api int
+	}
+
+	// ConflictError is returned when the archive on the server is not the
+	// one the push is based on. Remote holds the current metadata of the server.
+	ConflictError struct {
+		Remote repository.Metadata
+	}
+
+	// ChecksumError is returned when a downloaded archive does not match
+	// the digest sent by the server
+	ChecksumError struct {
+		Expected string
+		Actual   string
 	}
 
 	Information struct {
@@ -38,8 +58,28 @@ type (
 var (
 	ErrNotFound     error = errors.New("not found")
 	ErrUnauthorized error = errors.New("unauthorized (HTTP Error 401)")
+	ErrConflict     error = errors.New("the remote archive has been modified (HTTP Error 409)")
+	ErrTooLarge     error = errors.New("the archive is larger than the server accepts (HTTP Error 413)")
+	ErrChecksum     error = errors.New("the archive does not match its digest")
+	ErrRejected     error = errors.New("the server rejected the archive, it is damaged (HTTP Error 422)")
 )
 
+func (e *ConflictError) Error() string {
+	return fmt.Sprintf("%s: remote version is %d", ErrConflict, e.Remote.Version)
+}
+
+func (e *ConflictError) Is(target error) bool {
+	return target == ErrConflict
+}
+
+func (e *ChecksumError) Error() string {
+	return fmt.Sprintf("%s: got %s, expected %s", ErrChecksum, e.Actual, e.Expected)
+}
+
+func (e *ChecksumError) Is(target error) bool {
+	return target == ErrChecksum
+}
+
 func New(baseURL, username, password string) *Client {
 	return &Client{
 		baseURL:  baseURL,
@@ -104,6 +144,27 @@ func (c *Client) Version() (Information, error) {
 	return Information{}, errors.New("invalid payload sent by the server")
 }
 
+// algorithm returns the algorithm of the digests sent to the server, the
+// servers before digestAPIVersion only know md5
+func (c *Client) algorithm() crypto.Hash {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.api == 0 {
+		info, err := c.Version()
+		if err != nil {
+			slog.Debug("failed to get the API version of the server", "err", err)
+			return crypto.MD5
+		}
+		c.api = info.APIVersion
+	}
+
+	if c.api < digestAPIVersion {
+		return crypto.MD5
+	}
+	return hash.Default
+}
+
 // Deprecated: use c.Metadata instead
 func (c *Client) Hash(gameID string) (string, error) {
 	m, err := c.Metadata(gameID)
@@ -125,35 +186,31 @@ func (c *Client) Metadata(gameID string) (repository.Metadata, error) {
 	}
 
 	if m, ok := (o.Data).(map[string]any); ok {
-		gm := repository.Metadata{
-			ID:      m["id"].(string),
-			Name:    m["name"].(string),
-			Version: int(m["version"].(float64)),
-			Date:    customtime.MustParse(time.RFC3339, m["date"].(string)),
-			MD5:     m["md5"].(string),
-		}
-		return gm, nil
+		return parseMetadata(m), nil
 	}
 
 	return repository.Metadata{}, errors.New("invalid payload sent by the server")
 }
 
-func (c *Client) PushSave(archivePath string, m repository.Metadata) error {
-	u, err := url.JoinPath(c.baseURL, "api", "v1", "games", m.ID, "data")
-	if err != nil {
-		return err
-	}
-
-	return c.push(u, archivePath, m)
+// PushSave sends the archive of a game. base is the hash of the remote archive
+// the local archive is based on: if the remote archive has been modified since,
+// the push is rejected with a *ConflictError. An empty base disables the check.
+func (c *Client) PushSave(archive io.Reader, m repository.Metadata, base string) error {
+	return c.send(archive, m, "", base)
 }
 
-func (c *Client) PushBackup(archiveMetadata repository.Backup, m repository.Metadata) error {
-	u, err := url.JoinPath(c.baseURL, "api", "v1", "games", m.ID, "hist", archiveMetadata.UUID, "data")
-	if err != nil {
-		return err
+func (c *Client) PushBackup(archive io.Reader, archiveMetadata repository.Backup, m repository.Metadata) error {
+	// send the metadata of the game at the time of the backup when known
+	if archiveMetadata.Version > 0 {
+		m.Version = archiveMetadata.Version
+		m.Date = archiveMetadata.Date
+		m.Parent = archiveMetadata.Parent
+		m.Device = archiveMetadata.Device
 	}
+	m.Label = archiveMetadata.Label
+	m.Conflict = archiveMetadata.Conflict
 
-	return c.push(u, archiveMetadata.ArchivePath, m)
+	return c.send(archive, m, archiveMetadata.UUID, "")
 }
 
 func (c *Client) ListArchives(gameID string) ([]string, error) {
@@ -199,109 +256,55 @@ func (c *Client) ArchiveInfo(gameID, uuid string) (repository.Backup, error) {
 			CreatedAt: customtime.MustParse(time.RFC3339, m["created_at"].(string)),
 			MD5:       m["md5"].(string),
 		}
+		if v, ok := m["digest"].(string); ok {
+			b.Digest = v
+		}
+		if v, ok := m["size"].(float64); ok {
+			b.Size = int64(v)
+		}
+		if v, ok := m["version"].(float64); ok {
+			b.Version = int(v)
+		}
+		if v, ok := m["date"].(string); ok {
+			b.Date = customtime.MustParse(time.RFC3339, v)
+		}
+		if v, ok := m["parent"].(string); ok {
+			b.Parent = v
+		}
+		if v, ok := m["device"].(string); ok {
+			b.Device = v
+		}
+		if v, ok := m["label"].(string); ok {
+			b.Label = v
+		}
+		if v, ok := m["conflict"].(bool); ok {
+			b.Conflict = v
+		}
 		return b, nil
 	}
 
 	return repository.Backup{}, errors.New("invalid payload sent by the server")
 }
 
+// Pull downloads the current archive of the game to archivePath, an
+// interrupted download resumes from archivePath + ".part" (see download)
 func (c *Client) Pull(gameID, archivePath string) error {
 	u, err := url.JoinPath(c.baseURL, "api", "v1", "games", gameID, "data")
 	if err != nil {
 		return err
 	}
 
-	cli := http.Client{}
-
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return err
-	}
-
-	req.SetBasicAuth(c.username, c.password)
-
-	f, err := os.OpenFile(archivePath+".part", os.O_CREATE|os.O_WRONLY, 0740)
-	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
-	}
-	defer f.Close()
-
-	res, err := cli.Do(req)
-	if err != nil {
-		return fmt.Errorf("cannot connect to remote: %w", err)
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		return fmt.Errorf("cannot connect to remote: server return code: %s", res.Status)
-	}
-
-	bar := progressbar.DefaultBytes(
-		res.ContentLength,
-		"Pulling...",
-	)
-	defer bar.Close()
-
-	if _, err := io.Copy(io.MultiWriter(f, bar), res.Body); err != nil {
-		return fmt.Errorf("an error occured while copying the file from the remote: %w", err)
-	}
-
-	if err := os.Rename(archivePath+".part", archivePath); err != nil {
-		return fmt.Errorf("failed to move temporary data: %w", err)
-	}
-
-	return nil
+	return c.download(u, archivePath)
 }
 
+// PullBackup downloads a backup of the game to archivePath, see Pull
 func (c *Client) PullBackup(gameID, uuid, archivePath string) error {
 	u, err := url.JoinPath(c.baseURL, "api", "v1", "games", gameID, "hist", uuid, "data")
 	if err != nil {
 		return err
 	}
 
-	cli := http.Client{}
-
-	req, err := http.NewRequest("GET", u, nil)
-	if err != nil {
-		return err
-	}
-
-	req.SetBasicAuth(c.username, c.password)
-
-	f, err := os.OpenFile(archivePath+".part", os.O_CREATE|os.O_WRONLY, 0740)
-	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
-	}
-
-	res, err := cli.Do(req)
-	if err != nil {
-		f.Close()
-		return fmt.Errorf("cannot connect to remote: %w", err)
-	}
-	defer res.Body.Close()
-
-	if res.StatusCode != http.StatusOK {
-		f.Close()
-		return fmt.Errorf("cannot connect to remote: server return code: %s", res.Status)
-	}
-
-	bar := progressbar.DefaultBytes(
-		res.ContentLength,
-		"Pulling...",
-	)
-	defer bar.Close()
-
-	if _, err := io.Copy(io.MultiWriter(f, bar), res.Body); err != nil {
-		f.Close()
-		return fmt.Errorf("an error occured while copying the file from the remote: %w", err)
-	}
-	f.Close()
-
-	if err := os.Rename(archivePath+".part", archivePath); err != nil {
-		return fmt.Errorf("failed to move temporary data: %w", err)
-	}
-
-	return nil
+	return c.download(u, archivePath)
 }
 
 func (c *Client) Ping() error {
@@ -350,14 +353,7 @@ func (c *Client) All() ([]repository.Metadata, error) {
 		var res []repository.Metadata
 		for _, g := range games {
 			if v, ok := g.(map[string]any); ok {
-				gm := repository.Metadata{
-					ID:      v["id"].(string),
-					Name:    v["name"].(string),
-					Version: int(v["version"].(float64)),
-					Date:    customtime.MustParse(time.RFC3339, v["date"].(string)),
-					MD5:     v["md5"].(string),
-				}
-				res = append(res, gm)
+				res = append(res, parseMetadata(v))
 			}
 		}
 
@@ -405,42 +401,65 @@ func (c *Client) get(url string) (obj.HTTPObject, error) {
 	return httpObject, nil
 }
 
-func (c *Client) push(u, archivePath string, m repository.Metadata) error {
-	f, err := os.OpenFile(archivePath, os.O_RDONLY, 0)
+// push streams the archive in a multipart form, the metadata are sent before
+// the payload so that the server does not have to keep the archive aside
+func (c *Client) push(u string, f io.Reader, m repository.Metadata, base string) error {
+	values, err := fields(m)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		return err
 	}
-	defer f.Close()
 
 	buf := new(bytes.Buffer)
 	writer := multipart.NewWriter(buf)
 
-	part, err := writer.CreateFormFile("payload", "data.tar.gz")
-	if err != nil {
-		return err
+	for k, v := range values {
+		writer.WriteField(k, v[0])
 	}
 
-	if _, err := io.Copy(part, f); err != nil {
-		return fmt.Errorf("failed to copy data: %w", err)
+	if _, err := writer.CreateFormFile("payload", "data.tar.gz"); err != nil {
+		return err
 	}
 
-	writer.WriteField("name", m.Name)
-	writer.WriteField("version", strconv.Itoa(m.Version))
-	writer.WriteField("date", m.Date.Format(time.RFC3339))
+	// the closing boundary, as written by writer.Close
+	tail := fmt.Sprintf("\r\n--%s--\r\n", writer.Boundary())
+
+	cli := http.Client{}
 
-	if err := writer.Close(); err != nil {
+	// the digest is sent in a trailer when the archive cannot be read twice
+	alg := c.algorithm()
+	sum, ok, err := digest(f, alg)
+	if err != nil {
 		return err
 	}
+	body := io.Reader(f)
+	d := &digester{r: f, h: hash.NewHasher(alg), alg: alg}
+	if !ok {
+		body = d
+	}
 
-	cli := http.Client{}
-
-	req, err := http.NewRequest("POST", u, buf)
+	req, err := http.NewRequest("POST", u, io.MultiReader(buf, body, strings.NewReader(tail)))
 	if err != nil {
 		return err
 	}
 
+	// the length is unknown when the archive cannot be measured, the body
+	// is then sent in chunks
+	if size, ok := remaining(f); ok {
+		req.ContentLength = int64(buf.Len()) + size + int64(len(tail))
+	}
+
 	req.SetBasicAuth(c.username, c.password)
 	req.Header.Set("Content-Type", writer.FormDataContentType())
+	req.Header.Set(versionHeader, strconv.Itoa(constants.ApiVersion))
+	if len(base) > 0 {
+		req.Header.Set("If-Match", strconv.Quote(base))
+	}
+	if ok {
+		req.Header.Set(digestHeader, hash.ReprDigest(sum))
+	} else {
+		req.Trailer = http.Header{digestHeader: nil}
+		d.trailer = req.Trailer
+	}
 
 	res, err := cli.Do(req)
 	if err != nil {
@@ -448,9 +467,141 @@ func (c *Client) push(u, archivePath string, m repository.Metadata) error {
 	}
 	defer res.Body.Close()
 
+	return pushed(res)
+}
+
+// fields returns the metadata sent with an archive
+func fields(m repository.Metadata) (url.Values, error) {
+	values := url.Values{}
+	values.Set("name", m.Name)
+	values.Set("version", strconv.Itoa(m.Version))
+	values.Set("date", m.Date.Format(time.RFC3339))
+	if len(m.Parent) > 0 {
+		values.Set("parent", m.Parent)
+	}
+	if len(m.Device) > 0 {
+		values.Set("device", m.Device)
+	}
+	if len(m.Label) > 0 {
+		values.Set("label", m.Label)
+	}
+	if m.Conflict {
+		values.Set("conflict", "true")
+	}
+	// the save directory of each device, so that a new device can reuse them
+	if len(m.Paths) > 0 {
+		v, err := json.Marshal(m.Paths)
+		if err != nil {
+			return nil, err
+		}
+		values.Set("paths", string(v))
+	}
+	if len(m.Roots) > 0 {
+		v, err := json.Marshal(m.Roots)
+		if err != nil {
+			return nil, err
+		}
+		values.Set("roots", string(v))
+	}
+	return values, nil
+}
+
+// pushed returns the error of the response to a push
+func pushed(res *http.Response) error {
+	if res.StatusCode == http.StatusConflict {
+		var httpObject obj.HTTPObject
+		d := json.NewDecoder(res.Body)
+		if err := d.Decode(&httpObject); err != nil {
+			return fmt.Errorf("%w: %w", ErrConflict, err)
+		}
+		if v, ok := (httpObject.Data).(map[string]any); ok {
+			return &ConflictError{Remote: parseMetadata(v)}
+		}
+		return ErrConflict
+	}
+
+	if res.StatusCode == http.StatusRequestEntityTooLarge {
+		return ErrTooLarge
+	}
+
+	if res.StatusCode == http.StatusUnprocessableEntity {
+		return ErrRejected
+	}
+
 	if res.StatusCode != 201 {
 		return fmt.Errorf("server returns an unexpected status code: %s (expected 201)", res.Status)
 	}
 
 	return nil
 }
+
+// remaining returns the number of bytes left to read in r, if it can seek
+func remaining(r io.Reader) (int64, bool) {
+	s, ok := r.(io.Seeker)
+	if !ok {
+		return 0, false
+	}
+
+	cur, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return 0, false
+	}
+	end, err := s.Seek(0, io.SeekEnd)
+	if err != nil {
+		return 0, false
+	}
+	if _, err := s.Seek(cur, io.SeekStart); err != nil {
+		return 0, false
+	}
+	return end - cur, true
+}
+
+func parseMetadata(m map[string]any) repository.Metadata {
+	gm := repository.Metadata{
+		ID:      m["id"].(string),
+		Name:    m["name"].(string),
+		Version: int(m["version"].(float64)),
+		Date:    customtime.MustParse(time.RFC3339, m["date"].(string)),
+	}
+	if v, ok := m["md5"].(string); ok {
+		gm.MD5 = v
+	}
+	if v, ok := m["digest"].(string); ok {
+		gm.Digest = v
+	}
+	if v, ok := m["parent"].(string); ok {
+		gm.Parent = v
+	}
+	if v, ok := m["device"].(string); ok {
+		gm.Device = v
+	}
+	if v, ok := m["paths"].(map[string]any); ok {
+		gm.Paths = parsePaths(v)
+	}
+	if v, ok := m["roots"].([]any); ok {
+		for _, r := range v {
+			r, ok := r.(map[string]any)
+			if !ok {
+				continue
+			}
+			var root repository.Root
+			root.Name, _ = r["name"].(string)
+			root.Path, _ = r["path"].(string)
+			if p, ok := r["paths"].(map[string]any); ok {
+				root.Paths = parsePaths(p)
+			}
+			gm.Roots = append(gm.Roots, root)
+		}
+	}
+	return gm
+}
+
+func parsePaths(m map[string]any) map[string]string {
+	res := make(map[string]string)
+	for k, v := range m {
+		if v, ok := v.(string); ok {
+			res[k] = v
+		}
+	}
+	return res
+}
@@ -0,0 +1,197 @@
+package client
+
+import (
+	"bytes"
+	"cloudsave/pkg/remote/obj"
+	"cloudsave/pkg/repository"
+	customtime "cloudsave/pkg/tools/time"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+type (
+	// LockError is returned when another device holds the lease of the game.
+	// Lease is the lease of that device.
+	LockError struct {
+		Lease repository.Lease
+	}
+)
+
+var (
+	ErrLocked error = errors.New("the game is checked out by another device (HTTP Error 409)")
+)
+
+func (e *LockError) Error() string {
+	return fmt.Sprintf("the game is checked out by %s since %s", e.Lease.Device, e.Lease.Since.Local().Format(time.DateTime))
+}
+
+func (e *LockError) Is(target error) bool {
+	return target == ErrLocked
+}
+
+// Lease returns the lease of the game, nil if nobody holds it or if the
+// server does not know the game
+func (c *Client) Lease(gameID string) (*repository.Lease, error) {
+	u, err := url.JoinPath(c.baseURL, "api", "v1", "games", gameID, "lock")
+	if err != nil {
+		return nil, err
+	}
+
+	o, err := c.get(u)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil, nil
+		}
+		return nil, err
+	}
+
+	if v, ok := (o.Data).(map[string]any); ok {
+		l := parseLease(v)
+		return &l, nil
+	}
+
+	return nil, errors.New("invalid payload sent by the server")
+}
+
+// Lock takes the lease of the game for the device during ttl, a *LockError
+// is returned if another device holds it, unless steal is set. ErrNotFound
+// is returned if the server does not know the game or does not support
+// the leases.
+func (c *Client) Lock(gameID, deviceID, device string, ttl time.Duration, steal bool) (repository.Lease, error) {
+	return c.lease(http.MethodPost, gameID, obj.LeaseRequest{
+		DeviceID: deviceID,
+		Device:   device,
+		TTL:      int64(ttl / time.Second),
+		Steal:    steal,
+	})
+}
+
+// Renew extends the lease the device holds by ttl. ErrNotFound is returned
+// if the lease was lost, a *LockError if another device took it.
+func (c *Client) Renew(gameID, deviceID string, ttl time.Duration) (repository.Lease, error) {
+	return c.lease(http.MethodPut, gameID, obj.LeaseRequest{
+		DeviceID: deviceID,
+		TTL:      int64(ttl / time.Second),
+	})
+}
+
+// Unlock releases the lease the device holds, the lease of another device
+// is only released if force is set
+func (c *Client) Unlock(gameID, deviceID string, force bool) error {
+	u, err := url.JoinPath(c.baseURL, "api", "v1", "games", gameID, "lock")
+	if err != nil {
+		return err
+	}
+	u += "?" + url.Values{"device_id": {deviceID}, "force": {strconv.FormatBool(force)}}.Encode()
+
+	req, err := http.NewRequest(http.MethodDelete, u, nil)
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(c.username, c.password)
+
+	cli := http.Client{}
+
+	res, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNoContent, http.StatusOK:
+		return nil
+	case http.StatusNotFound:
+		return ErrNotFound
+	case http.StatusUnauthorized:
+		return ErrUnauthorized
+	case http.StatusConflict:
+		return lockError(res)
+	}
+
+	return fmt.Errorf("server returns an unexpected status code: %s (expected 204)", res.Status)
+}
+
+func (c *Client) lease(method, gameID string, body obj.LeaseRequest) (repository.Lease, error) {
+	u, err := url.JoinPath(c.baseURL, "api", "v1", "games", gameID, "lock")
+	if err != nil {
+		return repository.Lease{}, err
+	}
+
+	v, err := json.Marshal(body)
+	if err != nil {
+		return repository.Lease{}, err
+	}
+
+	req, err := http.NewRequest(method, u, bytes.NewReader(v))
+	if err != nil {
+		return repository.Lease{}, err
+	}
+
+	req.SetBasicAuth(c.username, c.password)
+	req.Header.Set("Content-Type", "application/json")
+
+	cli := http.Client{}
+
+	res, err := cli.Do(req)
+	if err != nil {
+		return repository.Lease{}, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusNotFound:
+		return repository.Lease{}, ErrNotFound
+	case http.StatusUnauthorized:
+		return repository.Lease{}, ErrUnauthorized
+	case http.StatusConflict:
+		return repository.Lease{}, lockError(res)
+	case http.StatusOK:
+	default:
+		return repository.Lease{}, fmt.Errorf("server returns an unexpected status code: %s (expected 200)", res.Status)
+	}
+
+	var httpObject obj.HTTPObject
+	d := json.NewDecoder(res.Body)
+	if err := d.Decode(&httpObject); err != nil {
+		return repository.Lease{}, err
+	}
+
+	if v, ok := (httpObject.Data).(map[string]any); ok {
+		return parseLease(v), nil
+	}
+
+	return repository.Lease{}, errors.New("invalid payload sent by the server")
+}
+
+// lockError reads the lease of the other device from a conflict response
+func lockError(res *http.Response) error {
+	var httpObject obj.HTTPObject
+	d := json.NewDecoder(res.Body)
+	if err := d.Decode(&httpObject); err != nil {
+		return fmt.Errorf("%w: %w", ErrLocked, err)
+	}
+	if v, ok := (httpObject.Data).(map[string]any); ok {
+		return &LockError{Lease: parseLease(v)}
+	}
+	return ErrLocked
+}
+
+func parseLease(m map[string]any) repository.Lease {
+	var l repository.Lease
+	l.DeviceID, _ = m["device_id"].(string)
+	l.Device, _ = m["device"].(string)
+	if v, ok := m["since"].(string); ok {
+		l.Since = customtime.MustParse(time.RFC3339, v)
+	}
+	if v, ok := m["expires"].(string); ok {
+		l.Expires = customtime.MustParse(time.RFC3339, v)
+	}
+	return l
+}
@@ -0,0 +1,531 @@
+package client
+
+import (
+	"bytes"
+	"cloudsave/pkg/constants"
+	"cloudsave/pkg/remote/obj"
+	"cloudsave/pkg/repository"
+	"cloudsave/pkg/tools/hash"
+	"crypto"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"net/http"
+	"net/url"
+	"os"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/schollz/progressbar/v3"
+)
+
+type (
+	// session is the state of a chunked upload on the server
+	session struct {
+		id     string
+		offset int64
+	}
+
+	// chunk is the body of a request that sends a part of a file. The
+	// transport may still read a body after the response, so the chunk
+	// cannot be read anymore once closed: the file can then be moved to
+	// the next part.
+	chunk struct {
+		mu     sync.Mutex
+		r      io.Reader
+		closed bool
+	}
+
+	// digester hashes an archive as it is sent and sets its digest in
+	// the trailers of the request at the end
+	digester struct {
+		r       io.Reader
+		h       *hash.Hasher
+		alg     crypto.Hash
+		trailer http.Header
+	}
+)
+
+const (
+	// attempts is the number of times a transfer is tried in a row without
+	// progress before it fails, it resumes where it stopped each time
+	attempts = 5
+	// chunkSize is the size of the chunks of an upload, the smaller
+	// archives are sent at once
+	chunkSize int64 = 8 << 20
+	// digestHeader holds the digest of the archives sent and received
+	digestHeader = "Repr-Digest"
+	// versionHeader tells the server the API version of the client
+	versionHeader = "Api-Version"
+	// digestAPIVersion is the first API version that accepts the digests
+	// stronger than md5
+	digestAPIVersion = 2
+)
+
+var (
+	// errUnsupported is returned when the server has no upload sessions
+	errUnsupported error = errors.New("the server does not support the chunked uploads")
+	// errRestart is returned when a partial download cannot be resumed
+	errRestart error = errors.New("the download cannot be resumed")
+)
+
+// download writes the resource to archivePath. The data are received in
+// archivePath + ".part", and the entity tag of the resource is kept next
+// to it: an interrupted download resumes with a range request, unless the
+// resource has changed since.
+func (c *Client) download(u, archivePath string) error {
+	part := archivePath + ".part"
+
+	failures := 0
+	for {
+		before := size(part)
+		retry, err := c.fetch(u, part)
+		if err == nil {
+			break
+		}
+		if !retry {
+			return err
+		}
+
+		if size(part) > before {
+			failures = 0
+		}
+		failures++
+		if failures >= attempts {
+			return err
+		}
+		slog.Warn("download failed, trying again", "err", err)
+		time.Sleep(time.Duration(failures) * time.Second)
+	}
+
+	if err := os.Rename(part, archivePath); err != nil {
+		return fmt.Errorf("failed to move temporary data: %w", err)
+	}
+	os.Remove(part + ".etag")
+
+	return nil
+}
+
+// fetch receives the rest of the resource in part, it tells whether
+// the download can be tried again when it fails
+func (c *Client) fetch(u, part string) (bool, error) {
+	f, err := os.OpenFile(part, os.O_CREATE|os.O_WRONLY, 0740)
+	if err != nil {
+		return false, fmt.Errorf("failed to open file: %w", err)
+	}
+	defer f.Close()
+
+	offset, err := f.Seek(0, io.SeekEnd)
+	if err != nil {
+		return false, fmt.Errorf("failed to open file: %w", err)
+	}
+
+	// the data cannot be resumed without the entity tag they come from
+	validator, err := os.ReadFile(part + ".etag")
+	if err != nil || len(validator) == 0 {
+		offset = 0
+	}
+
+	cli := http.Client{}
+
+	req, err := http.NewRequest("GET", u, nil)
+	if err != nil {
+		return false, err
+	}
+
+	req.SetBasicAuth(c.username, c.password)
+	if offset > 0 {
+		req.Header.Set("Range", fmt.Sprintf("bytes=%d-", offset))
+		req.Header.Set("If-Range", string(validator))
+	}
+
+	res, err := cli.Do(req)
+	if err != nil {
+		return true, fmt.Errorf("cannot connect to remote: %w", err)
+	}
+	defer res.Body.Close()
+
+	switch {
+	case res.StatusCode == http.StatusPartialContent:
+		if start, ok := rangeStart(res.Header.Get("Content-Range")); !ok || start != offset {
+			return true, restart(f, part)
+		}
+	case res.StatusCode == http.StatusOK:
+		// the resource has changed, or the server does not support ranges
+		offset = 0
+		if err := f.Truncate(0); err != nil {
+			return false, fmt.Errorf("failed to truncate file: %w", err)
+		}
+		if _, err := f.Seek(0, io.SeekStart); err != nil {
+			return false, fmt.Errorf("failed to truncate file: %w", err)
+		}
+		if err := os.WriteFile(part+".etag", []byte(res.Header.Get("ETag")), 0740); err != nil {
+			return false, fmt.Errorf("failed to keep the entity tag: %w", err)
+		}
+	case res.StatusCode == http.StatusRequestedRangeNotSatisfiable:
+		return true, restart(f, part)
+	case res.StatusCode >= 500:
+		return true, fmt.Errorf("cannot connect to remote: server return code: %s", res.Status)
+	default:
+		return false, fmt.Errorf("cannot connect to remote: server return code: %s", res.Status)
+	}
+
+	size := int64(-1)
+	if res.ContentLength >= 0 {
+		size = offset + res.ContentLength
+	}
+	bar := progressbar.DefaultBytes(size, "Pulling...")
+	defer bar.Close()
+	bar.Set64(offset)
+
+	if _, err := io.Copy(io.MultiWriter(f, bar), res.Body); err != nil {
+		return true, fmt.Errorf("an error occured while copying the file from the remote: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return false, fmt.Errorf("failed to write file: %w", err)
+	}
+
+	// the servers that do not send a digest are trusted
+	digests := hash.ParseReprDigest(res.Header.Get(digestHeader))
+	if len(digests) == 0 {
+		return false, nil
+	}
+
+	expected := digests[0]
+	alg, _, _ := hash.ParseDigest(expected)
+	actual, err := hash.FileDigest(part, alg)
+	if err != nil {
+		return false, fmt.Errorf("failed to hash the downloaded archive: %w", err)
+	}
+	if actual != expected {
+		// the download starts again from zero
+		if err := os.Truncate(part, 0); err != nil {
+			return false, fmt.Errorf("failed to truncate file: %w", err)
+		}
+		os.Remove(part + ".etag")
+		return true, &ChecksumError{Expected: expected, Actual: actual}
+	}
+
+	return false, nil
+}
+
+// size returns the size of the file, 0 if it does not exist
+func size(path string) int64 {
+	fi, err := os.Stat(path)
+	if err != nil {
+		return 0
+	}
+	return fi.Size()
+}
+
+// digest returns the digest of the rest of the archive, f is left where it
+// was. It returns false if the archive cannot be read twice.
+func digest(f io.Reader, alg crypto.Hash) (string, bool, error) {
+	s, ok := f.(io.Seeker)
+	if !ok {
+		return "", false, nil
+	}
+
+	start, err := s.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return "", false, nil
+	}
+
+	h := hash.NewHasher(alg)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", false, fmt.Errorf("failed to hash the archive: %w", err)
+	}
+	if _, err := s.Seek(start, io.SeekStart); err != nil {
+		return "", false, err
+	}
+	return h.Digest(alg), true, nil
+}
+
+func (d *digester) Read(p []byte) (int, error) {
+	n, err := d.r.Read(p)
+	d.h.Write(p[:n])
+	if errors.Is(err, io.EOF) {
+		d.trailer.Set(digestHeader, hash.ReprDigest(d.h.Digest(d.alg)))
+	}
+	return n, err
+}
+
+// restart drops the partial data, the next attempt starts from zero
+func restart(f *os.File, part string) error {
+	if err := f.Truncate(0); err != nil {
+		return fmt.Errorf("failed to truncate file: %w", err)
+	}
+	os.Remove(part + ".etag")
+	return errRestart
+}
+
+// rangeStart returns the first byte of a Content-Range header (bytes N-M/T)
+func rangeStart(v string) (int64, bool) {
+	v, ok := strings.CutPrefix(v, "bytes ")
+	if !ok {
+		return 0, false
+	}
+	v, _, ok = strings.Cut(v, "-")
+	if !ok {
+		return 0, false
+	}
+	start, err := strconv.ParseInt(v, 10, 64)
+	return start, err == nil
+}
+
+// send pushes the archive as the current one (backupID is empty) or as
+// a backup. The large archives are sent in chunks that are sent again
+// when the connection is lost, if the server supports it.
+func (c *Client) send(f io.Reader, m repository.Metadata, backupID, base string) error {
+	if size, ok := remaining(f); ok && size > chunkSize {
+		err := c.upload(f.(io.ReadSeeker), size, m, backupID, base)
+		if !errors.Is(err, errUnsupported) {
+			return err
+		}
+		slog.Debug("the server has no upload sessions, the archive is sent at once")
+	}
+
+	elem := []string{"api", "v1", "games", m.ID, "data"}
+	if len(backupID) > 0 {
+		elem = []string{"api", "v1", "games", m.ID, "hist", backupID, "data"}
+	}
+	u, err := url.JoinPath(c.baseURL, elem...)
+	if err != nil {
+		return err
+	}
+
+	return c.push(u, f, m, base)
+}
+
+// upload sends the size bytes of f in an upload session, then commits it
+// with the metadata and the digest of the data. f is left where it was if
+// errUnsupported is returned.
+func (c *Client) upload(f io.ReadSeeker, size int64, m repository.Metadata, backupID, base string) error {
+	start, err := f.Seek(0, io.SeekCurrent)
+	if err != nil {
+		return err
+	}
+
+	alg := c.algorithm()
+	h := hash.NewHasher(alg)
+	if _, err := io.Copy(h, io.LimitReader(f, size)); err != nil {
+		return fmt.Errorf("failed to hash the archive: %w", err)
+	}
+	sum := h.Digest(alg)
+	if _, err := f.Seek(start, io.SeekStart); err != nil {
+		return err
+	}
+
+	s, err := c.createSession(m.ID, size)
+	if err != nil {
+		return err
+	}
+
+	failures := 0
+	for s.offset < size {
+		if _, err := f.Seek(start+s.offset, io.SeekStart); err != nil {
+			return err
+		}
+
+		n := min(chunkSize, size-s.offset)
+		next, err := c.putChunk(m.ID, s, io.LimitReader(f, n), n)
+		if err == nil {
+			s, failures = next, 0
+			continue
+		}
+
+		// the server may have received a part of the chunk
+		if next, err := c.sessionStatus(m.ID, s); err == nil {
+			if next.offset > s.offset {
+				failures = 0
+			}
+			s = next
+		}
+
+		failures++
+		if failures >= attempts {
+			c.abortSession(m.ID, s)
+			return fmt.Errorf("failed to upload the archive: %w", err)
+		}
+		slog.Warn("upload interrupted, resuming", "err", err)
+		time.Sleep(time.Duration(failures) * time.Second)
+	}
+
+	values, err := fields(m)
+	if err != nil {
+		return err
+	}
+	if len(backupID) > 0 {
+		values.Set("backup", backupID)
+	}
+
+	u, err := url.JoinPath(c.baseURL, "api", "v1", "games", m.ID, "uploads", s.id, "commit")
+	if err != nil {
+		return err
+	}
+
+	req, err := http.NewRequest("POST", u, strings.NewReader(values.Encode()))
+	if err != nil {
+		return err
+	}
+
+	req.SetBasicAuth(c.username, c.password)
+	req.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	req.Header.Set(versionHeader, strconv.Itoa(constants.ApiVersion))
+	req.Header.Set(digestHeader, hash.ReprDigest(sum))
+	if len(base) > 0 {
+		req.Header.Set("If-Match", strconv.Quote(base))
+	}
+
+	cli := http.Client{}
+
+	res, err := cli.Do(req)
+	if err != nil {
+		return err
+	}
+	defer res.Body.Close()
+
+	return pushed(res)
+}
+
+func (c *Client) createSession(gameID string, size int64) (session, error) {
+	u, err := url.JoinPath(c.baseURL, "api", "v1", "games", gameID, "uploads")
+	if err != nil {
+		return session{}, err
+	}
+
+	v, err := json.Marshal(obj.UploadRequest{Size: size})
+	if err != nil {
+		return session{}, err
+	}
+
+	s, err := c.session("POST", u, bytes.NewReader(v), int64(len(v)))
+	if errors.Is(err, ErrNotFound) {
+		return session{}, errUnsupported
+	}
+	return s, err
+}
+
+func (c *Client) sessionStatus(gameID string, s session) (session, error) {
+	u, err := url.JoinPath(c.baseURL, "api", "v1", "games", gameID, "uploads", s.id)
+	if err != nil {
+		return session{}, err
+	}
+
+	return c.session("GET", u, nil, 0)
+}
+
+// putChunk appends the n bytes of r to the session
+func (c *Client) putChunk(gameID string, s session, r io.Reader, n int64) (session, error) {
+	u, err := url.JoinPath(c.baseURL, "api", "v1", "games", gameID, "uploads", s.id)
+	if err != nil {
+		return session{}, err
+	}
+	u += "?offset=" + strconv.FormatInt(s.offset, 10)
+
+	body := &chunk{r: r}
+	defer body.Close()
+
+	return c.session("PUT", u, body, n)
+}
+
+func (c *chunk) Read(p []byte) (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	if c.closed {
+		return 0, io.ErrClosedPipe
+	}
+	return c.r.Read(p)
+}
+
+// Close waits for the read in progress, if any
+func (c *chunk) Close() error {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	c.closed = true
+	return nil
+}
+
+// abortSession removes the session, the server removes it anyway once
+// it is abandoned
+func (c *Client) abortSession(gameID string, s session) {
+	u, err := url.JoinPath(c.baseURL, "api", "v1", "games", gameID, "uploads", s.id)
+	if err != nil {
+		return
+	}
+
+	req, err := http.NewRequest("DELETE", u, nil)
+	if err != nil {
+		return
+	}
+
+	req.SetBasicAuth(c.username, c.password)
+
+	cli := http.Client{}
+
+	res, err := cli.Do(req)
+	if err != nil {
+		slog.Debug("failed to abort the upload", "err", err)
+		return
+	}
+	res.Body.Close()
+}
+
+// session sends a request about an upload session and returns its state,
+// the state is also returned when the offset was not the one of the server
+func (c *Client) session(method, u string, body io.Reader, n int64) (session, error) {
+	req, err := http.NewRequest(method, u, body)
+	if err != nil {
+		return session{}, err
+	}
+
+	req.SetBasicAuth(c.username, c.password)
+	if body != nil {
+		req.ContentLength = n
+	}
+
+	cli := http.Client{}
+
+	res, err := cli.Do(req)
+	if err != nil {
+		return session{}, err
+	}
+	defer res.Body.Close()
+
+	switch res.StatusCode {
+	case http.StatusOK, http.StatusConflict:
+	case http.StatusNotFound, http.StatusMethodNotAllowed:
+		return session{}, ErrNotFound
+	case http.StatusUnauthorized:
+		return session{}, ErrUnauthorized
+	case http.StatusRequestEntityTooLarge:
+		return session{}, ErrTooLarge
+	default:
+		return session{}, fmt.Errorf("server returns an unexpected status code: %s (expected 200)", res.Status)
+	}
+
+	var httpObject obj.HTTPObject
+	d := json.NewDecoder(res.Body)
+	if err := d.Decode(&httpObject); err != nil {
+		return session{}, err
+	}
+
+	v, ok := (httpObject.Data).(map[string]any)
+	if !ok {
+		return session{}, errors.New("invalid payload sent by the server")
+	}
+
+	var s session
+	s.id, _ = v["id"].(string)
+	if offset, ok := v["offset"].(float64); ok {
+		s.offset = int64(offset)
+	}
+	return s, nil
+}
@@ -19,4 +19,18 @@ type (
 		HTTPCore
 		Data any `json:"data"`
 	}
+
+	// UploadRequest starts a chunked upload of Size bytes
+	UploadRequest struct {
+		Size int64 `json:"size"`
+	}
+
+	// LeaseRequest is the body of the requests that take or renew the lease
+	// of a game, TTL is in seconds
+	LeaseRequest struct {
+		DeviceID string `json:"device_id"`
+		Device   string `json:"device,omitempty"`
+		TTL      int64  `json:"ttl,omitempty"`
+		Steal    bool   `json:"steal,omitempty"`
+	}
 )
@@ -10,8 +10,11 @@ import (
 
 type (
 	Remote struct {
-		URL    string `json:"url"`
-		GameID string `json:"-"`
+		URL string `json:"url"`
+		// Backups are the backups known to be on the server, they are not
+		// pushed again once the server removed them
+		Backups []string `json:"backups,omitempty"`
+		GameID  string   `json:"-"`
 	}
 )
 
@@ -57,11 +60,30 @@ func One(gameID string) (Remote, error) {
 	return r, nil
 }
 
+// Set changes the server of the game, the backups known to be on the
+// previous server are forgotten
 func Set(gameID, url string) error {
-	r := Remote{
-		URL: url,
+	// a missing or corrupted remote is replaced
+	r, err := One(gameID)
+	if err != nil || r.URL != url {
+		r = Remote{URL: url}
 	}
 
+	return save(gameID, r)
+}
+
+// SetBackups keeps the backups known to be on the server
+func SetBackups(gameID string, backups []string) error {
+	r, err := One(gameID)
+	if err != nil {
+		return err
+	}
+	r.Backups = backups
+
+	return save(gameID, r)
+}
+
+func save(gameID string, r Remote) error {
 	f, err := os.OpenFile(filepath.Join(datastorepath, gameID, "remote.json"), os.O_WRONLY|os.O_CREATE|os.O_TRUNC, 0740)
 	if err != nil {
 		return err
@@ -0,0 +1,623 @@
+package repository
+
+import (
+	"cloudsave/pkg/tools/hash"
+	"crypto"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+	"sync"
+)
+
+const (
+	minChunkSize = 16 << 10
+	maxChunkSize = 256 << 10
+	// the average size of a chunk is 64 KiB
+	chunkMask = (1 << 16) - 1
+)
+
+type (
+	// ChunkRepository stores the archives as content-defined chunks, shared
+	// between every game and every backup of the datastore. The metadata are
+	// stored like in the LazyRepository, but the archive of each game and backup
+	// is replaced by a manifest listing the chunks.
+	ChunkRepository struct {
+		*LazyRepository
+
+		chunkRoot string
+		// writers hold a read lock until the manifest is written, the garbage
+		// collector holds the write lock
+		mu sync.RWMutex
+	}
+
+	manifest struct {
+		Size   int64      `json:"size"`
+		MD5    string     `json:"md5"`
+		Digest string     `json:"digest,omitempty"`
+		Chunks []chunkRef `json:"chunks"`
+	}
+
+	chunkRef struct {
+		Hash string `json:"hash"`
+		Size int64  `json:"size"`
+	}
+
+	chunkWriter struct {
+		repo   *ChunkRepository
+		path   string
+		locked bool
+		buf    []byte
+		fp     uint64
+		hasher *hash.Hasher
+		m      manifest
+		err    error
+		closed bool
+	}
+
+	chunkReader struct {
+		repo    *ChunkRepository
+		m       manifest
+		offsets []int64
+		pos     int64
+		idx     int
+		data    []byte
+	}
+
+	chunkTransaction struct {
+		*stagedTransaction
+		repo     *ChunkRepository
+		released bool
+	}
+
+	// GarbageCollector is implemented by the repositories that share data
+	// between the games and need to remove the unreferenced data
+	GarbageCollector interface {
+		GC() (int, error)
+	}
+)
+
+var gear [256]uint64
+
+func init() {
+	// splitmix64, the table must never change: the chunk boundaries depend on it
+	var seed uint64 = 0x636c6f7564736176
+	for i := range gear {
+		seed += 0x9e3779b97f4a7c15
+		z := seed
+		z = (z ^ (z >> 30)) * 0xbf58476d1ce4e5b9
+		z = (z ^ (z >> 27)) * 0x94d049bb133111eb
+		gear[i] = z ^ (z >> 31)
+	}
+}
+
+func NewChunkRepository(dataRootPath, chunkRootPath string) (*ChunkRepository, error) {
+	l, err := NewLazyRepository(dataRootPath)
+	if err != nil {
+		return nil, err
+	}
+
+	if err := os.MkdirAll(chunkRootPath, 0740); err != nil {
+		return nil, fmt.Errorf("failed to make the chunk directory: %w", err)
+	}
+
+	return &ChunkRepository{
+		LazyRepository: l,
+		chunkRoot:      chunkRootPath,
+	}, nil
+}
+
+func (c *ChunkRepository) WriteBlob(id Identifier) (BlobWriter, error) {
+	path := c.DataPath(id)
+
+	slog.Debug("loading chunk write buffer...", "id", id)
+	if _, err := os.Stat(path); err != nil {
+		return nil, fmt.Errorf("failed to open destination: %w", err)
+	}
+
+	c.mu.RLock()
+	return c.newChunkWriter(filepath.Join(path, "data.manifest"), true), nil
+}
+
+// Begin starts a transaction, the chunks are protected from the
+// garbage collector until the end of the transaction
+func (c *ChunkRepository) Begin(id GameIdentifier) (Transaction, error) {
+	c.mu.RLock()
+	t, err := c.begin(id, "data.manifest", func(path string) (BlobWriter, error) {
+		return c.newChunkWriter(path, false), nil
+	})
+	if err != nil {
+		c.mu.RUnlock()
+		return nil, err
+	}
+
+	return &chunkTransaction{stagedTransaction: t, repo: c}, nil
+}
+
+// Recover rolls back the interrupted transactions and removes the
+// chunks that were not completely written
+func (c *ChunkRepository) Recover() error {
+	if err := c.LazyRepository.Recover(); err != nil {
+		return err
+	}
+
+	return filepath.WalkDir(c.chunkRoot, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if !d.IsDir() && strings.HasSuffix(d.Name(), ".tmp") {
+			slog.Warn("removing interrupted write", "path", path)
+			return os.Remove(path)
+		}
+		return nil
+	})
+}
+
+func (c *ChunkRepository) newChunkWriter(path string, locked bool) *chunkWriter {
+	return &chunkWriter{
+		repo:   c,
+		path:   path,
+		locked: locked,
+		buf:    make([]byte, 0, maxChunkSize),
+		hasher: hash.NewHasher(crypto.MD5, hash.Default),
+	}
+}
+
+func (c *ChunkRepository) ReadBlob(id Identifier) (io.ReadSeekCloser, error) {
+	slog.Debug("loading chunk read buffer...", "id", id)
+	m, err := c.manifest(id)
+	if err != nil {
+		return nil, fmt.Errorf("failed to open blob: %w", err)
+	}
+
+	offsets := make([]int64, len(m.Chunks))
+	var offset int64
+	for i, ch := range m.Chunks {
+		offsets[i] = offset
+		offset += ch.Size
+	}
+
+	return &chunkReader{
+		repo:    c,
+		m:       m,
+		offsets: offsets,
+		idx:     -1,
+	}, nil
+}
+
+func (c *ChunkRepository) Metadata(id GameIdentifier) (Metadata, error) {
+	m, err := c.LazyRepository.Metadata(id)
+	if err != nil {
+		return Metadata{}, err
+	}
+
+	mf, err := c.manifest(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return m, nil
+		}
+		return Metadata{}, err
+	}
+
+	m.MD5 = mf.MD5
+	m.Digest = mf.Digest
+	return m, nil
+}
+
+func (c *ChunkRepository) Backup(id BackupIdentifier) (Backup, error) {
+	path := filepath.Join(c.DataPath(id), "data.manifest")
+
+	slog.Debug("loading hist metadata", "id", id)
+	fs, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Backup{}, ErrNotFound
+		}
+		return Backup{}, fmt.Errorf("corrupted datastore: failed to open metadata: %w", err)
+	}
+
+	m, err := c.manifest(id)
+	if err != nil {
+		return Backup{}, err
+	}
+
+	b := Backup{
+		CreatedAt: fs.ModTime(),
+		MD5:       m.MD5,
+		Digest:    m.Digest,
+		UUID:      id.backupID,
+		Size:      m.Size,
+	}
+
+	if err := readBackupMetadata(c.DataPath(id), &b); err != nil {
+		return Backup{}, err
+	}
+
+	return b, nil
+}
+
+// GC removes the chunks that are not referenced by any manifest
+func (c *ChunkRepository) GC() (int, error) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+
+	refs := make(map[string]struct{})
+	add := func(id Identifier) error {
+		m, err := c.manifest(id)
+		if err != nil {
+			if errors.Is(err, ErrNotFound) {
+				return nil
+			}
+			return err
+		}
+		for _, ch := range m.Chunks {
+			refs[ch.Hash] = struct{}{}
+		}
+		return nil
+	}
+
+	games, err := c.All()
+	if err != nil {
+		return 0, err
+	}
+	for _, g := range games {
+		gameID := NewGameIdentifier(g)
+		if err := add(gameID); err != nil {
+			return 0, fmt.Errorf("[%s] failed to load manifest: %w", g, err)
+		}
+
+		hist, err := c.AllHist(gameID)
+		if err != nil {
+			return 0, fmt.Errorf("[%s] failed to load hist data: %w", g, err)
+		}
+		for _, b := range hist {
+			if err := add(NewBackupIdentifier(g, b)); err != nil {
+				return 0, fmt.Errorf("[%s] failed to load manifest of %s: %w", g, b, err)
+			}
+		}
+	}
+
+	removed := 0
+	err = filepath.WalkDir(c.chunkRoot, func(path string, d os.DirEntry, err error) error {
+		if err != nil {
+			return err
+		}
+		if d.IsDir() {
+			return nil
+		}
+		if _, ok := refs[d.Name()]; ok || strings.HasSuffix(d.Name(), ".tmp") {
+			return nil
+		}
+		slog.Debug("removing unreferenced chunk", "hash", d.Name())
+		if err := os.Remove(path); err != nil {
+			return err
+		}
+		removed++
+		return nil
+	})
+	if err != nil {
+		return removed, fmt.Errorf("failed to remove unreferenced chunks: %w", err)
+	}
+
+	return removed, nil
+}
+
+// Migrate converts the archives stored by the LazyRepository (data.tar.gz)
+// into chunks, the archives are removed once converted. The manifests
+// written before the digests are rehashed.
+func (c *ChunkRepository) Migrate() error {
+	games, err := c.All()
+	if err != nil {
+		return err
+	}
+
+	for _, g := range games {
+		gameID := NewGameIdentifier(g)
+		if err := c.migrate(gameID); err != nil {
+			return fmt.Errorf("[%s] failed to migrate the archive: %w", g, err)
+		}
+		if err := c.rehash(gameID); err != nil {
+			return fmt.Errorf("[%s] failed to rehash the archive: %w", g, err)
+		}
+
+		hist, err := c.AllHist(gameID)
+		if err != nil {
+			return fmt.Errorf("[%s] failed to load hist data: %w", g, err)
+		}
+		for _, b := range hist {
+			if err := c.migrate(NewBackupIdentifier(g, b)); err != nil {
+				return fmt.Errorf("[%s] failed to migrate the backup %s: %w", g, b, err)
+			}
+			if err := c.rehash(NewBackupIdentifier(g, b)); err != nil {
+				return fmt.Errorf("[%s] failed to rehash the backup %s: %w", g, b, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (c *ChunkRepository) migrate(id Identifier) error {
+	path := filepath.Join(c.DataPath(id), "data.tar.gz")
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	slog.Info("migrating archive to the chunk store", "id", id)
+	src, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return err
+	}
+
+	dst, err := c.WriteBlob(id)
+	if err != nil {
+		src.Close()
+		return err
+	}
+
+	_, err = io.Copy(dst, src)
+	src.Close()
+	if err != nil {
+		dst.Abort()
+		return err
+	}
+	if err := dst.Close(); err != nil {
+		return err
+	}
+
+	// keep the date of the archive, it is the creation date of the backups
+	if err := os.Chtimes(filepath.Join(c.DataPath(id), "data.manifest"), fi.ModTime(), fi.ModTime()); err != nil {
+		return err
+	}
+
+	if err := os.Remove(filepath.Join(c.DataPath(id), digestsFile)); err != nil && !errors.Is(err, os.ErrNotExist) {
+		return err
+	}
+	return os.Remove(path)
+}
+
+// rehash adds the digest to a manifest that has none
+func (c *ChunkRepository) rehash(id Identifier) error {
+	m, err := c.manifest(id)
+	if err != nil {
+		if errors.Is(err, ErrNotFound) {
+			return nil
+		}
+		return err
+	}
+	if len(m.Digest) > 0 {
+		return nil
+	}
+
+	path := filepath.Join(c.DataPath(id), "data.manifest")
+	fi, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+
+	slog.Info("rehashing archive", "id", id)
+	src, err := c.ReadBlob(id)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	h := hash.NewHasher(hash.Default)
+	if _, err := io.Copy(h, src); err != nil {
+		return fmt.Errorf("failed to read the chunks: %w", err)
+	}
+	m.Digest = h.Digest(hash.Default)
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+	if err := writeFile(path, data); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	// keep the date of the manifest, it is the creation date of the backups
+	return os.Chtimes(path, fi.ModTime(), fi.ModTime())
+}
+
+func (c *ChunkRepository) manifest(id Identifier) (manifest, error) {
+	f, err := os.OpenFile(filepath.Join(c.DataPath(id), "data.manifest"), os.O_RDONLY, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return manifest{}, ErrNotFound
+		}
+		return manifest{}, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer f.Close()
+
+	var m manifest
+	d := json.NewDecoder(f)
+	if err := d.Decode(&m); err != nil {
+		return manifest{}, fmt.Errorf("corrupted datastore: failed to parse manifest: %w", err)
+	}
+
+	return m, nil
+}
+
+func (c *ChunkRepository) chunkPath(h string) string {
+	return filepath.Join(c.chunkRoot, h[:2], h)
+}
+
+func (w *chunkWriter) Write(p []byte) (int, error) {
+	if w.err != nil {
+		return 0, w.err
+	}
+	if w.closed {
+		return 0, os.ErrClosed
+	}
+
+	for i, b := range p {
+		w.buf = append(w.buf, b)
+		w.fp = (w.fp << 1) + gear[b]
+
+		if len(w.buf) < minChunkSize {
+			continue
+		}
+		if w.fp&chunkMask == 0 || len(w.buf) >= maxChunkSize {
+			if err := w.cut(); err != nil {
+				w.err = err
+				return i + 1, err
+			}
+		}
+	}
+
+	return len(p), nil
+}
+
+// cut stores the buffered data as a chunk
+func (w *chunkWriter) cut() error {
+	if len(w.buf) == 0 {
+		return nil
+	}
+
+	sum := sha256.Sum256(w.buf)
+	h := hex.EncodeToString(sum[:])
+	path := w.repo.chunkPath(h)
+
+	if _, err := os.Stat(path); errors.Is(err, os.ErrNotExist) {
+		if err := writeFile(path, w.buf); err != nil {
+			return fmt.Errorf("failed to write chunk: %w", err)
+		}
+	} else if err != nil {
+		return fmt.Errorf("failed to open chunk: %w", err)
+	}
+
+	w.hasher.Write(w.buf)
+	w.m.Chunks = append(w.m.Chunks, chunkRef{Hash: h, Size: int64(len(w.buf))})
+	w.m.Size += int64(len(w.buf))
+	w.buf = w.buf[:0]
+	w.fp = 0
+
+	return nil
+}
+
+// Close writes the manifest, the blob is not visible before
+func (w *chunkWriter) Close() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	defer w.release()
+
+	if w.err != nil {
+		return w.err
+	}
+
+	if err := w.cut(); err != nil {
+		return err
+	}
+	w.m.MD5 = w.hasher.Sum(crypto.MD5)
+	w.m.Digest = w.hasher.Digest(hash.Default)
+
+	data, err := json.Marshal(w.m)
+	if err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	if err := writeFile(w.path, data); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	return nil
+}
+
+// Abort drops the manifest, the chunks already written are
+// removed by the garbage collector if they are not used
+func (w *chunkWriter) Abort() error {
+	if w.closed {
+		return nil
+	}
+	w.closed = true
+	w.release()
+	return nil
+}
+
+func (w *chunkWriter) release() {
+	if w.locked {
+		w.repo.mu.RUnlock()
+	}
+}
+
+func (t *chunkTransaction) Commit() error {
+	defer t.release()
+	return t.stagedTransaction.Commit()
+}
+
+func (t *chunkTransaction) Rollback() error {
+	defer t.release()
+	return t.stagedTransaction.Rollback()
+}
+
+func (t *chunkTransaction) release() {
+	if !t.released {
+		t.released = true
+		t.repo.mu.RUnlock()
+	}
+}
+
+func (r *chunkReader) Read(p []byte) (int, error) {
+	if r.pos >= r.m.Size {
+		return 0, io.EOF
+	}
+
+	i := sort.Search(len(r.offsets), func(i int) bool { return r.offsets[i] > r.pos }) - 1
+	if i != r.idx {
+		ch := r.m.Chunks[i]
+		data, err := os.ReadFile(r.repo.chunkPath(ch.Hash))
+		if err != nil {
+			return 0, fmt.Errorf("corrupted datastore: failed to read chunk: %w", err)
+		}
+		if int64(len(data)) != ch.Size {
+			return 0, fmt.Errorf("corrupted datastore: chunk %s has an unexpected size", ch.Hash)
+		}
+		r.idx = i
+		r.data = data
+	}
+
+	n := copy(p, r.data[r.pos-r.offsets[i]:])
+	r.pos += int64(n)
+	return n, nil
+}
+
+func (r *chunkReader) Seek(offset int64, whence int) (int64, error) {
+	var pos int64
+	switch whence {
+	case io.SeekStart:
+		pos = offset
+	case io.SeekCurrent:
+		pos = r.pos + offset
+	case io.SeekEnd:
+		pos = r.m.Size + offset
+	default:
+		return 0, errors.New("invalid whence")
+	}
+
+	if pos < 0 {
+		return 0, errors.New("negative position")
+	}
+
+	r.pos = pos
+	return pos, nil
+}
+
+func (r *chunkReader) Close() error {
+	r.data = nil
+	return nil
+}
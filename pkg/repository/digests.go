@@ -0,0 +1,144 @@
+package repository
+
+import (
+	"cloudsave/pkg/tools/hash"
+	"crypto"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+type (
+	// archiveDigests are kept next to an archive so that it is not hashed
+	// on every read. They are valid as long as the archive has the same
+	// size and modification time.
+	archiveDigests struct {
+		Size    int64     `json:"size"`
+		ModTime time.Time `json:"mod_time"`
+		MD5     string    `json:"md5"`
+		Digest  string    `json:"digest"`
+	}
+
+	// archiveWriter writes an archive and hashes it on the way, the
+	// digests are kept once the archive is written
+	archiveWriter struct {
+		*fileWriter
+		hasher *hash.Hasher
+	}
+)
+
+const digestsFile = "digests.json"
+
+func newArchiveWriter(path string) (*archiveWriter, error) {
+	w, err := newFileWriter(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &archiveWriter{
+		fileWriter: w,
+		hasher:     hash.NewHasher(crypto.MD5, hash.Default),
+	}, nil
+}
+
+func (w *archiveWriter) Write(p []byte) (int, error) {
+	n, err := w.fileWriter.Write(p)
+	w.hasher.Write(p[:n])
+	return n, err
+}
+
+func (w *archiveWriter) Close() error {
+	if w.done {
+		return nil
+	}
+
+	if err := w.fileWriter.Close(); err != nil {
+		return err
+	}
+
+	// the archive is written, the digests are computed again on the next
+	// read if they cannot be kept
+	fi, err := os.Stat(w.path)
+	if err == nil {
+		err = writeDigests(w.path, archiveDigests{
+			Size:    fi.Size(),
+			ModTime: fi.ModTime(),
+			MD5:     w.hasher.Sum(crypto.MD5),
+			Digest:  w.hasher.Digest(hash.Default),
+		})
+	}
+	if err != nil {
+		slog.Warn("failed to keep the digests of the archive", "path", w.path, "err", err)
+	}
+
+	return nil
+}
+
+// digests returns the md5 hash of the archive and its digest with the
+// default algorithm. fi is the archive as it is now: the archive is only
+// read if it has changed since the digests were kept.
+func digests(path string, fi os.FileInfo) (string, string, error) {
+	if d, err := readDigests(path); err == nil && d.valid(fi) {
+		return d.MD5, d.Digest, nil
+	}
+
+	slog.Debug("hashing archive", "path", path)
+	f, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		return "", "", err
+	}
+	defer f.Close()
+
+	h := hash.NewHasher(crypto.MD5, hash.Default)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", "", err
+	}
+
+	d := archiveDigests{
+		Size:    fi.Size(),
+		ModTime: fi.ModTime(),
+		MD5:     h.Sum(crypto.MD5),
+		Digest:  h.Digest(hash.Default),
+	}
+	if err := writeDigests(path, d); err != nil {
+		slog.Debug("failed to keep the digests of the archive", "path", path, "err", err)
+	}
+
+	return d.MD5, d.Digest, nil
+}
+
+// valid tells whether the digests describe the archive, the digests of
+// another algorithm than the default one are made again
+func (d archiveDigests) valid(fi os.FileInfo) bool {
+	if d.Size != fi.Size() || !d.ModTime.Equal(fi.ModTime()) || len(d.MD5) == 0 {
+		return false
+	}
+
+	alg, _, err := hash.ParseDigest(d.Digest)
+	return err == nil && alg == hash.Default
+}
+
+func readDigests(path string) (archiveDigests, error) {
+	data, err := os.ReadFile(filepath.Join(filepath.Dir(path), digestsFile))
+	if err != nil {
+		return archiveDigests{}, err
+	}
+
+	var d archiveDigests
+	if err := json.Unmarshal(data, &d); err != nil {
+		return archiveDigests{}, fmt.Errorf("failed to parse the digests: %w", err)
+	}
+	return d, nil
+}
+
+func writeDigests(path string, d archiveDigests) error {
+	data, err := json.Marshal(d)
+	if err != nil {
+		return fmt.Errorf("failed to encode the digests: %w", err)
+	}
+	return writeFile(filepath.Join(filepath.Dir(path), digestsFile), data)
+}
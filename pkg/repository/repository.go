@@ -1,7 +1,8 @@
 package repository
 
 import (
-	"cloudsave/pkg/tools/hash"
+	"cloudsave/pkg/retention"
+	files "cloudsave/pkg/tools/manifest"
 	"encoding/json"
 	"errors"
 	"fmt"
@@ -15,12 +16,39 @@ import (
 
 type (
 	Metadata struct {
-		ID      string    `json:"id"`
-		Name    string    `json:"name"`
-		Path    string    `json:"path"`
-		Version int       `json:"version"`
-		Date    time.Time `json:"date"`
-		MD5     string    `json:"md5,omitempty"`
+		ID   string `json:"id"`
+		Name string `json:"name"`
+		// Path is the save directory when Paths is empty (older versions)
+		Path string `json:"path"`
+		// Paths is the save directory on each device, indexed by the device ID.
+		// The paths may have variables, see paths.Expand.
+		Paths   map[string]string `json:"paths,omitempty"`
+		Version int               `json:"version"`
+		Date    time.Time         `json:"date"`
+		MD5     string            `json:"md5,omitempty"`
+		// Digest is the digest of the archive tagged with its algorithm
+		// (see hash.Digest), MD5 is kept for the older clients
+		Digest string `json:"digest,omitempty"`
+		Parent string `json:"parent,omitempty"`
+		Device string `json:"device,omitempty"`
+		// Label describes why a backup was made, it is only set on backups
+		Label string `json:"label,omitempty"`
+		// Conflict is set on the backups of the discarded side of a
+		// conflict, the retention policy keeps them
+		Conflict bool `json:"conflict,omitempty"`
+		// Include and Exclude are glob patterns that select the archived files
+		Include []string `json:"include,omitempty"`
+		Exclude []string `json:"exclude,omitempty"`
+		// Roots are the other directories of the save, Path is the main one
+		Roots []Root `json:"roots,omitempty"`
+	}
+
+	// Root is a directory of the save archived with its name as prefix,
+	// Path and Paths work like the ones of Metadata
+	Root struct {
+		Name  string            `json:"name"`
+		Path  string            `json:"path,omitempty"`
+		Paths map[string]string `json:"paths,omitempty"`
 	}
 
 	Remote struct {
@@ -28,10 +56,27 @@ type (
 		GameID string `json:"-"`
 	}
 
+	// Lease tells that a device plays a game, the other devices are warned
+	// until it expires or is released
+	Lease struct {
+		DeviceID string    `json:"device_id"`
+		Device   string    `json:"device"`
+		Since    time.Time `json:"since"`
+		Expires  time.Time `json:"expires"`
+	}
+
 	Backup struct {
 		CreatedAt   time.Time `json:"created_at"`
 		MD5         string    `json:"md5"`
+		Digest      string    `json:"digest,omitempty"`
 		UUID        string    `json:"uuid"`
+		Size        int64     `json:"size"`
+		Version     int       `json:"version,omitempty"`
+		Date        time.Time `json:"date,omitzero"`
+		Parent      string    `json:"parent,omitempty"`
+		Device      string    `json:"device,omitempty"`
+		Label       string    `json:"label,omitempty"`
+		Conflict    bool      `json:"conflict,omitempty"`
 		ArchivePath string    `json:"-"`
 	}
 
@@ -72,21 +117,28 @@ type (
 		All() ([]string, error)
 		AllHist(gameID GameIdentifier) ([]string, error)
 
-		WriteBlob(ID Identifier) (io.Writer, error)
+		WriteBlob(ID Identifier) (BlobWriter, error)
 		WriteMetadata(gameID GameIdentifier, m Metadata) error
+		WriteBackupMetadata(id BackupIdentifier, m Metadata) error
+		Begin(gameID GameIdentifier) (Transaction, error)
 
 		Metadata(gameID GameIdentifier) (Metadata, error)
-		LastScan(gameID GameIdentifier) (time.Time, error)
+		Manifest(gameID GameIdentifier) (files.Manifest, error)
 		ReadBlob(gameID Identifier) (io.ReadSeekCloser, error)
 		Backup(id BackupIdentifier) (Backup, error)
 		Remote(id GameIdentifier) (*Remote, error)
+		Retention(id GameIdentifier) (*retention.Policy, error)
+		Lease(id GameIdentifier) (*Lease, error)
 
 		SetRemote(gameID GameIdentifier, url string) error
-		ResetLastScan(id GameIdentifier) error
+		SetRetention(gameID GameIdentifier, p *retention.Policy) error
+		SetLease(gameID GameIdentifier, l *Lease) error
+		WriteManifest(gameID GameIdentifier, m files.Manifest) error
 
 		DataPath(id Identifier) string
 
 		Remove(gameID GameIdentifier) error
+		RemoveBackup(id BackupIdentifier) error
 	}
 )
 
@@ -178,11 +230,11 @@ func (l *LazyRepository) AllHist(id GameIdentifier) ([]string, error) {
 	return res, nil
 }
 
-func (l *LazyRepository) WriteBlob(ID Identifier) (io.Writer, error) {
+func (l *LazyRepository) WriteBlob(ID Identifier) (BlobWriter, error) {
 	path := l.DataPath(ID)
 
 	slog.Debug("loading write buffer...", "id", ID)
-	dst, err := os.OpenFile(filepath.Join(path, "data.tar.gz"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0740)
+	dst, err := newArchiveWriter(filepath.Join(path, "data.tar.gz"))
 	if err != nil {
 		return nil, fmt.Errorf("failed to open destination file: %w", err)
 	}
@@ -191,22 +243,10 @@ func (l *LazyRepository) WriteBlob(ID Identifier) (io.Writer, error) {
 }
 
 func (l *LazyRepository) WriteMetadata(id GameIdentifier, m Metadata) error {
-	m.MD5 = ""
 	path := l.DataPath(id)
 
 	slog.Debug("writing metadata", "id", id, "metadata", m)
-	dst, err := os.OpenFile(filepath.Join(path, "metadata.json"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0740)
-	if err != nil {
-		return fmt.Errorf("failed to open destination file: %w", err)
-	}
-	defer dst.Close()
-
-	e := json.NewEncoder(dst)
-	if err := e.Encode(m); err != nil {
-		return fmt.Errorf("failed to encode data: %w", err)
-	}
-
-	return nil
+	return writeMetadata(filepath.Join(path, "metadata.json"), m)
 }
 
 func (l *LazyRepository) Metadata(id GameIdentifier) (Metadata, error) {
@@ -227,17 +267,18 @@ func (l *LazyRepository) Metadata(id GameIdentifier) (Metadata, error) {
 		return Metadata{}, fmt.Errorf("corrupted datastore: failed to parse metadata: %w", err)
 	}
 
-	if _, err := os.Stat(filepath.Join(path, "data.tar.gz")); err != nil {
+	fi, err := os.Stat(filepath.Join(path, "data.tar.gz"))
+	if err != nil {
 		if errors.Is(err, os.ErrNotExist) {
 			return m, nil
 		}
 		return Metadata{}, fmt.Errorf("failed to open archive: %w", err)
 	}
 
-	slog.Debug("loading md5 hash", "id", id)
-	m.MD5, err = hash.FileMD5(filepath.Join(path, "data.tar.gz"))
+	slog.Debug("loading archive digests", "id", id)
+	m.MD5, m.Digest, err = digests(filepath.Join(path, "data.tar.gz"), fi)
 	if err != nil {
-		return Metadata{}, fmt.Errorf("failed to calculate md5: %w", err)
+		return Metadata{}, fmt.Errorf("failed to calculate the digests: %w", err)
 	}
 
 	return m, nil
@@ -255,58 +296,75 @@ func (l *LazyRepository) Backup(id BackupIdentifier) (Backup, error) {
 		return Backup{}, fmt.Errorf("corrupted datastore: failed to open metadata: %w", err)
 	}
 
-	slog.Debug("loading md5 hash", "id", id)
-	h, err := hash.FileMD5(filepath.Join(path, "data.tar.gz"))
+	slog.Debug("loading archive digests", "id", id)
+	h, digest, err := digests(filepath.Join(path, "data.tar.gz"), fs)
 	if err != nil {
 		return Backup{}, fmt.Errorf("corrupted datastore: failed to open metadata: %w", err)
 	}
 
-	return Backup{
+	b := Backup{
 		CreatedAt:   fs.ModTime(),
 		MD5:         h,
+		Digest:      digest,
 		UUID:        id.backupID,
+		Size:        fs.Size(),
 		ArchivePath: filepath.Join(path, "data.tar.gz"),
-	}, nil
-}
-
-func (l *LazyRepository) LastScan(id GameIdentifier) (time.Time, error) {
-	path := l.DataPath(id)
-
-	data, err := os.ReadFile(filepath.Join(path, ".last_run"))
-	if err != nil {
-		if errors.Is(err, os.ErrNotExist) {
-			return time.Time{}, nil
-		}
-		return time.Time{}, fmt.Errorf("failed to reading state file: %w", err)
 	}
 
-	lastRun, err := time.Parse(time.RFC3339, string(data))
-	if err != nil {
-		return time.Time{}, fmt.Errorf("parsing state file timestamp: %w", err)
+	if err := readBackupMetadata(path, &b); err != nil {
+		return Backup{}, err
 	}
 
-	return lastRun, nil
+	return b, nil
 }
 
-func (l *LazyRepository) ResetLastScan(id GameIdentifier) error {
+// WriteBackupMetadata keeps the metadata of the game as they were
+// when the backup was made
+func (l *LazyRepository) WriteBackupMetadata(id BackupIdentifier, m Metadata) error {
 	path := l.DataPath(id)
 
-	slog.Debug("resetting last scan datetime for", "id", id)
-	f, err := os.OpenFile(filepath.Join(path, ".last_run"), os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0740)
+	slog.Debug("writing backup metadata", "id", id, "metadata", m)
+	return writeMetadata(filepath.Join(path, "metadata.json"), m)
+}
+
+// readBackupMetadata completes the backup with the metadata of the game at the time
+// of the backup, if they were saved
+func readBackupMetadata(path string, b *Backup) error {
+	src, err := os.OpenFile(filepath.Join(path, "metadata.json"), os.O_RDONLY, 0)
 	if err != nil {
-		return fmt.Errorf("failed to open file: %w", err)
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return fmt.Errorf("corrupted datastore: failed to open backup metadata: %w", err)
 	}
-	defer f.Close()
-
-	data := time.Now().Format(time.RFC3339)
+	defer src.Close()
 
-	if _, err := f.WriteString(data); err != nil {
-		return fmt.Errorf("failed to write file: %w", err)
+	var m Metadata
+	d := json.NewDecoder(src)
+	if err := d.Decode(&m); err != nil {
+		return fmt.Errorf("corrupted datastore: failed to parse backup metadata: %w", err)
 	}
 
+	b.Version = m.Version
+	b.Date = m.Date
+	b.Parent = m.Parent
+	b.Device = m.Device
+	b.Label = m.Label
+	b.Conflict = m.Conflict
 	return nil
 }
 
+// Manifest returns the files of the save directories as they were at the
+// last scan, an empty manifest is returned if there was none
+func (l *LazyRepository) Manifest(id GameIdentifier) (files.Manifest, error) {
+	return files.Load(filepath.Join(l.DataPath(id), "manifest.json"))
+}
+
+func (l *LazyRepository) WriteManifest(id GameIdentifier, m files.Manifest) error {
+	slog.Debug("writing manifest for", "id", id)
+	return files.Save(filepath.Join(l.DataPath(id), "manifest.json"), m)
+}
+
 func (l *LazyRepository) ReadBlob(id Identifier) (io.ReadSeekCloser, error) {
 	path := l.DataPath(id)
 
@@ -363,6 +421,82 @@ func (l *LazyRepository) Remote(id GameIdentifier) (*Remote, error) {
 	return &r, nil
 }
 
+func (l *LazyRepository) SetRetention(id GameIdentifier, p *retention.Policy) error {
+	path := filepath.Join(l.DataPath(id), "retention.json")
+
+	if p == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove retention policy: %w", err)
+		}
+		return nil
+	}
+
+	return retention.Save(path, *p)
+}
+
+func (l *LazyRepository) Retention(id GameIdentifier) (*retention.Policy, error) {
+	path := filepath.Join(l.DataPath(id), "retention.json")
+
+	if _, err := os.Stat(path); err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open retention policy: %w", err)
+	}
+
+	p, err := retention.Load(path)
+	if err != nil {
+		return nil, err
+	}
+
+	return &p, nil
+}
+
+// SetLease replaces the lease of the game, it is removed if l is nil
+func (l *LazyRepository) SetLease(id GameIdentifier, lease *Lease) error {
+	path := filepath.Join(l.DataPath(id), "lease.json")
+
+	if lease == nil {
+		if err := os.Remove(path); err != nil && !errors.Is(err, os.ErrNotExist) {
+			return fmt.Errorf("failed to remove lease: %w", err)
+		}
+		return nil
+	}
+
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0740)
+	if err != nil {
+		return fmt.Errorf("failed to open lease: %w", err)
+	}
+	defer f.Close()
+
+	e := json.NewEncoder(f)
+	if err := e.Encode(lease); err != nil {
+		return fmt.Errorf("failed to encode lease: %w", err)
+	}
+
+	return nil
+}
+
+// Lease returns the lease of the game, nil if there is none
+func (l *LazyRepository) Lease(id GameIdentifier) (*Lease, error) {
+	f, err := os.OpenFile(filepath.Join(l.DataPath(id), "lease.json"), os.O_RDONLY, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open lease: %w", err)
+	}
+	defer f.Close()
+
+	var lease Lease
+	d := json.NewDecoder(f)
+	if err := d.Decode(&lease); err != nil {
+		return nil, fmt.Errorf("corrupted datastore: failed to parse lease: %w", err)
+	}
+
+	return &lease, nil
+}
+
 func (l *LazyRepository) Remove(id GameIdentifier) error {
 	path := l.DataPath(id)
 
@@ -374,6 +508,17 @@ func (l *LazyRepository) Remove(id GameIdentifier) error {
 	return nil
 }
 
+func (l *LazyRepository) RemoveBackup(id BackupIdentifier) error {
+	path := l.DataPath(id)
+
+	slog.Debug("removing backup", "id", id)
+	if err := os.RemoveAll(path); err != nil {
+		return fmt.Errorf("failed to remove backup folder from the datastore: %w", err)
+	}
+
+	return nil
+}
+
 func (r *LazyRepository) DataPath(id Identifier) string {
 	switch identifier := id.(type) {
 	case GameIdentifier:
@@ -391,10 +536,15 @@ func NewEagerRepository(dataRootPath string) (*EagerRepository, error) {
 		return nil, err
 	}
 
+	return NewEagerRepositoryWith(r), nil
+}
+
+// NewEagerRepositoryWith adds a cache in front of another repository
+func NewEagerRepositoryWith(r Repository) *EagerRepository {
 	return &EagerRepository{
 		Repository: r,
 		data:       make(map[string]Data),
-	}, nil
+	}
 }
 
 func (r *EagerRepository) Preload() error {
@@ -484,6 +634,30 @@ func (r *EagerRepository) WriteMetadata(id GameIdentifier, m Metadata) error {
 	return nil
 }
 
+func (r *EagerRepository) WriteBackupMetadata(id BackupIdentifier, m Metadata) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.Repository.WriteBackupMetadata(id, m); err != nil {
+		return err
+	}
+
+	b, err := r.Repository.Backup(id)
+	if err != nil {
+		return err
+	}
+
+	if d, ok := r.data[id.gameID]; ok {
+		if d.Backup == nil {
+			d.Backup = make(map[string]Backup)
+		}
+		d.Backup[id.backupID] = b
+		r.data[id.gameID] = d
+	}
+
+	return nil
+}
+
 func (r *EagerRepository) Metadata(id GameIdentifier) (Metadata, error) {
 	r.mu.RLock()
 	defer r.mu.RUnlock()
@@ -537,7 +711,31 @@ func (r *EagerRepository) Remove(id GameIdentifier) error {
 	return nil
 }
 
+func (r *EagerRepository) RemoveBackup(id BackupIdentifier) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	if err := r.Repository.RemoveBackup(id); err != nil {
+		return err
+	}
+
+	if d, ok := r.data[id.gameID]; ok {
+		delete(d.Backup, id.backupID)
+	}
+	return nil
+}
+
+func (r *EagerRepository) GC() (int, error) {
+	if gc, ok := r.Repository.(GarbageCollector); ok {
+		return gc.GC()
+	}
+	return 0, nil
+}
+
 func (r *EagerRepository) ReloadMetadata(id GameIdentifier) error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
 	backup, err := r.Repository.AllHist(id)
 	if err != nil {
 		return fmt.Errorf("[%s] failed to load hist data: %w", id, err)
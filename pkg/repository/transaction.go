@@ -0,0 +1,287 @@
+package repository
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log/slog"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+const (
+	stagingPrefix = ".staging-"
+	commitMarker  = "COMMIT"
+)
+
+type (
+	// BlobWriter writes a blob in a temporary location. The blob replaces
+	// the current one when the writer is closed. Abort drops the written data,
+	// it does nothing once the writer is closed.
+	BlobWriter interface {
+		io.WriteCloser
+		Abort() error
+	}
+
+	// Transaction stages the blob and the metadata of a game, then replaces
+	// both of them at once on Commit. Rollback does nothing once committed.
+	Transaction interface {
+		WriteBlob() (BlobWriter, error)
+		WriteMetadata(m Metadata) error
+		Commit() error
+		Rollback() error
+	}
+
+	fileWriter struct {
+		f    *os.File
+		path string
+		done bool
+	}
+
+	stagedTransaction struct {
+		dir    string
+		target string
+		blob   string
+		open   func(path string) (BlobWriter, error)
+		done   bool
+	}
+)
+
+func newFileWriter(path string) (*fileWriter, error) {
+	f, err := os.OpenFile(path+"."+uuid.NewString()+".tmp", os.O_CREATE|os.O_EXCL|os.O_WRONLY, 0740)
+	if err != nil {
+		return nil, err
+	}
+
+	return &fileWriter{
+		f:    f,
+		path: path,
+	}, nil
+}
+
+func (w *fileWriter) Write(p []byte) (int, error) {
+	return w.f.Write(p)
+}
+
+func (w *fileWriter) Close() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	if err := w.f.Sync(); err != nil {
+		w.f.Close()
+		os.Remove(w.f.Name())
+		return fmt.Errorf("failed to flush data: %w", err)
+	}
+
+	if err := w.f.Close(); err != nil {
+		os.Remove(w.f.Name())
+		return fmt.Errorf("failed to close file: %w", err)
+	}
+
+	if err := os.Rename(w.f.Name(), w.path); err != nil {
+		os.Remove(w.f.Name())
+		return fmt.Errorf("failed to move temporary data: %w", err)
+	}
+
+	return nil
+}
+
+func (w *fileWriter) Abort() error {
+	if w.done {
+		return nil
+	}
+	w.done = true
+
+	w.f.Close()
+	return os.Remove(w.f.Name())
+}
+
+func (l *LazyRepository) Begin(id GameIdentifier) (Transaction, error) {
+	return l.begin(id, "data.tar.gz", func(path string) (BlobWriter, error) {
+		return newArchiveWriter(path)
+	})
+}
+
+func (l *LazyRepository) begin(id GameIdentifier, blob string, open func(path string) (BlobWriter, error)) (*stagedTransaction, error) {
+	path := l.DataPath(id)
+
+	dir := filepath.Join(path, stagingPrefix+uuid.NewString())
+	slog.Debug("starting transaction", "id", id, "staging", dir)
+	if err := os.MkdirAll(dir, 0740); err != nil {
+		return nil, fmt.Errorf("failed to make staging directory: %w", err)
+	}
+
+	return &stagedTransaction{
+		dir:    dir,
+		target: path,
+		blob:   blob,
+		open:   open,
+	}, nil
+}
+
+// Recover finishes the transactions that were committed and rolls back
+// the others, then removes the temporary files left by an interrupted write
+func (l *LazyRepository) Recover() error {
+	games, err := l.All()
+	if err != nil {
+		return err
+	}
+
+	for _, g := range games {
+		gameID := NewGameIdentifier(g)
+		if err := recoverDir(l.DataPath(gameID)); err != nil {
+			return fmt.Errorf("[%s] failed to recover: %w", g, err)
+		}
+
+		hist, err := l.AllHist(gameID)
+		if err != nil {
+			return fmt.Errorf("[%s] failed to load hist data: %w", g, err)
+		}
+		for _, b := range hist {
+			if err := recoverDir(l.DataPath(NewBackupIdentifier(g, b))); err != nil {
+				return fmt.Errorf("[%s] failed to recover backup %s: %w", g, b, err)
+			}
+		}
+	}
+
+	return nil
+}
+
+func (t *stagedTransaction) WriteBlob() (BlobWriter, error) {
+	if t.done {
+		return nil, errors.New("transaction closed")
+	}
+	return t.open(filepath.Join(t.dir, t.blob))
+}
+
+func (t *stagedTransaction) WriteMetadata(m Metadata) error {
+	if t.done {
+		return errors.New("transaction closed")
+	}
+	return writeMetadata(filepath.Join(t.dir, "metadata.json"), m)
+}
+
+func (t *stagedTransaction) Commit() error {
+	if t.done {
+		return errors.New("transaction closed")
+	}
+	t.done = true
+
+	// from here, the transaction is replayed if the process stops
+	if err := writeFile(filepath.Join(t.dir, commitMarker), nil); err != nil {
+		os.RemoveAll(t.dir)
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+
+	if err := applyStaging(t.dir, t.target); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+
+	return nil
+}
+
+func (t *stagedTransaction) Rollback() error {
+	if t.done {
+		return nil
+	}
+	t.done = true
+
+	slog.Debug("rolling back transaction", "staging", t.dir)
+	return os.RemoveAll(t.dir)
+}
+
+// applyStaging moves the staged files to their destination and removes the staging directory
+func applyStaging(dir, target string) error {
+	entries, err := os.ReadDir(dir)
+	if err != nil {
+		return err
+	}
+
+	for _, e := range entries {
+		if e.Name() == commitMarker || strings.HasSuffix(e.Name(), ".tmp") {
+			continue
+		}
+		if err := os.Rename(filepath.Join(dir, e.Name()), filepath.Join(target, e.Name())); err != nil {
+			return err
+		}
+	}
+
+	return os.RemoveAll(dir)
+}
+
+func recoverDir(path string) error {
+	entries, err := os.ReadDir(path)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil
+		}
+		return err
+	}
+
+	for _, e := range entries {
+		p := filepath.Join(path, e.Name())
+		switch {
+		case e.IsDir() && strings.HasPrefix(e.Name(), stagingPrefix):
+			if _, err := os.Stat(filepath.Join(p, commitMarker)); err == nil {
+				slog.Warn("replaying committed transaction", "staging", p)
+				if err := applyStaging(p, path); err != nil {
+					return err
+				}
+				continue
+			}
+			slog.Warn("rolling back interrupted transaction", "staging", p)
+			if err := os.RemoveAll(p); err != nil {
+				return err
+			}
+		case !e.IsDir() && strings.HasSuffix(e.Name(), ".tmp"):
+			slog.Warn("removing interrupted write", "path", p)
+			if err := os.Remove(p); err != nil {
+				return err
+			}
+		}
+	}
+
+	return nil
+}
+
+func writeMetadata(path string, m Metadata) error {
+	m.MD5 = ""
+	m.Digest = ""
+
+	data, err := json.Marshal(m)
+	if err != nil {
+		return fmt.Errorf("failed to encode data: %w", err)
+	}
+
+	if err := writeFile(path, data); err != nil {
+		return fmt.Errorf("failed to write metadata: %w", err)
+	}
+
+	return nil
+}
+
+// writeFile writes the file in a temporary file then moves it
+// to its destination, a reader never sees a partial file
+func writeFile(path string, data []byte) error {
+	if err := os.MkdirAll(filepath.Dir(path), 0740); err != nil {
+		return err
+	}
+
+	w, err := newFileWriter(path)
+	if err != nil {
+		return err
+	}
+
+	if _, err := w.Write(data); err != nil {
+		w.Abort()
+		return err
+	}
+
+	return w.Close()
+}
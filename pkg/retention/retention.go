@@ -0,0 +1,149 @@
+package retention
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"slices"
+	"time"
+)
+
+type (
+	// Policy describes which backups must be kept. A backup is kept
+	// as soon as one of the rules selects it; a policy without any rule
+	// keeps everything.
+	Policy struct {
+		KeepLast    int   `json:"keep_last,omitempty"`
+		KeepDaily   int   `json:"keep_daily,omitempty"`
+		KeepWeekly  int   `json:"keep_weekly,omitempty"`
+		KeepMonthly int   `json:"keep_monthly,omitempty"`
+		MaxSize     int64 `json:"max_size,omitempty"`
+	}
+
+	Entry struct {
+		ID        string
+		CreatedAt time.Time
+		Size      int64
+	}
+)
+
+// IsZero reports whether the policy has no rule at all
+func (p Policy) IsZero() bool {
+	return p == Policy{}
+}
+
+func (p Policy) hasKeepRule() bool {
+	return p.KeepLast > 0 || p.KeepDaily > 0 || p.KeepWeekly > 0 || p.KeepMonthly > 0
+}
+
+func (p Policy) String() string {
+	if p.IsZero() {
+		return "keep everything"
+	}
+	return fmt.Sprintf("last=%d daily=%d weekly=%d monthly=%d max-size=%d", p.KeepLast, p.KeepDaily, p.KeepWeekly, p.KeepMonthly, p.MaxSize)
+}
+
+// Select splits the entries in two lists: the entries to keep and the entries to remove.
+// Both lists are sorted from the newest to the oldest entry.
+func Select(p Policy, entries []Entry) (keep []Entry, remove []Entry) {
+	sorted := slices.Clone(entries)
+	slices.SortStableFunc(sorted, func(a, b Entry) int {
+		return b.CreatedAt.Compare(a.CreatedAt)
+	})
+
+	kept := make([]bool, len(sorted))
+	if !p.hasKeepRule() {
+		for i := range kept {
+			kept[i] = true
+		}
+	} else {
+		for i := 0; i < len(sorted) && i < p.KeepLast; i++ {
+			kept[i] = true
+		}
+		bucket(sorted, kept, p.KeepDaily, func(t time.Time) string {
+			return t.Format(time.DateOnly)
+		})
+		bucket(sorted, kept, p.KeepWeekly, func(t time.Time) string {
+			y, w := t.ISOWeek()
+			return fmt.Sprintf("%d-%d", y, w)
+		})
+		bucket(sorted, kept, p.KeepMonthly, func(t time.Time) string {
+			return t.Format("2006-01")
+		})
+	}
+
+	var total int64
+	for i, e := range sorted {
+		if kept[i] && p.MaxSize > 0 {
+			total += e.Size
+			if total > p.MaxSize {
+				kept[i] = false
+			}
+		}
+
+		if kept[i] {
+			keep = append(keep, e)
+		} else {
+			remove = append(remove, e)
+		}
+	}
+
+	return keep, remove
+}
+
+// bucket keeps the newest entry of the n most recent buckets
+func bucket(sorted []Entry, kept []bool, n int, key func(t time.Time) string) {
+	if n <= 0 {
+		return
+	}
+
+	seen := make(map[string]struct{})
+	for i, e := range sorted {
+		k := key(e.CreatedAt.Local())
+		if _, ok := seen[k]; ok {
+			continue
+		}
+		if len(seen) == n {
+			return
+		}
+		seen[k] = struct{}{}
+		kept[i] = true
+	}
+}
+
+// Load reads a policy from a json file. A missing file is not an error,
+// an empty policy is returned instead.
+func Load(path string) (Policy, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Policy{}, nil
+		}
+		return Policy{}, fmt.Errorf("failed to open retention policy: %w", err)
+	}
+	defer f.Close()
+
+	var p Policy
+	d := json.NewDecoder(f)
+	if err := d.Decode(&p); err != nil {
+		return Policy{}, fmt.Errorf("failed to parse retention policy (%s): %w", path, err)
+	}
+
+	return p, nil
+}
+
+func Save(path string, p Policy) error {
+	f, err := os.OpenFile(path, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0740)
+	if err != nil {
+		return fmt.Errorf("failed to open retention policy: %w", err)
+	}
+	defer f.Close()
+
+	e := json.NewEncoder(f)
+	if err := e.Encode(p); err != nil {
+		return fmt.Errorf("failed to encode retention policy: %w", err)
+	}
+
+	return nil
+}
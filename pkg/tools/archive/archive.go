@@ -2,29 +2,170 @@ package archive
 
 import (
 	"archive/tar"
+	"cloudsave/pkg/tools/hash"
+	"cloudsave/pkg/tools/manifest"
 	"compress/gzip"
+	"errors"
 	"fmt"
 	"io"
 	"os"
+	"path"
 	"path/filepath"
+	"strings"
+	"time"
 )
 
+type (
+	// Policy tells what to do with an entry that can be harmful
+	Policy int
+
+	// Options restricts what an archive can write on the disk
+	Options struct {
+		// Symlinks are only created if they point inside the destination
+		Symlinks Policy
+		// Hardlinks are only created if they point to a file of the archive
+		Hardlinks Policy
+		// Special files (devices, fifos) are never created, Allow is treated as Skip
+		Special Policy
+		// MaxSize is the maximum size of the extracted files, 0 means no limit
+		MaxSize int64
+		// MaxEntries is the maximum number of entries, 0 means no limit
+		MaxEntries int
+		// Select, if set, gives the name in the destination of an entry,
+		// from its slash-separated name. The entries it refuses are skipped.
+		Select func(name string) (string, bool)
+	}
+
+	// Source is a directory archived under Prefix, see TarSources
+	Source struct {
+		Prefix string
+		Root   string
+		// Keep tells whether an entry is archived, its name is
+		// slash-separated and relative to Root. Nil keeps everything.
+		Keep func(name string, dir bool) bool
+	}
+
+	// EntryError describes an entry that cannot be extracted
+	EntryError struct {
+		Name string
+		Err  error
+	}
+)
+
+const (
+	// Skip ignores the entry
+	Skip Policy = iota
+	// Reject stops the extraction with an error
+	Reject
+	// Allow extracts the entry
+	Allow
+)
+
+var (
+	ErrUnsafePath     = errors.New("the path leaves the destination directory")
+	ErrLink           = errors.New("links are not allowed")
+	ErrSpecial        = errors.New("special files are not allowed")
+	ErrTooLarge       = errors.New("the archive is too large")
+	ErrTooManyEntries = errors.New("the archive has too many entries")
+	ErrInvalidName    = errors.New("the name is not valid on this system")
+	ErrCaseCollision  = errors.New("another entry has the same name with a different case")
+)
+
+// DefaultOptions are the options used by Untar
+var DefaultOptions = Options{
+	Symlinks:   Allow,
+	Hardlinks:  Skip,
+	Special:    Skip,
+	MaxSize:    64 << 30,
+	MaxEntries: 1_000_000,
+}
+
+func (p Policy) String() string {
+	switch p {
+	case Skip:
+		return "skip"
+	case Reject:
+		return "reject"
+	case Allow:
+		return "allow"
+	}
+	return "unknown"
+}
+
+// ParsePolicy reads the name of a policy (see Policy.String)
+func ParsePolicy(v string) (Policy, error) {
+	for _, p := range []Policy{Skip, Reject, Allow} {
+		if p.String() == v {
+			return p, nil
+		}
+	}
+	return Skip, fmt.Errorf("unknown policy %q, expected skip, reject or allow", v)
+}
+
+func (e *EntryError) Error() string {
+	return fmt.Sprintf("invalid archive entry %q: %s", e.Name, e.Err)
+}
+
+func (e *EntryError) Unwrap() error {
+	return e.Err
+}
+
 func Untar(file io.Reader, path string) error {
+	return UntarWith(file, path, DefaultOptions)
+}
+
+// UntarWith extracts the archive in root. The entries cannot be written
+// outside of root, an *EntryError is returned for the first invalid entry.
+func UntarWith(file io.Reader, root string, opts Options) error {
 	gzr, err := gzip.NewReader(file)
 	if err != nil {
 		return err
 	}
 	defer gzr.Close()
 
+	if err := os.MkdirAll(root, 0755); err != nil {
+		return err
+	}
+
+	// two entries cannot be the same file on a case-insensitive system
+	insensitive, err := caseInsensitive(root)
+	if err != nil {
+		return fmt.Errorf("failed to check the file system: %w", err)
+	}
+	names := make(map[string]string)
+
 	tr := tar.NewReader(gzr)
 
+	var size int64
+	var count int
+	var links []string
+	var dirs []*tar.Header
 	for {
 		header, err := tr.Next()
 
 		switch {
 
-		// if no more files are found return
+		// if no more files are found, check where the links lead
 		case err == io.EOF:
+			for _, l := range links {
+				if fi, err := os.Lstat(l); err != nil || fi.Mode()&os.ModeSymlink == 0 {
+					continue // replaced by another entry
+				}
+				if err := resolve(root, l); err != nil {
+					os.Remove(l)
+					rel, _ := filepath.Rel(root, l)
+					return &EntryError{Name: filepath.ToSlash(rel), Err: err}
+				}
+			}
+
+			// the content of a directory changes its mtime: the deepest
+			// directories are done first, once every file is written
+			for i := len(dirs) - 1; i >= 0; i-- {
+				target, _ := join(root, dirs[i].Name)
+				if err := os.Chtimes(target, time.Time{}, dirs[i].ModTime); err != nil {
+					return err
+				}
+			}
 			return nil
 
 		// return any other error
@@ -36,12 +177,54 @@ func Untar(file io.Reader, path string) error {
 			continue
 		}
 
+		count++
+		if opts.MaxEntries > 0 && count > opts.MaxEntries {
+			return &EntryError{Name: header.Name, Err: ErrTooManyEntries}
+		}
+
+		if opts.Select != nil {
+			name, ok := opts.Select(normalize(header.Name))
+			if !ok {
+				continue
+			}
+			// a hard link cannot point to an entry that is not extracted
+			if header.Typeflag == tar.TypeLink {
+				if header.Linkname, ok = opts.Select(normalize(header.Linkname)); !ok {
+					if err := enforce(opts.Hardlinks, name, ErrLink); err != nil {
+						return err
+					}
+					continue
+				}
+			}
+			header.Name = name
+		}
+
 		// the target location where the dir/file should be created
-		target := filepath.Join(path, header.Name)
+		target, err := join(root, header.Name)
+		if err != nil {
+			return &EntryError{Name: header.Name, Err: err}
+		}
+
+		if insensitive {
+			name := path.Clean(normalize(header.Name))
+			key := strings.ToLower(name)
+			if v, ok := names[key]; ok && v != name {
+				return &EntryError{Name: header.Name, Err: ErrCaseCollision}
+			}
+			names[key] = name
+		}
 
-		// the following switch could also be done using fi.Mode(), not sure if there
-		// a benefit of using one vs. the other.
-		// fi := header.FileInfo()
+		// an entry cannot be written through a link made by a previous entry
+		if err := checkParents(root, target); err != nil {
+			return &EntryError{Name: header.Name, Err: err}
+		}
+
+		// and it replaces a link of the same name instead of writing through it
+		if fi, err := os.Lstat(target); err == nil && fi.Mode()&os.ModeSymlink != 0 && target != filepath.Clean(root) {
+			if err := os.Remove(target); err != nil {
+				return err
+			}
+		}
 
 		// check the file type
 		switch header.Typeflag {
@@ -53,34 +236,370 @@ func Untar(file io.Reader, path string) error {
 					return err
 				}
 			}
+			if err := os.Chmod(target, dirMode(header.Mode)); err != nil {
+				return err
+			}
+			dirs = append(dirs, header)
 
 		// if it's a file create it
 		case tar.TypeReg:
-			f, err := os.OpenFile(target, os.O_CREATE|os.O_RDWR, os.FileMode(header.Mode))
-			if err != nil {
+			if opts.MaxSize > 0 && size+header.Size > opts.MaxSize {
+				return &EntryError{Name: header.Name, Err: ErrTooLarge}
+			}
+
+			// some archives do not have an entry for each directory
+			if err := os.MkdirAll(filepath.Dir(target), 0755); err != nil {
 				return err
 			}
 
-			// copy over contents
-			if _, err := io.Copy(f, tr); err != nil {
+			f, err := os.OpenFile(target, os.O_CREATE|os.O_TRUNC|os.O_WRONLY, fileMode(header.Mode))
+			if err != nil {
 				return err
 			}
 
+			// copy over contents, the size in the header cannot be trusted
+			n, err := io.Copy(f, io.LimitReader(tr, header.Size))
+			size += n
+
 			// manually close here after each file operation; defering would cause each file close
 			// to wait until all operations have completed.
 			f.Close()
+			if err != nil {
+				return err
+			}
+
+			// the file may exist already with other permissions
+			if err := os.Chmod(target, fileMode(header.Mode)); err != nil {
+				return err
+			}
+			if err := os.Chtimes(target, time.Time{}, header.ModTime); err != nil {
+				return err
+			}
+
+		case tar.TypeSymlink:
+			if err := enforce(opts.Symlinks, header.Name, ErrLink); err != nil {
+				return err
+			}
+			if opts.Symlinks != Allow {
+				continue
+			}
+
+			// the link is resolved from its directory, it is checked again
+			// at the end once every link of the archive exists
+			linkname := filepath.FromSlash(normalize(header.Linkname))
+			if filepath.IsAbs(linkname) {
+				return &EntryError{Name: header.Name, Err: ErrUnsafePath}
+			}
+			dir, err := filepath.Rel(root, filepath.Dir(target))
+			if err != nil {
+				return err
+			}
+			if _, err := join(root, filepath.Join(dir, linkname)); err != nil {
+				return &EntryError{Name: header.Name, Err: err}
+			}
+
+			if err := os.Symlink(linkname, target); err != nil {
+				return err
+			}
+			links = append(links, target)
+
+		case tar.TypeLink:
+			if err := enforce(opts.Hardlinks, header.Name, ErrLink); err != nil {
+				return err
+			}
+			if opts.Hardlinks != Allow {
+				continue
+			}
+
+			// the link points to an entry of the archive
+			src, err := join(root, header.Linkname)
+			if err != nil {
+				return &EntryError{Name: header.Name, Err: err}
+			}
+			if err := checkParents(root, src); err != nil {
+				return &EntryError{Name: header.Name, Err: err}
+			}
+			if fi, err := os.Lstat(src); err != nil || !fi.Mode().IsRegular() {
+				return &EntryError{Name: header.Name, Err: ErrLink}
+			}
+
+			if err := os.Link(src, target); err != nil {
+				return err
+			}
+
+		case tar.TypeChar, tar.TypeBlock, tar.TypeFifo:
+			if err := enforce(opts.Special, header.Name, ErrSpecial); err != nil {
+				return err
+			}
 		}
 	}
 }
 
+// enforce returns an error if the policy rejects the entry
+func enforce(p Policy, name string, err error) error {
+	if p == Reject {
+		return &EntryError{Name: name, Err: err}
+	}
+	return nil
+}
+
+// normalize returns the slash-separated form of an entry name,
+// older archives made on Windows use backslashes
+func normalize(name string) string {
+	return strings.ReplaceAll(name, `\`, "/")
+}
+
+// join returns the location of name in root, name must be a relative
+// path that stays in root and that is valid on this system
+func join(root, name string) (string, error) {
+	name = normalize(name)
+	for _, part := range strings.Split(name, "/") {
+		if part == "" || part == "." || part == ".." {
+			continue
+		}
+		if !validName(part) {
+			return "", ErrInvalidName
+		}
+	}
+
+	name = filepath.FromSlash(name)
+	if filepath.IsAbs(name) || len(filepath.VolumeName(name)) > 0 || strings.HasPrefix(name, string(filepath.Separator)) {
+		return "", ErrUnsafePath
+	}
+
+	name = filepath.Clean(name)
+	if name == ".." || strings.HasPrefix(name, ".."+string(filepath.Separator)) {
+		return "", ErrUnsafePath
+	}
+
+	return filepath.Join(root, name), nil
+}
+
+// caseInsensitive reports whether the file system of dir ignores the case of the names
+func caseInsensitive(dir string) (bool, error) {
+	f, err := os.CreateTemp(dir, ".cloudsave-CASE-")
+	if err != nil {
+		return false, err
+	}
+	f.Close()
+	defer os.Remove(f.Name())
+
+	_, err = os.Stat(filepath.Join(dir, strings.ToLower(filepath.Base(f.Name()))))
+	return err == nil, nil
+}
+
+// checkParents fails if a directory between root and target is a link
+func checkParents(root, target string) error {
+	rel, err := filepath.Rel(root, filepath.Dir(target))
+	if err != nil {
+		return err
+	}
+	if rel == "." {
+		return nil
+	}
+
+	p := root
+	for _, part := range strings.Split(rel, string(filepath.Separator)) {
+		p = filepath.Join(p, part)
+		fi, err := os.Lstat(p)
+		if err != nil {
+			if errors.Is(err, os.ErrNotExist) {
+				return nil
+			}
+			return err
+		}
+		if fi.Mode()&os.ModeSymlink != 0 {
+			return ErrUnsafePath
+		}
+	}
+	return nil
+}
+
+// resolve follows the link like the system does and fails if the link
+// (or a link it goes through) leads outside of root
+func resolve(root, link string) error {
+	dir, err := filepath.Rel(root, filepath.Dir(link))
+	if err != nil {
+		return err
+	}
+
+	var cur []string
+	if dir != "." {
+		cur = strings.Split(dir, string(filepath.Separator))
+	}
+
+	target, err := os.Readlink(link)
+	if err != nil {
+		return err
+	}
+	// the path is not cleaned: "link/.." is not the same as "."
+	queue := strings.Split(target, string(filepath.Separator))
+
+	for hops := 0; len(queue) > 0; {
+		part := queue[0]
+		queue = queue[1:]
+
+		switch part {
+		case ".", "":
+			continue
+		case "..":
+			if len(cur) == 0 {
+				return ErrUnsafePath
+			}
+			cur = cur[:len(cur)-1]
+			continue
+		}
+
+		p := filepath.Join(append([]string{root}, append(cur, part)...)...)
+		fi, err := os.Lstat(p)
+		if err != nil || fi.Mode()&os.ModeSymlink == 0 {
+			cur = append(cur, part)
+			continue
+		}
+
+		hops++
+		if hops > 40 {
+			return ErrLink
+		}
+		t, err := os.Readlink(p)
+		if err != nil {
+			return err
+		}
+		if filepath.IsAbs(t) {
+			return ErrUnsafePath
+		}
+		queue = append(strings.Split(t, string(filepath.Separator)), queue...)
+	}
+
+	return nil
+}
+
+// stable removes what changes without the content being modified (access
+// time, owner of the files on this computer) so the same directory always
+// gives the same archive
+func stable(h *tar.Header) {
+	h.ModTime = h.ModTime.Truncate(time.Second)
+	if h.Typeflag == tar.TypeSymlink {
+		// the time of a link cannot be restored everywhere
+		h.ModTime = time.Unix(0, 0)
+	}
+	h.AccessTime = time.Time{}
+	h.ChangeTime = time.Time{}
+	h.Uid, h.Gid = 0, 0
+	h.Uname, h.Gname = "", ""
+}
+
+// fileMode keeps the permissions of the entry but not the special bits
+// (setuid, setgid, sticky), the owner can always read and write the file
+func fileMode(mode int64) os.FileMode {
+	return os.FileMode(mode)&os.ModePerm | 0600
+}
+
+// dirMode is fileMode for directories, the owner can always open them
+func dirMode(mode int64) os.FileMode {
+	return os.FileMode(mode)&os.ModePerm | 0700
+}
+
+// Manifest describes the regular files and the symbolic links of the
+// archive, indexed by their slash-separated path
+func Manifest(file io.Reader) (manifest.Manifest, error) {
+	gzr, err := gzip.NewReader(file)
+	if err != nil {
+		return manifest.Manifest{}, err
+	}
+	defer gzr.Close()
+
+	res := manifest.Manifest{Files: make(map[string]manifest.Entry)}
+	tr := tar.NewReader(gzr)
+	for {
+		header, err := tr.Next()
+		if err == io.EOF {
+			return res, nil
+		}
+		if err != nil {
+			return manifest.Manifest{}, err
+		}
+
+		e := manifest.Entry{Size: header.Size, ModTime: header.ModTime}
+		switch header.Typeflag {
+		case tar.TypeReg:
+			if e.Hash, err = hash.MD5(tr); err != nil {
+				return manifest.Manifest{}, err
+			}
+		case tar.TypeSymlink:
+			e.Link = normalize(header.Linkname)
+		default:
+			continue
+		}
+		res.Files[path.Clean(normalize(header.Name))] = e
+	}
+}
+
+type (
+	// memberWriter compresses each file of the archive in its own gzip member,
+	// the compressed data of a file does not depend on the previous files
+	// so the unchanged files are stored the same way from an archive to another
+	memberWriter struct {
+		dst     io.Writer
+		gw      *gzip.Writer
+		written bool
+	}
+)
+
+func (m *memberWriter) Write(p []byte) (int, error) {
+	m.written = m.written || len(p) > 0
+	return m.gw.Write(p)
+}
+
+// cut ends the current gzip member and starts a new one
+func (m *memberWriter) cut() error {
+	if !m.written {
+		return nil
+	}
+	if err := m.gw.Close(); err != nil {
+		return err
+	}
+	m.gw.Reset(m.dst)
+	m.written = false
+	return nil
+}
+
+func (m *memberWriter) Close() error {
+	return m.gw.Close()
+}
+
 func Tar(file io.Writer, root string) error {
-	gw := gzip.NewWriter(file)
+	return TarWith(file, root, nil)
+}
+
+// TarWith archives root like Tar, keep tells whether an entry is archived,
+// its name is slash-separated and relative to root. The content of a
+// directory that is not kept is skipped.
+func TarWith(file io.Writer, root string, keep func(name string, dir bool) bool) error {
+	return TarSources(file, Source{Root: root, Keep: keep})
+}
+
+// TarSources archives several directories in the same archive, the entries
+// of each source are named after its prefix. A source without prefix is at
+// the root of the archive.
+func TarSources(file io.Writer, sources ...Source) error {
+	gw := &memberWriter{dst: file, gw: gzip.NewWriter(file)}
 	defer gw.Close()
 
 	tw := tar.NewWriter(gw)
 	defer tw.Close()
 
-	// Walk again to add files
+	for _, src := range sources {
+		if err := tarSource(tw, gw, src); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func tarSource(tw *tar.Writer, gw *memberWriter, src Source) error {
+	root, keep := src.Root, src.Keep
+
 	err := filepath.Walk(root, func(path string, info os.FileInfo, walkErr error) error {
 		if walkErr != nil {
 			return fmt.Errorf("failed to walk through the directory: %w", walkErr)
@@ -91,12 +610,39 @@ func Tar(file io.Writer, root string) error {
 			return fmt.Errorf("failed to make relative path: %w", err)
 		}
 
+		if keep != nil && relpath != "." && !keep(filepath.ToSlash(relpath), info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		var link string
+		if info.Mode()&os.ModeSymlink != 0 {
+			if link, err = os.Readlink(path); err != nil {
+				return fmt.Errorf("failed to read link: %w", err)
+			}
+		}
+
 		// Create tar header
-		header, err := tar.FileInfoHeader(info, path)
+		header, err := tar.FileInfoHeader(info, link)
 		if err != nil {
 			return fmt.Errorf("failed to make file info header: %w", err)
 		}
-		header.Name = relpath
+		// the names are always slash-separated, whatever the system
+		header.Name = filepath.ToSlash(relpath)
+		if len(src.Prefix) > 0 {
+			header.Name = strings.TrimSuffix(src.Prefix+"/"+header.Name, "/.")
+		}
+		header.Linkname = filepath.ToSlash(header.Linkname)
+		stable(header)
+
+		if err := tw.Flush(); err != nil {
+			return fmt.Errorf("failed to write padding: %w", err)
+		}
+		if err := gw.cut(); err != nil {
+			return fmt.Errorf("failed to compress: %w", err)
+		}
 
 		if err := tw.WriteHeader(header); err != nil {
 			return fmt.Errorf("failed to write header: %w", err)
@@ -0,0 +1,342 @@
+package archive
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"runtime"
+	"testing"
+	"time"
+)
+
+// entry is an entry of a test archive
+type entry struct {
+	name     string
+	typeflag byte
+	body     string
+	linkname string
+}
+
+// makeArchive writes the entries in a gzip/tar archive
+func makeArchive(t *testing.T, entries ...entry) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	gw := gzip.NewWriter(buf)
+	tw := tar.NewWriter(gw)
+	for _, e := range entries {
+		h := &tar.Header{
+			Name:     e.name,
+			Typeflag: e.typeflag,
+			Linkname: e.linkname,
+			Mode:     0644,
+			ModTime:  time.Unix(1700000000, 0),
+		}
+		if e.typeflag == tar.TypeReg {
+			h.Size = int64(len(e.body))
+		}
+		if err := tw.WriteHeader(h); err != nil {
+			t.Fatal(err)
+		}
+		if _, err := tw.Write([]byte(e.body)); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err := tw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	if err := gw.Close(); err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func tarDir(t *testing.T, root string) []byte {
+	t.Helper()
+
+	buf := new(bytes.Buffer)
+	if err := Tar(buf, root); err != nil {
+		t.Fatalf("failed to tar %s: %s", root, err)
+	}
+	return buf.Bytes()
+}
+
+func writeFile(t *testing.T, path, content string, mode os.FileMode, mtime time.Time) {
+	t.Helper()
+
+	if err := os.MkdirAll(filepath.Dir(path), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.WriteFile(path, []byte(content), mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chmod(path, mode); err != nil {
+		t.Fatal(err)
+	}
+	if err := os.Chtimes(path, mtime, mtime); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestRoundTrip(t *testing.T) {
+	src := t.TempDir()
+	mtime := time.Date(2024, 3, 1, 12, 30, 0, 0, time.UTC)
+
+	writeFile(t, filepath.Join(src, "save.dat"), "progress", 0644, mtime)
+	writeFile(t, filepath.Join(src, "private.dat"), "secret", 0600, mtime.Add(time.Hour))
+	writeFile(t, filepath.Join(src, "slot", "1", "slot.dat"), "slot 1", 0755, mtime.Add(2*time.Hour))
+	if err := os.MkdirAll(filepath.Join(src, "empty"), 0755); err != nil {
+		t.Fatal(err)
+	}
+	if runtime.GOOS != "windows" {
+		if err := os.Symlink("save.dat", filepath.Join(src, "latest")); err != nil {
+			t.Fatal(err)
+		}
+	}
+	for _, dir := range []string{"empty", filepath.Join("slot", "1"), "slot"} {
+		if err := os.Chtimes(filepath.Join(src, dir), mtime, mtime); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	first := tarDir(t, src)
+
+	dst := t.TempDir()
+	if err := Untar(bytes.NewReader(first), dst); err != nil {
+		t.Fatalf("failed to untar: %s", err)
+	}
+
+	second := tarDir(t, dst)
+	if !bytes.Equal(first, second) {
+		t.Fatalf("the archive changed after a round trip: %d bytes, then %d bytes", len(first), len(second))
+	}
+
+	for _, name := range []string{"save.dat", "private.dat", filepath.Join("slot", "1", "slot.dat"), "empty", "slot"} {
+		want, err := os.Stat(filepath.Join(src, name))
+		if err != nil {
+			t.Fatal(err)
+		}
+		got, err := os.Stat(filepath.Join(dst, name))
+		if err != nil {
+			t.Fatalf("%s: %s", name, err)
+		}
+		if !got.ModTime().Equal(want.ModTime()) {
+			t.Errorf("%s: mtime is %s, expected %s", name, got.ModTime(), want.ModTime())
+		}
+		if runtime.GOOS != "windows" && got.Mode() != want.Mode() {
+			t.Errorf("%s: mode is %s, expected %s", name, got.Mode(), want.Mode())
+		}
+	}
+
+	if runtime.GOOS != "windows" {
+		link, err := os.Readlink(filepath.Join(dst, "latest"))
+		if err != nil {
+			t.Fatalf("the symlink is missing: %s", err)
+		}
+		if link != "save.dat" {
+			t.Errorf("the symlink points to %q, expected %q", link, "save.dat")
+		}
+	}
+}
+
+func TestUntarTruncates(t *testing.T) {
+	dst := t.TempDir()
+	writeFile(t, filepath.Join(dst, "save.dat"), "a much longer previous content", 0644, time.Now())
+
+	data := makeArchive(t, entry{name: "save.dat", typeflag: tar.TypeReg, body: "short"})
+	if err := Untar(bytes.NewReader(data), dst); err != nil {
+		t.Fatalf("failed to untar: %s", err)
+	}
+
+	got, err := os.ReadFile(filepath.Join(dst, "save.dat"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(got) != "short" {
+		t.Errorf("the content is %q, expected %q", got, "short")
+	}
+}
+
+func TestLinkPolicies(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the links need privileges on windows")
+	}
+
+	// the entries after a link must be extracted whatever the policy
+	data := makeArchive(t,
+		entry{name: "a.txt", typeflag: tar.TypeReg, body: "a"},
+		entry{name: "sym", typeflag: tar.TypeSymlink, linkname: "a.txt"},
+		entry{name: "hard", typeflag: tar.TypeLink, linkname: "a.txt"},
+		entry{name: "b.txt", typeflag: tar.TypeReg, body: "b"},
+	)
+
+	tests := []struct {
+		name      string
+		symlinks  Policy
+		hardlinks Policy
+		err       error
+		sym, hard bool
+	}{
+		{name: "allow", symlinks: Allow, hardlinks: Allow, sym: true, hard: true},
+		{name: "skip", symlinks: Skip, hardlinks: Skip},
+		{name: "skip symlinks", symlinks: Skip, hardlinks: Allow, hard: true},
+		{name: "skip hardlinks", symlinks: Allow, hardlinks: Skip, sym: true},
+		{name: "reject symlinks", symlinks: Reject, hardlinks: Skip, err: ErrLink},
+		{name: "reject hardlinks", symlinks: Skip, hardlinks: Reject, err: ErrLink},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			dst := t.TempDir()
+			opts := DefaultOptions
+			opts.Symlinks = tt.symlinks
+			opts.Hardlinks = tt.hardlinks
+
+			err := UntarWith(bytes.NewReader(data), dst, opts)
+			if tt.err != nil {
+				var entryErr *EntryError
+				if !errors.Is(err, tt.err) || !errors.As(err, &entryErr) {
+					t.Fatalf("got error %v, expected %v", err, tt.err)
+				}
+				return
+			}
+			if err != nil {
+				t.Fatalf("failed to untar: %s", err)
+			}
+
+			for _, name := range []string{"a.txt", "b.txt"} {
+				if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+					t.Errorf("%s is missing: %s", name, err)
+				}
+			}
+
+			fi, err := os.Lstat(filepath.Join(dst, "sym"))
+			if tt.sym && (err != nil || fi.Mode()&os.ModeSymlink == 0) {
+				t.Errorf("the symlink is missing")
+			}
+			if !tt.sym && err == nil {
+				t.Errorf("the symlink is extracted")
+			}
+
+			_, err = os.Lstat(filepath.Join(dst, "hard"))
+			if tt.hard && err != nil {
+				t.Errorf("the hardlink is missing: %s", err)
+			}
+			if !tt.hard && err == nil {
+				t.Errorf("the hardlink is extracted")
+			}
+		})
+	}
+}
+
+func TestUnsafeSymlink(t *testing.T) {
+	if runtime.GOOS == "windows" {
+		t.Skip("the links need privileges on windows")
+	}
+
+	data := makeArchive(t, entry{name: "escape", typeflag: tar.TypeSymlink, linkname: "../outside"})
+	err := Untar(bytes.NewReader(data), t.TempDir())
+	if !errors.Is(err, ErrUnsafePath) {
+		t.Fatalf("got error %v, expected %v", err, ErrUnsafePath)
+	}
+}
+
+func TestUnsafePaths(t *testing.T) {
+	for _, name := range []string{"../x", "save/../../x", "/abs/x"} {
+		t.Run(name, func(t *testing.T) {
+			root := filepath.Join(t.TempDir(), "root")
+			if err := os.Mkdir(root, 0755); err != nil {
+				t.Fatal(err)
+			}
+
+			data := makeArchive(t, entry{name: name, typeflag: tar.TypeReg, body: "x"})
+			err := Untar(bytes.NewReader(data), root)
+			if !errors.Is(err, ErrUnsafePath) {
+				t.Fatalf("got error %v, expected %v", err, ErrUnsafePath)
+			}
+			if _, err := os.Stat(filepath.Join(filepath.Dir(root), "x")); err == nil {
+				t.Errorf("the entry is written outside of the destination")
+			}
+		})
+	}
+}
+
+func TestLimits(t *testing.T) {
+	data := makeArchive(t,
+		entry{name: "a.txt", typeflag: tar.TypeReg, body: "aaaa"},
+		entry{name: "b.txt", typeflag: tar.TypeReg, body: "bbbb"},
+		entry{name: "c.txt", typeflag: tar.TypeReg, body: "cccc"},
+	)
+
+	tests := []struct {
+		name       string
+		maxSize    int64
+		maxEntries int
+		err        error
+	}{
+		{name: "no limit"},
+		{name: "size", maxSize: 12},
+		{name: "too large", maxSize: 10, err: ErrTooLarge},
+		{name: "entries", maxEntries: 3},
+		{name: "too many entries", maxEntries: 2, err: ErrTooManyEntries},
+	}
+
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			opts := DefaultOptions
+			opts.MaxSize = tt.maxSize
+			opts.MaxEntries = tt.maxEntries
+
+			err := UntarWith(bytes.NewReader(data), t.TempDir(), opts)
+			if tt.err == nil && err != nil {
+				t.Fatalf("failed to untar: %s", err)
+			}
+			if !errors.Is(err, tt.err) {
+				t.Fatalf("got error %v, expected %v", err, tt.err)
+			}
+		})
+	}
+}
+
+func TestSpecialPolicies(t *testing.T) {
+	for _, typeflag := range []byte{tar.TypeChar, tar.TypeBlock, tar.TypeFifo} {
+		data := makeArchive(t,
+			entry{name: "a.txt", typeflag: tar.TypeReg, body: "a"},
+			entry{name: "special", typeflag: typeflag},
+			entry{name: "b.txt", typeflag: tar.TypeReg, body: "b"},
+		)
+
+		// the special files are never created, Allow is the same as Skip
+		for _, policy := range []Policy{Allow, Skip, Reject} {
+			t.Run(fmt.Sprintf("%c/%s", typeflag, policy), func(t *testing.T) {
+				dst := t.TempDir()
+				opts := DefaultOptions
+				opts.Special = policy
+
+				err := UntarWith(bytes.NewReader(data), dst, opts)
+				if policy == Reject {
+					if !errors.Is(err, ErrSpecial) {
+						t.Fatalf("got error %v, expected %v", err, ErrSpecial)
+					}
+					return
+				}
+				if err != nil {
+					t.Fatalf("failed to untar: %s", err)
+				}
+
+				if _, err := os.Lstat(filepath.Join(dst, "special")); err == nil {
+					t.Errorf("the special file is created")
+				}
+				for _, name := range []string{"a.txt", "b.txt"} {
+					if _, err := os.Stat(filepath.Join(dst, name)); err != nil {
+						t.Errorf("%s is missing: %s", name, err)
+					}
+				}
+			})
+		}
+	}
+}
@@ -0,0 +1,12 @@
+//go:build !windows
+
+package archive
+
+import (
+	"strings"
+)
+
+// validName reports whether a file can have this name on this system
+func validName(name string) bool {
+	return !strings.ContainsRune(name, 0)
+}
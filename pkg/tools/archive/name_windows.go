@@ -0,0 +1,33 @@
+package archive
+
+import (
+	"strings"
+)
+
+// names reserved by Windows, with or without extension
+var reserved = map[string]struct{}{
+	"CON": {}, "PRN": {}, "AUX": {}, "NUL": {},
+	"COM1": {}, "COM2": {}, "COM3": {}, "COM4": {}, "COM5": {}, "COM6": {}, "COM7": {}, "COM8": {}, "COM9": {},
+	"LPT1": {}, "LPT2": {}, "LPT3": {}, "LPT4": {}, "LPT5": {}, "LPT6": {}, "LPT7": {}, "LPT8": {}, "LPT9": {},
+}
+
+// validName reports whether a file can have this name on this system
+func validName(name string) bool {
+	if strings.ContainsAny(name, `<>:"|?*`) {
+		return false
+	}
+	for _, r := range name {
+		if r < 32 {
+			return false
+		}
+	}
+
+	// Windows silently removes them, "a." and "a" would be the same file
+	if strings.HasSuffix(name, ".") || strings.HasSuffix(name, " ") {
+		return false
+	}
+
+	base, _, _ := strings.Cut(name, ".")
+	_, ok := reserved[strings.ToUpper(strings.TrimRight(base, " "))]
+	return !ok
+}
@@ -0,0 +1,74 @@
+package archive
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"io"
+)
+
+type (
+	// Validator checks that the data written to it are a gzip/tar archive,
+	// the archive is read as it is written so it can follow a copy
+	Validator struct {
+		pw   *io.PipeWriter
+		done chan error
+	}
+)
+
+var ErrInvalid = errors.New("the data are not a gzip/tar archive")
+
+func NewValidator() *Validator {
+	pr, pw := io.Pipe()
+	v := &Validator{pw: pw, done: make(chan error, 1)}
+
+	go func() {
+		err := Validate(pr)
+		// the rest of the data are dropped so that the writer never blocks
+		io.Copy(io.Discard, pr)
+		v.done <- err
+	}()
+
+	return v
+}
+
+func (v *Validator) Write(p []byte) (int, error) {
+	return v.pw.Write(p)
+}
+
+// Close ends the data and returns ErrInvalid if they are not an archive
+func (v *Validator) Close() error {
+	v.pw.Close()
+	return <-v.done
+}
+
+// Validate reads the whole archive, every gzip member and every tar entry,
+// and returns ErrInvalid if it is not complete and well-formed
+func Validate(r io.Reader) error {
+	gzr, err := gzip.NewReader(r)
+	if err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	defer gzr.Close()
+
+	tr := tar.NewReader(gzr)
+	for {
+		_, err := tr.Next()
+		if err == io.EOF {
+			break
+		}
+		if err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalid, err)
+		}
+		if _, err := io.Copy(io.Discard, tr); err != nil {
+			return fmt.Errorf("%w: %w", ErrInvalid, err)
+		}
+	}
+
+	// the padding after the end of the tar stream must be valid gzip as well
+	if _, err := io.Copy(io.Discard, gzr); err != nil {
+		return fmt.Errorf("%w: %w", ErrInvalid, err)
+	}
+	return nil
+}
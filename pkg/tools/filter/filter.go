@@ -0,0 +1,199 @@
+package filter
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"os"
+	"path"
+	"path/filepath"
+	"slices"
+	"strings"
+)
+
+type (
+	// Filter tells which files of a save directory are archived.
+	// A nil Filter keeps every file.
+	Filter struct {
+		include []pattern
+		exclude []pattern
+	}
+
+	pattern struct {
+		parts []string
+		// the pattern has a slash, it is matched from the root of the
+		// save directory instead of against the base name
+		anchored bool
+		// the pattern ends with a slash, it only matches directories
+		dirOnly bool
+	}
+)
+
+// IgnoreFile is read from the root of a save directory, it holds one
+// exclude pattern per line. It is always archived.
+const IgnoreFile = ".cloudsaveignore"
+
+var (
+	ErrBadPattern error = errors.New("invalid pattern")
+)
+
+// New makes a filter from glob patterns. The patterns use the syntax of
+// path.Match on slash-separated names, `**` matches any number of directories.
+// When include is empty, every file that is not excluded is kept.
+func New(include, exclude []string) (*Filter, error) {
+	f := new(Filter)
+	for _, v := range include {
+		p, err := parse(v)
+		if err != nil {
+			return nil, err
+		}
+		f.include = append(f.include, p)
+	}
+	for _, v := range exclude {
+		p, err := parse(v)
+		if err != nil {
+			return nil, err
+		}
+		f.exclude = append(f.exclude, p)
+	}
+	return f, nil
+}
+
+// Load makes a filter from the patterns and the ignore file of root, if any
+func Load(root string, include, exclude []string) (*Filter, error) {
+	lines, err := readIgnoreFile(filepath.Join(root, IgnoreFile))
+	if err != nil {
+		return nil, err
+	}
+	return New(include, append(slices.Clone(exclude), lines...))
+}
+
+func readIgnoreFile(name string) ([]string, error) {
+	f, err := os.Open(name)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to open %s: %w", IgnoreFile, err)
+	}
+	defer f.Close()
+
+	var lines []string
+	n := 0
+	s := bufio.NewScanner(f)
+	for s.Scan() {
+		n++
+		line := strings.TrimSpace(s.Text())
+		if len(line) == 0 || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if _, err := parse(line); err != nil {
+			return nil, fmt.Errorf("%s:%d: %w", IgnoreFile, n, err)
+		}
+		lines = append(lines, line)
+	}
+	if err := s.Err(); err != nil {
+		return nil, fmt.Errorf("failed to read %s: %w", IgnoreFile, err)
+	}
+	return lines, nil
+}
+
+func parse(v string) (pattern, error) {
+	v = strings.TrimSpace(v)
+
+	var p pattern
+	if strings.HasSuffix(v, "/") {
+		p.dirOnly = true
+		v = strings.TrimSuffix(v, "/")
+	}
+	if strings.Contains(v, "/") {
+		p.anchored = true
+		v = strings.TrimPrefix(v, "/")
+	}
+	if len(v) == 0 {
+		return pattern{}, fmt.Errorf("%w: empty pattern", ErrBadPattern)
+	}
+
+	p.parts = strings.Split(v, "/")
+	for _, part := range p.parts {
+		if len(part) == 0 {
+			return pattern{}, fmt.Errorf("%w: %q has an empty component", ErrBadPattern, v)
+		}
+		if _, err := path.Match(part, ""); err != nil {
+			return pattern{}, fmt.Errorf("%w: %q", ErrBadPattern, v)
+		}
+	}
+	return p, nil
+}
+
+// Match tells whether the entry name, slash-separated and relative to the
+// root of the save directory, is kept. A file is dropped when it or one of
+// its parents is excluded, or when there are include patterns and neither
+// the file nor its parents match one. Directories are only dropped when
+// they are excluded, they may contain included files.
+func (f *Filter) Match(name string, dir bool) bool {
+	if f == nil {
+		return true
+	}
+
+	name = strings.Trim(path.Clean(name), "/")
+	if name == "." || len(name) == 0 || name == IgnoreFile {
+		return true
+	}
+
+	parts := strings.Split(name, "/")
+	for i := range parts {
+		isDir := dir || i < len(parts)-1
+		for _, p := range f.exclude {
+			if p.match(parts[:i+1], isDir) {
+				return false
+			}
+		}
+	}
+
+	if len(f.include) == 0 || dir {
+		return true
+	}
+
+	for i := range parts {
+		isDir := i < len(parts)-1
+		for _, p := range f.include {
+			if p.match(parts[:i+1], isDir) {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+func (p pattern) match(parts []string, dir bool) bool {
+	if p.dirOnly && !dir {
+		return false
+	}
+	if !p.anchored {
+		ok, _ := path.Match(p.parts[0], parts[len(parts)-1])
+		return ok
+	}
+	return matchParts(p.parts, parts)
+}
+
+func matchParts(pattern, name []string) bool {
+	if len(pattern) == 0 {
+		return len(name) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(name); i++ {
+			if matchParts(pattern[1:], name[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(name) == 0 {
+		return false
+	}
+	if ok, _ := path.Match(pattern[0], name[0]); !ok {
+		return false
+	}
+	return matchParts(pattern[1:], name[1:])
+}
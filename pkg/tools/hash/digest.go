@@ -0,0 +1,195 @@
+package hash
+
+import (
+	"crypto"
+	_ "crypto/md5"
+	_ "crypto/sha256"
+	_ "crypto/sha512"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	gohash "hash"
+	"io"
+	"os"
+	"strings"
+)
+
+type (
+	// algorithm is a hash function of the digests, a digest is written
+	// "<name>:<hex>" and field is its name in the HTTP headers (RFC 9530)
+	algorithm struct {
+		hash  crypto.Hash
+		name  string
+		field string
+	}
+
+	// Hasher hashes data with several algorithms at once
+	Hasher struct {
+		hashes map[crypto.Hash]gohash.Hash
+	}
+)
+
+// Default is the algorithm of the new digests
+const Default = crypto.SHA256
+
+// algorithms are the known hash functions, the strongest first
+var algorithms = []algorithm{
+	{crypto.SHA512, "sha512", "sha-512"},
+	{crypto.SHA256, "sha256", "sha-256"},
+	{crypto.MD5, "md5", "md5"},
+}
+
+var ErrUnknownAlgorithm = errors.New("unknown digest algorithm")
+
+// Algorithms returns the known algorithms, the strongest first
+func Algorithms() []crypto.Hash {
+	res := make([]crypto.Hash, len(algorithms))
+	for i, a := range algorithms {
+		res[i] = a.hash
+	}
+	return res
+}
+
+func lookup(h crypto.Hash) (algorithm, bool) {
+	for _, a := range algorithms {
+		if a.hash == h {
+			return a, true
+		}
+	}
+	return algorithm{}, false
+}
+
+// Digest tags the hex-encoded sum with the name of its algorithm
+func Digest(h crypto.Hash, sum string) string {
+	a, ok := lookup(h)
+	if !ok {
+		return ""
+	}
+	return a.name + ":" + sum
+}
+
+// ParseDigest returns the algorithm and the hex-encoded sum of a digest.
+// A digest without a name is an md5 sum, as they were written before.
+func ParseDigest(d string) (crypto.Hash, string, error) {
+	name, sum, ok := strings.Cut(d, ":")
+	if !ok {
+		name, sum = "md5", d
+	}
+
+	for _, a := range algorithms {
+		if a.name != name {
+			continue
+		}
+		if b, err := hex.DecodeString(sum); err != nil || len(b) != a.hash.Size() {
+			return 0, "", fmt.Errorf("invalid %s digest: %q", name, sum)
+		}
+		return a.hash, sum, nil
+	}
+	return 0, "", fmt.Errorf("%w: %q", ErrUnknownAlgorithm, name)
+}
+
+// NewHasher returns a hasher for the algorithms, the unknown ones are ignored
+func NewHasher(hs ...crypto.Hash) *Hasher {
+	res := &Hasher{hashes: make(map[crypto.Hash]gohash.Hash)}
+	for _, h := range hs {
+		if _, ok := lookup(h); ok {
+			res.hashes[h] = h.New()
+		}
+	}
+	return res
+}
+
+func (h *Hasher) Write(p []byte) (int, error) {
+	for _, v := range h.hashes {
+		v.Write(p)
+	}
+	return len(p), nil
+}
+
+// Sum returns the hex-encoded sum of the algorithm, empty if the hasher
+// does not use it
+func (h *Hasher) Sum(alg crypto.Hash) string {
+	v, ok := h.hashes[alg]
+	if !ok {
+		return ""
+	}
+	return hex.EncodeToString(v.Sum(nil))
+}
+
+// Digest returns the digest of the algorithm, empty if the hasher does not
+// use it
+func (h *Hasher) Digest(alg crypto.Hash) string {
+	sum := h.Sum(alg)
+	if len(sum) == 0 {
+		return ""
+	}
+	return Digest(alg, sum)
+}
+
+// FileDigest returns the digest of the file with the algorithm
+func FileDigest(fp string, alg crypto.Hash) (string, error) {
+	f, err := os.OpenFile(fp, os.O_RDONLY, 0)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+
+	h := NewHasher(alg)
+	if _, err := io.Copy(h, f); err != nil {
+		return "", err
+	}
+	return h.Digest(alg), nil
+}
+
+// ReprDigest returns the value of a Repr-Digest header (RFC 9530) with the
+// digests of an archive, the invalid ones are left out
+func ReprDigest(digests ...string) string {
+	var members []string
+	for _, d := range digests {
+		h, sum, err := ParseDigest(d)
+		if err != nil {
+			continue
+		}
+		a, _ := lookup(h)
+		b, _ := hex.DecodeString(sum)
+		members = append(members, a.field+"=:"+base64.StdEncoding.EncodeToString(b)+":")
+	}
+	return strings.Join(members, ", ")
+}
+
+// ParseReprDigest returns the digests of a Repr-Digest header that have a
+// known algorithm, the strongest first
+func ParseReprDigest(v string) []string {
+	fields := make(map[string]string)
+	for _, member := range strings.Split(v, ",") {
+		field, value, ok := strings.Cut(strings.TrimSpace(member), "=")
+		if !ok {
+			continue
+		}
+
+		value, ok = strings.CutPrefix(value, ":")
+		if !ok {
+			continue
+		}
+		value, ok = strings.CutSuffix(value, ":")
+		if !ok {
+			continue
+		}
+		fields[strings.ToLower(field)] = value
+	}
+
+	var res []string
+	for _, a := range algorithms {
+		value, ok := fields[a.field]
+		if !ok {
+			continue
+		}
+		b, err := base64.StdEncoding.DecodeString(value)
+		if err != nil || len(b) != a.hash.Size() {
+			continue
+		}
+		res = append(res, a.name+":"+hex.EncodeToString(b))
+	}
+	return res
+}
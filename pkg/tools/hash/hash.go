@@ -14,8 +14,12 @@ func FileMD5(fp string) (string, error) {
 	}
 	defer f.Close()
 
+	return MD5(f)
+}
+
+func MD5(r io.Reader) (string, error) {
 	hasher := md5.New()
-	if _, err := io.Copy(hasher, f); err != nil {
+	if _, err := io.Copy(hasher, r); err != nil {
 		return "", err
 	}
 	sum := hasher.Sum(nil)
@@ -0,0 +1,125 @@
+package manifest
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/fs"
+	"os"
+	"time"
+)
+
+type (
+	// Manifest describes the regular files and the symbolic links of a save,
+	// indexed by their slash-separated name in the archive
+	Manifest struct {
+		// Date is when the files were read, the zero value if the manifest
+		// comes from an archive
+		Date  time.Time        `json:"date,omitzero"`
+		Files map[string]Entry `json:"files"`
+	}
+
+	Entry struct {
+		Size    int64     `json:"size"`
+		ModTime time.Time `json:"mtime"`
+		// Hash is the md5 hash of the content, empty for a symbolic link
+		Hash string `json:"hash,omitempty"`
+		// Link is the slash-separated target of a symbolic link
+		Link string `json:"link,omitempty"`
+	}
+)
+
+// racy is how long a file can be written after it was read without its
+// mtime being changed, on the file systems with a coarse clock (FAT)
+const racy = 2 * time.Second
+
+func New() Manifest {
+	return Manifest{
+		Date:  time.Now(),
+		Files: make(map[string]Entry),
+	}
+}
+
+// Cached returns the hash of the file from the manifest when it has the
+// same size and mtime, and was not modified right before the manifest
+// was made: its content may have changed since without its mtime changing
+func (m Manifest) Cached(name string, info fs.FileInfo) (string, bool) {
+	e, ok := m.Files[name]
+	if !ok || len(e.Hash) == 0 || m.Date.IsZero() {
+		return "", false
+	}
+	if e.Size != info.Size() || !e.ModTime.Equal(info.ModTime()) {
+		return "", false
+	}
+	if !e.ModTime.Before(m.Date.Add(-racy)) {
+		return "", false
+	}
+	return e.Hash, true
+}
+
+// Same tells whether the entries have the same content, the mtimes
+// are not compared
+func (e Entry) Same(o Entry) bool {
+	return e.Hash == o.Hash && e.Link == o.Link
+}
+
+// Equal tells whether both manifests have the same files with the same content
+func (m Manifest) Equal(o Manifest) bool {
+	if len(m.Files) != len(o.Files) {
+		return false
+	}
+	for name, e := range m.Files {
+		v, ok := o.Files[name]
+		if !ok || !e.Same(v) {
+			return false
+		}
+	}
+	return true
+}
+
+// Load reads the manifest at path, an empty manifest is returned if
+// the file does not exist
+func Load(path string) (Manifest, error) {
+	f, err := os.OpenFile(path, os.O_RDONLY, 0)
+	if err != nil {
+		if errors.Is(err, os.ErrNotExist) {
+			return Manifest{}, nil
+		}
+		return Manifest{}, fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer f.Close()
+
+	var m Manifest
+	d := json.NewDecoder(f)
+	if err := d.Decode(&m); err != nil {
+		return Manifest{}, fmt.Errorf("failed to parse manifest (%s): %w", path, err)
+	}
+
+	return m, nil
+}
+
+// Save writes the manifest at path, the previous one is kept until the
+// new one is fully written
+func Save(path string, m Manifest) error {
+	f, err := os.OpenFile(path+".tmp", os.O_CREATE|os.O_TRUNC|os.O_WRONLY, 0740)
+	if err != nil {
+		return fmt.Errorf("failed to open manifest: %w", err)
+	}
+	defer os.Remove(f.Name())
+	defer f.Close()
+
+	e := json.NewEncoder(f)
+	if err := e.Encode(m); err != nil {
+		return fmt.Errorf("failed to encode manifest: %w", err)
+	}
+
+	if err := f.Close(); err != nil {
+		return fmt.Errorf("failed to write manifest: %w", err)
+	}
+
+	if err := os.Rename(f.Name(), path); err != nil {
+		return fmt.Errorf("failed to replace manifest: %w", err)
+	}
+
+	return nil
+}
@@ -0,0 +1,103 @@
+package paths
+
+import (
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+var (
+	// ErrUndefined is returned when a variable has no value on this device
+	ErrUndefined error = errors.New("undefined variable")
+
+	// $VAR, ${VAR} or %VAR%
+	variable = regexp.MustCompile(`\$\{([A-Za-z_][A-Za-z0-9_]*)\}|\$([A-Za-z_][A-Za-z0-9_]*)|%([A-Za-z_][A-Za-z0-9_()]*)%`)
+
+	// the variables used by Portable, the most specific first
+	portable = []string{"STEAM", "XDG_DATA_HOME", "XDG_CONFIG_HOME", "LOCALAPPDATA", "APPDATA", "HOME"}
+)
+
+// Expand replaces the variables of a path ($VAR, ${VAR} or %VAR%) by their
+// value on this device. The environment variables are used first, then
+// HOME, XDG_DATA_HOME, XDG_CONFIG_HOME and STEAM (the root of the Steam
+// installation) get a default value when they are not set.
+func Expand(p string) (string, error) {
+	var err error
+	res := variable.ReplaceAllStringFunc(p, func(m string) string {
+		sub := variable.FindStringSubmatch(m)
+		name := sub[1] + sub[2] + sub[3]
+		v, ok := lookup(name)
+		if !ok {
+			if err == nil {
+				err = fmt.Errorf("%w: %s", ErrUndefined, name)
+			}
+			return m
+		}
+		return filepath.ToSlash(v)
+	})
+	if err != nil {
+		return "", err
+	}
+	return filepath.Clean(filepath.FromSlash(res)), nil
+}
+
+// Abs returns an absolute representation of p, a path that starts
+// with a variable is returned as is
+func Abs(p string) (string, error) {
+	v, err := Expand(p)
+	if err != nil {
+		return "", err
+	}
+	if v != filepath.Clean(p) && filepath.IsAbs(v) {
+		return p, nil
+	}
+	return filepath.Abs(p)
+}
+
+// Portable returns p with its beginning replaced by the variable it is in,
+// e.g. $XDG_DATA_HOME/game for /home/me/.local/share/game. The separators
+// are slashes so that the path can be expanded on another system.
+func Portable(p string) string {
+	p = filepath.Clean(p)
+	for _, name := range portable {
+		v, ok := lookup(name)
+		if !ok || !filepath.IsAbs(v) {
+			continue
+		}
+		v = filepath.Clean(v)
+		// a variable set to the root of the file system says nothing
+		if filepath.Dir(v) == v {
+			continue
+		}
+
+		rel, err := filepath.Rel(v, p)
+		if err != nil || rel == ".." || strings.HasPrefix(rel, ".."+string(filepath.Separator)) {
+			continue
+		}
+		if rel == "." {
+			return "$" + name
+		}
+		return "$" + name + "/" + filepath.ToSlash(rel)
+	}
+	return filepath.ToSlash(p)
+}
+
+func lookup(name string) (string, bool) {
+	if v, ok := os.LookupEnv(name); ok && len(v) > 0 {
+		return v, true
+	}
+	return builtin(name)
+}
+
+// firstDir returns the first directory that exists
+func firstDir(candidates ...string) (string, bool) {
+	for _, c := range candidates {
+		if fi, err := os.Stat(c); err == nil && fi.IsDir() {
+			return c, true
+		}
+	}
+	return "", false
+}
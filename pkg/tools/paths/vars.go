@@ -0,0 +1,32 @@
+//go:build !windows
+
+package paths
+
+import (
+	"os"
+	"path/filepath"
+)
+
+func builtin(name string) (string, bool) {
+	home, err := os.UserHomeDir()
+	if err != nil {
+		return "", false
+	}
+
+	switch name {
+	case "HOME":
+		return home, true
+	case "XDG_DATA_HOME":
+		return filepath.Join(home, ".local", "share"), true
+	case "XDG_CONFIG_HOME":
+		return filepath.Join(home, ".config"), true
+	case "STEAM":
+		return firstDir(
+			filepath.Join(home, ".steam", "steam"),
+			filepath.Join(home, ".local", "share", "Steam"),
+			filepath.Join(home, ".var", "app", "com.valvesoftware.Steam", "data", "Steam"),
+			filepath.Join(home, "Library", "Application Support", "Steam"),
+		)
+	}
+	return "", false
+}
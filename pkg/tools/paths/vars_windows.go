@@ -0,0 +1,23 @@
+package paths
+
+import (
+	"os"
+	"path/filepath"
+)
+
+func builtin(name string) (string, bool) {
+	switch name {
+	case "HOME":
+		home, err := os.UserHomeDir()
+		return home, err == nil
+	case "STEAM":
+		var candidates []string
+		for _, v := range []string{"ProgramFiles(x86)", "ProgramFiles"} {
+			if dir, ok := os.LookupEnv(v); ok {
+				candidates = append(candidates, filepath.Join(dir, "Steam"))
+			}
+		}
+		return firstDir(candidates...)
+	}
+	return "", false
+}